@@ -0,0 +1,542 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	openapiv2 "github.com/googleapis/gnostic/openapiv2"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/version"
+	clientversion "k8s.io/client-go/pkg/version"
+	"k8s.io/client-go/rest"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/kube"
+	"github.com/DaoCloud/ckube/log"
+	"github.com/DaoCloud/ckube/store"
+)
+
+// isNamespaced reports whether gvr is namespaced according to the config, which is filled from discovery at startup,
+// or the discovery of api server in cluster, ok is false if the scope is unknown.
+func isNamespaced(r *ReqContext, gvr store.GroupVersionResource, cluster string) (namespaced bool, ok bool) {
+	if p, ok := common.GetProxy(gvr.Group, gvr.Version, gvr.Resource); ok && p.Namespaced != nil {
+		return *p.Namespaced, true
+	}
+	client := r.ClusterClients[cluster]
+	if client == nil {
+		return false, false
+	}
+	return kube.ResourceScope(client, cluster, schema.GroupVersion{Group: gvr.Group, Version: gvr.Version}, gvr.Resource)
+}
+
+// discoveryTTL is how long the discovery documents and OpenAPI of api servers are cached.
+const discoveryTTL = 5 * time.Minute
+
+// mergedCluster is the cluster key of the merged multi-cluster discovery documents.
+const mergedCluster = "*"
+
+type docKey struct {
+	cluster string
+	path    string
+	accept  string
+}
+
+type discoveryDoc struct {
+	body        []byte
+	contentType string
+	etag        string
+	expire      time.Time
+}
+
+// discoveryDocs caches the documents, docKey - *discoveryDoc.
+var discoveryDocs sync.Map
+
+// upstreamError is a non 200 response of api server, which is passed to the client as it is.
+type upstreamError struct {
+	code int
+	doc  discoveryDoc
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("api server responds %d: %s", e.code, e.doc.body)
+}
+
+func newDiscoveryDoc(body []byte, contentType string) *discoveryDoc {
+	sum := sha256.Sum256(body)
+	return &discoveryDoc{
+		body:        body,
+		contentType: contentType,
+		etag:        `"` + hex.EncodeToString(sum[:]) + `"`,
+		expire:      time.Now().Add(discoveryTTL),
+	}
+}
+
+func cachedDoc(key docKey) *discoveryDoc {
+	if v, ok := discoveryDocs.Load(key); ok {
+		if doc := v.(*discoveryDoc); time.Now().Before(doc.expire) {
+			return doc
+		}
+	}
+	return nil
+}
+
+// fetchDoc gets the document of path from the api server of cluster.
+func fetchDoc(r *ReqContext, cluster, path, accept string) (*discoveryDoc, error) {
+	key := docKey{cluster: cluster, path: path, accept: accept}
+	if doc := cachedDoc(key); doc != nil {
+		return doc, nil
+	}
+	client := r.ClusterClients[cluster]
+	if client == nil {
+		return nil, fmt.Errorf("request cluster not found: %s", cluster)
+	}
+	c := client.Discovery().RESTClient().(*rest.RESTClient)
+	hc := http.Client{Transport: newUpstreamTransport(c.Client.Transport, cluster)}
+	ctx, cancel := context.WithTimeout(r.Request.Context(), time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Get().AbsPath(path).URL().String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	doc := newDiscoveryDoc(body, resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upstreamError{code: resp.StatusCode, doc: *doc}
+	}
+	discoveryDocs.Store(key, doc)
+	return doc, nil
+}
+
+// sortedClusters returns the clusters with the default cluster first.
+func sortedClusters(r *ReqContext) []string {
+	def := common.GetConfig().DefaultCluster
+	clusters := []string{}
+	for c := range r.ClusterClients {
+		if c != def {
+			clusters = append(clusters, c)
+		}
+	}
+	sort.Strings(clusters)
+	if _, ok := r.ClusterClients[def]; ok {
+		clusters = append([]string{def}, clusters...)
+	}
+	return clusters
+}
+
+func mergeAPIGroup(dst *v1.APIGroup, src v1.APIGroup) {
+	for _, v := range src.Versions {
+		found := false
+		for _, e := range dst.Versions {
+			if e.GroupVersion == v.GroupVersion {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst.Versions = append(dst.Versions, v)
+		}
+	}
+}
+
+// mergeDiscovery merges the discovery documents of path from clusters, the former takes precedence.
+func mergeDiscovery(path string, bodies [][]byte) (interface{}, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "api":
+		res := v1.APIVersions{}
+		for i, body := range bodies {
+			vs := v1.APIVersions{}
+			if err := json.Unmarshal(body, &vs); err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				res = vs
+				continue
+			}
+			for _, v := range vs.Versions {
+				if !sets.NewString(res.Versions...).Has(v) {
+					res.Versions = append(res.Versions, v)
+				}
+			}
+		}
+		return res, nil
+	case len(parts) == 1 && parts[0] == "apis":
+		res := v1.APIGroupList{}
+		for i, body := range bodies {
+			gl := v1.APIGroupList{}
+			if err := json.Unmarshal(body, &gl); err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				res = gl
+				continue
+			}
+			for _, g := range gl.Groups {
+				found := false
+				for j := range res.Groups {
+					if res.Groups[j].Name == g.Name {
+						mergeAPIGroup(&res.Groups[j], g)
+						found = true
+						break
+					}
+				}
+				if !found {
+					res.Groups = append(res.Groups, g)
+				}
+			}
+		}
+		return res, nil
+	case len(parts) == 2 && parts[0] == "apis":
+		res := v1.APIGroup{}
+		for i, body := range bodies {
+			g := v1.APIGroup{}
+			if err := json.Unmarshal(body, &g); err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				res = g
+				continue
+			}
+			mergeAPIGroup(&res, g)
+		}
+		return res, nil
+	default:
+		res := v1.APIResourceList{}
+		for i, body := range bodies {
+			rl := v1.APIResourceList{}
+			if err := json.Unmarshal(body, &rl); err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				res = rl
+				continue
+			}
+			for _, resource := range rl.APIResources {
+				found := false
+				for _, e := range res.APIResources {
+					if e.Name == resource.Name {
+						found = true
+						break
+					}
+				}
+				if !found {
+					res.APIResources = append(res.APIResources, resource)
+				}
+			}
+		}
+		return res, nil
+	}
+}
+
+// openAPIMaps are the maps of OpenAPI v2 and v3 merged from clusters.
+var openAPIMaps = [][]string{
+	{"paths"},
+	{"definitions"},
+	{"parameters"},
+	{"components", "schemas"},
+	{"components", "parameters"},
+	{"components", "responses"},
+}
+
+// mergeOpenAPI merges the OpenAPI documents of clusters, the paths and definitions of the former take precedence.
+func mergeOpenAPI(bodies [][]byte) (interface{}, error) {
+	res := map[string]interface{}{}
+	for i, body := range bodies {
+		spec := map[string]interface{}{}
+		if err := json.Unmarshal(body, &spec); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			res = spec
+			continue
+		}
+		for _, keys := range openAPIMaps {
+			src, dst := spec, res
+			for _, k := range keys {
+				src, _ = src[k].(map[string]interface{})
+			}
+			if len(src) == 0 {
+				continue
+			}
+			for _, k := range keys {
+				d, ok := dst[k].(map[string]interface{})
+				if !ok {
+					d = map[string]interface{}{}
+					dst[k] = d
+				}
+				dst = d
+			}
+			for k, v := range src {
+				if _, ok := dst[k]; !ok {
+					dst[k] = v
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// mimeOpenAPIProto is the content type of the OpenAPI v2 in protobuf, which is requested by client-go.
+const mimeOpenAPIProto = "application/com.github.proto-openapi.spec.v2@v1.0+protobuf"
+
+// mergedDoc gets the discovery document or OpenAPI of path merged from all clusters, clusters failed are ignored
+// unless all of them failed. The merged OpenAPI v2 is encoded in protobuf if accept is mimeOpenAPIProto.
+func mergedDoc(r *ReqContext, path, accept string) (*discoveryDoc, error) {
+	key := docKey{cluster: mergedCluster, path: path, accept: accept}
+	if doc := cachedDoc(key); doc != nil {
+		return doc, nil
+	}
+	bodies := [][]byte{}
+	var firstErr error
+	for _, c := range sortedClusters(r) {
+		doc, err := fetchDoc(r, c, path, "application/json")
+		if err != nil {
+			if _, ok := err.(*upstreamError); !ok {
+				log.Warnf("cluster(%s): get discovery %s error: %v", c, path, err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		bodies = append(bodies, doc.body)
+	}
+	if len(bodies) == 0 {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("no cluster available")
+		}
+		return nil, firstErr
+	}
+	var merged interface{}
+	var err error
+	if strings.HasPrefix(path, "/openapi/") {
+		merged, err = mergeOpenAPI(bodies)
+	} else {
+		merged, err = mergeDiscovery(path, bodies)
+	}
+	if err != nil {
+		return nil, err
+	}
+	bs, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	doc := newDiscoveryDoc(bs, "application/json")
+	if accept == mimeOpenAPIProto {
+		spec, err := openapiv2.ParseDocument(bs)
+		if err != nil {
+			return nil, err
+		}
+		if bs, err = proto.Marshal(spec); err != nil {
+			return nil, err
+		}
+		doc = newDiscoveryDoc(bs, mimeOpenAPIProto)
+	}
+	discoveryDocs.Store(key, doc)
+	return doc, nil
+}
+
+// offlineVerbs are the verbs of the resources without configured verbs when ckube serves without clusters.
+var offlineVerbs = v1.Verbs{"get", "list", "watch"}
+
+// offlineVersion returns the version of the kubernetes released with the client-go ckube is built with.
+func offlineVersion() version.Info {
+	info := clientversion.Get()
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, dep := range bi.Deps {
+		// client-go v0.x.y is released with kubernetes v1.x.y
+		if dep.Path == "k8s.io/client-go" && strings.HasPrefix(dep.Version, "v0.") {
+			info.GitVersion = "v1." + strings.TrimPrefix(dep.Version, "v0.")
+			info.Major = "1"
+			info.Minor = strings.SplitN(strings.TrimPrefix(dep.Version, "v0."), ".", 2)[0]
+		}
+	}
+	return info
+}
+
+// offlineDiscovery builds the discovery document of path from the proxies in the config, which is served
+// when there is no cluster, such as serving a dump or manifests. ok is false if path is not found.
+func offlineDiscovery(path string) (doc interface{}, ok bool) {
+	proxies := []common.Proxy{}
+	for _, p := range common.GetConfig().Proxies {
+		// patterns are expanded by the discovery of api servers
+		if !p.IsPattern() {
+			proxies = append(proxies, p)
+		}
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case path == "/version":
+		return offlineVersion(), true
+	case len(parts) == 1 && parts[0] == "api":
+		res := v1.APIVersions{Versions: []string{}}
+		for _, p := range proxies {
+			if p.Group == "" && !sets.NewString(res.Versions...).Has(p.Version) {
+				res.Versions = append(res.Versions, p.Version)
+			}
+		}
+		return res, true
+	case len(parts) == 1 && parts[0] == "apis":
+		res := v1.APIGroupList{Groups: []v1.APIGroup{}}
+		for _, p := range proxies {
+			if p.Group == "" {
+				continue
+			}
+			v := v1.GroupVersionForDiscovery{GroupVersion: p.Group + "/" + p.Version, Version: p.Version}
+			found := false
+			for i := range res.Groups {
+				if res.Groups[i].Name == p.Group {
+					mergeAPIGroup(&res.Groups[i], v1.APIGroup{Versions: []v1.GroupVersionForDiscovery{v}})
+					found = true
+					break
+				}
+			}
+			if !found {
+				res.Groups = append(res.Groups, v1.APIGroup{
+					Name:             p.Group,
+					Versions:         []v1.GroupVersionForDiscovery{v},
+					PreferredVersion: v,
+				})
+			}
+		}
+		return res, true
+	case len(parts) == 2 && parts[0] == "apis":
+		list, _ := offlineDiscovery("/apis")
+		for _, g := range list.(v1.APIGroupList).Groups {
+			if g.Name == parts[1] {
+				return g, true
+			}
+		}
+		return nil, false
+	case len(parts) == 2 && parts[0] == "api", len(parts) == 3 && parts[0] == "apis":
+		gv := schema.GroupVersion{Version: parts[len(parts)-1]}
+		if len(parts) == 3 {
+			gv.Group = parts[1]
+		}
+		res := v1.APIResourceList{GroupVersion: gv.String()}
+		for _, p := range proxies {
+			if p.Group != gv.Group || p.Version != gv.Version {
+				continue
+			}
+			resource := v1.APIResource{
+				Name:  p.Resource,
+				Kind:  p.Kind(),
+				Verbs: offlineVerbs,
+				// the resources without configured scope are namespaced like most of the resources
+				Namespaced: p.Namespaced == nil || *p.Namespaced,
+			}
+			if len(p.Verbs) > 0 {
+				resource.Verbs = p.Verbs
+			}
+			res.APIResources = append(res.APIResources, resource)
+		}
+		if len(res.APIResources) == 0 {
+			return nil, false
+		}
+		return res, true
+	}
+	return nil, false
+}
+
+func serveDoc(w http.ResponseWriter, r *http.Request, code int, doc discoveryDoc) {
+	w.Header().Set("ETag", doc.etag)
+	if doc.contentType != "" {
+		w.Header().Set("Content-Type", doc.contentType)
+	}
+	if code == http.StatusOK && r.Header.Get("If-None-Match") == doc.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(code)
+	_, _ = w.Write(doc.body)
+}
+
+// Discovery serves the discovery documents (/api, /apis), /version and OpenAPI from cache with ETag.
+// Without clusters, the discovery documents are built from the proxies in the config and OpenAPI is not found.
+// The discovery documents and OpenAPI are merged from all clusters unless the `cluster` query parameter is set,
+// /version is got from the default cluster by default.
+func Discovery(r *ReqContext) interface{} {
+	path := r.Request.URL.Path
+	if len(r.ClusterClients) == 0 {
+		res, ok := offlineDiscovery(path)
+		if !ok {
+			return errorProxy(r.Writer, v1.Status{
+				Status:  v1.StatusFailure,
+				Message: fmt.Sprintf("%s is not found without clusters", path),
+				Reason:  v1.StatusReasonNotFound,
+				Code:    404,
+			})
+		}
+		bs, err := json.Marshal(res)
+		if err != nil {
+			return err
+		}
+		serveDoc(r.Writer, r.Request, http.StatusOK, *newDiscoveryDoc(bs, "application/json"))
+		return nil
+	}
+	cluster := r.Request.URL.Query().Get("cluster")
+	var doc *discoveryDoc
+	var err error
+	accept := r.Request.Header.Get("Accept")
+	switch {
+	case cluster != "":
+		doc, err = fetchDoc(r, cluster, path, accept)
+	case path == "/version":
+		doc, err = fetchDoc(r, common.GetConfig().DefaultCluster, path, accept)
+	case strings.HasPrefix(path, "/openapi/"):
+		if clusters := sortedClusters(r); len(clusters) == 1 {
+			doc, err = fetchDoc(r, clusters[0], path, accept)
+			break
+		}
+		if path == "/openapi/v2" && strings.Contains(accept, "protobuf") {
+			accept = mimeOpenAPIProto
+		} else {
+			// the merged OpenAPI v3 is always in json
+			accept = ""
+		}
+		doc, err = mergedDoc(r, path, accept)
+	default:
+		doc, err = mergedDoc(r, path, "")
+	}
+	if err != nil {
+		if ue, ok := err.(*upstreamError); ok {
+			serveDoc(r.Writer, r.Request, ue.code, ue.doc)
+			return nil
+		}
+		return errorProxy(r.Writer, v1.Status{
+			Status:  v1.StatusFailure,
+			Message: "get discovery error",
+			Reason:  v1.StatusReason(err.Error()),
+			Code:    503,
+		})
+	}
+	serveDoc(r.Writer, r.Request, http.StatusOK, *doc)
+	return nil
+}
@@ -0,0 +1,299 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	openapiv2 "github.com/googleapis/gnostic/openapiv2"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/DaoCloud/ckube/common"
+)
+
+func TestMergeDiscovery(t *testing.T) {
+	marshal := func(v interface{}) []byte {
+		bs, _ := json.Marshal(v)
+		return bs
+	}
+	cases := []struct {
+		name   string
+		path   string
+		bodies [][]byte
+		expect interface{}
+	}{
+		{
+			name: "api versions",
+			path: "/api",
+			bodies: [][]byte{
+				marshal(metav1.APIVersions{Versions: []string{"v1"}}),
+				marshal(metav1.APIVersions{Versions: []string{"v1", "v2"}}),
+			},
+			expect: metav1.APIVersions{Versions: []string{"v1", "v2"}},
+		},
+		{
+			name: "group list",
+			path: "/apis",
+			bodies: [][]byte{
+				marshal(metav1.APIGroupList{Groups: []metav1.APIGroup{
+					{Name: "apps", Versions: []metav1.GroupVersionForDiscovery{{GroupVersion: "apps/v1", Version: "v1"}}},
+				}}),
+				marshal(metav1.APIGroupList{Groups: []metav1.APIGroup{
+					{Name: "apps", Versions: []metav1.GroupVersionForDiscovery{{GroupVersion: "apps/v1beta1", Version: "v1beta1"}}},
+					{Name: "example.com", Versions: []metav1.GroupVersionForDiscovery{{GroupVersion: "example.com/v1", Version: "v1"}}},
+				}}),
+			},
+			expect: metav1.APIGroupList{Groups: []metav1.APIGroup{
+				{Name: "apps", Versions: []metav1.GroupVersionForDiscovery{
+					{GroupVersion: "apps/v1", Version: "v1"},
+					{GroupVersion: "apps/v1beta1", Version: "v1beta1"},
+				}},
+				{Name: "example.com", Versions: []metav1.GroupVersionForDiscovery{{GroupVersion: "example.com/v1", Version: "v1"}}},
+			}},
+		},
+		{
+			name: "group",
+			path: "/apis/apps",
+			bodies: [][]byte{
+				marshal(metav1.APIGroup{Name: "apps", Versions: []metav1.GroupVersionForDiscovery{{GroupVersion: "apps/v1", Version: "v1"}}}),
+				marshal(metav1.APIGroup{Name: "apps", Versions: []metav1.GroupVersionForDiscovery{{GroupVersion: "apps/v1", Version: "v1"}}}),
+			},
+			expect: metav1.APIGroup{Name: "apps", Versions: []metav1.GroupVersionForDiscovery{{GroupVersion: "apps/v1", Version: "v1"}}},
+		},
+		{
+			name: "resources",
+			path: "/apis/example.com/v1",
+			bodies: [][]byte{
+				marshal(metav1.APIResourceList{GroupVersion: "example.com/v1", APIResources: []metav1.APIResource{{Name: "foos", Kind: "Foo"}}}),
+				marshal(metav1.APIResourceList{GroupVersion: "example.com/v1", APIResources: []metav1.APIResource{
+					{Name: "foos", Kind: "Foo2"},
+					{Name: "bars", Kind: "Bar"},
+				}}),
+			},
+			expect: metav1.APIResourceList{GroupVersion: "example.com/v1", APIResources: []metav1.APIResource{
+				{Name: "foos", Kind: "Foo"},
+				{Name: "bars", Kind: "Bar"},
+			}},
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			res, err := mergeDiscovery(c.path, c.bodies)
+			assert.NoError(t, err)
+			assert.Equal(t, c.expect, res)
+		})
+	}
+}
+
+type recordWriter struct {
+	header http.Header
+	code   int
+	body   []byte
+}
+
+func (w *recordWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *recordWriter) Write(bs []byte) (int, error) {
+	w.body = append(w.body, bs...)
+	return len(bs), nil
+}
+
+func (w *recordWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+func TestDiscovery(t *testing.T) {
+	common.InitConfig(&common.Config{DefaultCluster: "discovery-c1"})
+	var hits int32
+	newServer := func(versions []string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			switch r.URL.Path {
+			case "/api":
+				bs, _ := json.Marshal(metav1.APIVersions{Versions: versions})
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write(bs)
+			case "/openapi/v2":
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = fmt.Fprintf(w, `{"swagger":"2.0","info":{"title":"Kubernetes","version":"v1.21.0"},
+					"paths":{"/api/%s/":{"get":{"responses":{"200":{"description":"OK"}}}}},
+					"definitions":{"io.k8s.%s":{"type":"object"},"io.k8s.shared":{"description":"%s"}}}`,
+					versions[0], versions[0], versions[0])
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"kind":"Status","code":404}`))
+			}
+		}))
+	}
+	s1, s2 := newServer([]string{"v1"}), newServer([]string{"v2"})
+	defer s1.Close()
+	defer s2.Close()
+	c1, _ := kubernetes.NewForConfig(&rest.Config{Host: s1.URL})
+	c2, _ := kubernetes.NewForConfig(&rest.Config{Host: s2.URL})
+	clients := map[string]kubernetes.Interface{"discovery-c1": c1, "discovery-c2": c2}
+	do := func(path string, header map[string]string) *recordWriter {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := &recordWriter{header: http.Header{}}
+		assert.Nil(t, Discovery(&ReqContext{ClusterClients: clients, Request: req, Writer: w}))
+		return w
+	}
+
+	w := do("/api", nil)
+	assert.Equal(t, http.StatusOK, w.code)
+	assert.JSONEq(t, `{"versions":["v1","v2"],"serverAddressByClientCIDRs":null}`, string(w.body))
+	etag := w.header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+
+	// cached and not modified
+	w = do("/api", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, w.code)
+	assert.Empty(t, w.body)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+
+	w = do("/api?cluster=discovery-c2", nil)
+	assert.Equal(t, http.StatusOK, w.code)
+	assert.JSONEq(t, `{"versions":["v2"],"serverAddressByClientCIDRs":null}`, string(w.body))
+
+	// OpenAPI is merged from all clusters, the definitions of the default cluster take precedence
+	w = do("/openapi/v2", map[string]string{"Accept": "application/json"})
+	assert.Equal(t, http.StatusOK, w.code)
+	assert.JSONEq(t, `{"swagger":"2.0","info":{"title":"Kubernetes","version":"v1.21.0"},
+		"paths":{"/api/v1/":{"get":{"responses":{"200":{"description":"OK"}}}},
+			"/api/v2/":{"get":{"responses":{"200":{"description":"OK"}}}}},
+		"definitions":{"io.k8s.v1":{"type":"object"},"io.k8s.v2":{"type":"object"},
+			"io.k8s.shared":{"description":"v1"}}}`, string(w.body))
+
+	w = do("/openapi/v2", map[string]string{"Accept": mimeOpenAPIProto})
+	assert.Equal(t, http.StatusOK, w.code)
+	assert.Equal(t, mimeOpenAPIProto, w.header.Get("Content-Type"))
+	spec := &openapiv2.Document{}
+	assert.NoError(t, proto.Unmarshal(w.body, spec))
+	assert.Len(t, spec.GetPaths().GetPath(), 2)
+	assert.Len(t, spec.GetDefinitions().GetAdditionalProperties(), 3)
+
+	w = do("/apis/example.com", nil)
+	assert.Equal(t, http.StatusNotFound, w.code)
+	assert.Equal(t, `{"kind":"Status","code":404}`, string(w.body))
+}
+
+func TestDiscovery_CircuitOpen(t *testing.T) {
+	common.InitConfig(&common.Config{
+		DefaultCluster: "discovery-circuit-open",
+		Upstream:       common.Upstream{Retries: -1, BreakerFailures: 1, BreakerSeconds: 60},
+	})
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	client, _ := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "/apis", nil)
+		w := &recordWriter{header: http.Header{}}
+		Discovery(&ReqContext{
+			ClusterClients: map[string]kubernetes.Interface{"discovery-circuit-open": client},
+			Request:        req,
+			Writer:         w,
+		})
+		assert.Equal(t, http.StatusServiceUnavailable, w.code)
+	}
+	// the second request fails fast without requesting the api server
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestOfflineDiscovery(t *testing.T) {
+	clusterScoped := false
+	common.InitConfig(&common.Config{
+		DefaultCluster: "default",
+		Proxies: []common.Proxy{
+			{Version: "v1", Resource: "pods", ListKind: "PodList"},
+			{Version: "v1", Resource: "nodes", ListKind: "NodeList", Namespaced: &clusterScoped},
+			{Group: "apps", Version: "v1", Resource: "deployments", ListKind: "DeploymentList", Verbs: []string{"get", "list"}},
+			{Group: "example.com", Version: "v1", Resource: common.ResourceAll},
+		},
+	})
+	do := func(path string) *recordWriter {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		w := &recordWriter{header: http.Header{}}
+		res := Discovery(&ReqContext{Request: req, Writer: w})
+		if res != nil {
+			bs, _ := json.Marshal(res)
+			w.body = bs
+		}
+		return w
+	}
+	cases := []struct {
+		path   string
+		code   int
+		expect string
+	}{
+		{
+			path:   "/api",
+			code:   http.StatusOK,
+			expect: `{"versions":["v1"],"serverAddressByClientCIDRs":null}`,
+		},
+		{
+			path: "/apis",
+			code: http.StatusOK,
+			expect: `{"groups":[{"name":"apps","versions":[{"groupVersion":"apps/v1","version":"v1"}],
+				"preferredVersion":{"groupVersion":"apps/v1","version":"v1"}}]}`,
+		},
+		{
+			path: "/apis/apps",
+			code: http.StatusOK,
+			expect: `{"name":"apps","versions":[{"groupVersion":"apps/v1","version":"v1"}],
+				"preferredVersion":{"groupVersion":"apps/v1","version":"v1"}}`,
+		},
+		{
+			path: "/api/v1",
+			code: http.StatusOK,
+			expect: `{"groupVersion":"v1","resources":[
+				{"name":"pods","singularName":"","namespaced":true,"kind":"Pod","verbs":["get","list","watch"]},
+				{"name":"nodes","singularName":"","namespaced":false,"kind":"Node","verbs":["get","list","watch"]}]}`,
+		},
+		{
+			path: "/apis/apps/v1",
+			code: http.StatusOK,
+			expect: `{"groupVersion":"apps/v1","resources":[
+				{"name":"deployments","singularName":"","namespaced":true,"kind":"Deployment","verbs":["get","list"]}]}`,
+		},
+		{
+			path: "/apis/example.com/v1",
+			code: http.StatusNotFound,
+		},
+		{
+			path: "/openapi/v2",
+			code: http.StatusNotFound,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.path), func(t *testing.T) {
+			w := do(c.path)
+			assert.Equal(t, c.code, w.code)
+			if c.expect != "" {
+				assert.JSONEq(t, c.expect, string(w.body))
+			}
+		})
+	}
+
+	w := do("/version")
+	assert.Equal(t, http.StatusOK, w.code)
+	v := version.Info{}
+	assert.NoError(t, json.Unmarshal(w.body, &v))
+	assert.NotEmpty(t, v.GitVersion)
+}
@@ -1,7 +1,7 @@
 package extend
 
 import (
-	"strings"
+	"fmt"
 
 	"github.com/gorilla/mux"
 	v1 "k8s.io/api/core/v1"
@@ -10,17 +10,23 @@ import (
 
 	"github.com/DaoCloud/ckube/api"
 	"github.com/DaoCloud/ckube/common"
-	"github.com/DaoCloud/ckube/page"
 	"github.com/DaoCloud/ckube/store"
-	"github.com/DaoCloud/ckube/utils"
+	"github.com/DaoCloud/ckube/store/relation"
 	"github.com/DaoCloud/ckube/watcher"
 )
 
+// Deploy2Service returns the services of the pods of a deployment, the pods are resolved by the relation engine
+// through the ownerReferences chain (Deployment → ReplicaSet → Pod) and the selector of the deployment.
 func Deploy2Service(r *api.ReqContext) interface{} {
 	cluster := mux.Vars(r.Request)["cluster"]
 	ns := mux.Vars(r.Request)["namespace"]
 	dep := mux.Vars(r.Request)["deployment"]
 	services := []*v1.Service{}
+	depGvr := store.GroupVersionResource{
+		Group:    "apps",
+		Version:  "v1",
+		Resource: "deployments",
+	}
 	podGvr := store.GroupVersionResource{
 		Group:    "",
 		Version:  "v1",
@@ -34,35 +40,27 @@ func Deploy2Service(r *api.ReqContext) interface{} {
 	if cluster == "" {
 		cluster = common.GetConfig().DefaultCluster
 	}
-	p := page.Paginate{Search: "name=" + dep}
-	_ = p.Clusters([]string{cluster})
-	res := r.Store.Query(podGvr, store.Query{
-		Namespace: ns,
-		Paginate:  p,
-	})
-	if res.Error != nil {
-		return res.Error
+	if !r.Store.IsStoreGVR(depGvr) {
+		return statusError(400, v12.StatusReasonBadRequest, fmt.Sprintf("resource %v is not cached", depGvr))
 	}
-	var labels map[string]string
-	for _, podIf := range res.Items {
-		if pod, ok := podIf.(v12.Object); ok {
-			depName := getDeploymentName(pod)
-			if depName != "" {
-				labels = pod.GetLabels()
-				break
-			}
-		}
+	deployment := r.Store.Get(depGvr, cluster, ns, dep)
+	if deployment == nil {
+		return services
+	}
+	engine := relation.NewEngine(r.Store)
+	pods, err := engine.Related(cluster, depGvr, deployment, podGvr)
+	if err != nil {
+		return err
+	}
+	if len(pods) == 0 {
+		return services
 	}
-	p = page.Paginate{}
-	_ = p.Clusters([]string{cluster})
-	res = r.Store.Query(svcGvr, store.Query{
-		Namespace: ns,
-		Paginate:  p,
-	})
-	if res.Error != nil {
-		return res.Error
+	// the pods of a deployment share the labels of its template
+	items, err := engine.Related(cluster, podGvr, pods[0], svcGvr)
+	if err != nil {
+		return err
 	}
-	for _, svcIf := range res.Items {
+	for _, svcIf := range items {
 		svc := &v1.Service{}
 		if s, ok := svcIf.(*watcher.ObjType); ok {
 			bs, _ := json.Marshal(s)
@@ -70,18 +68,7 @@ func Deploy2Service(r *api.ReqContext) interface{} {
 		} else {
 			svc = svcIf.(*v1.Service)
 		}
-		if svc.Spec.Selector != nil && utils.IsSubsetOf(svc.Spec.Selector, labels) {
-			services = append(services, svc)
-		}
+		services = append(services, svc)
 	}
 	return services
 }
-
-func getDeploymentName(pod v12.Object) string {
-	if len(pod.GetOwnerReferences()) == 0 || pod.GetOwnerReferences()[0].Kind != "ReplicaSet" {
-		return ""
-	} else {
-		parts := strings.Split(pod.GetOwnerReferences()[0].Name, "-")
-		return strings.Join(parts[:len(parts)-1], "-")
-	}
-}
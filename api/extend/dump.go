@@ -0,0 +1,49 @@
+package extend
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/DaoCloud/ckube/api"
+	"github.com/DaoCloud/ckube/log"
+)
+
+// CacheDump writes the dump of the cache as a gzip compressed file, which can be served by cacheproxy offline.
+// The dump is written to a temporary file first, so that an error is returned as the status instead of
+// an incomplete file.
+func CacheDump(r *api.ReqContext) interface{} {
+	f, err := os.CreateTemp("", "ckube-*.dump.gz")
+	if err != nil {
+		return statusError(500, v1.StatusReasonInternalError, fmt.Sprintf("dump cache error: %v", err))
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	if err := r.Store.Dump(f); err != nil {
+		return statusError(500, v1.StatusReasonInternalError, fmt.Sprintf("dump cache error: %v", err))
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return statusError(500, v1.StatusReasonInternalError, fmt.Sprintf("dump cache error: %v", err))
+	}
+	r.Writer.Header().Set("Content-Type", "application/gzip")
+	r.Writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	r.Writer.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=ckube-%s.dump.gz", time.Now().Format("20060102150405")))
+	r.Writer.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(r.Writer, f); err != nil {
+		// the client gets less than Content-Length
+		log.Errorf("write cache dump error: %v", err)
+	}
+	return nil
+}
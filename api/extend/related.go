@@ -0,0 +1,92 @@
+package extend
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/mux"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/DaoCloud/ckube/api"
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/store"
+	"github.com/DaoCloud/ckube/store/relation"
+)
+
+func statusError(code int32, reason v1.StatusReason, message string) v1.Status {
+	return v1.Status{
+		TypeMeta: v1.TypeMeta{
+			Kind:       "Status",
+			APIVersion: "v1",
+		},
+		Status:  v1.StatusFailure,
+		Message: message,
+		Reason:  reason,
+		Code:    code,
+	}
+}
+
+// Related returns the cached objects of the `kind` query parameter related to the requested object,
+// `kind` can be a resource name (pods), resource with group (deployments.apps) or a kind (Deployment).
+// The comma separated `clusters` query parameter looks up the object with the same name in each of the
+// clusters, the relations are resolved in the cluster of each object.
+func Related(r *api.ReqContext) interface{} {
+	cluster := mux.Vars(r.Request)["cluster"]
+	ns := mux.Vars(r.Request)["namespace"]
+	kind := mux.Vars(r.Request)["kind"]
+	name := mux.Vars(r.Request)["name"]
+	if cluster == "" {
+		cluster = common.GetConfig().DefaultCluster
+	}
+	clusters := []string{cluster}
+	if cs := r.Request.URL.Query().Get("clusters"); cs != "" {
+		clusters = strings.Split(cs, ",")
+	}
+	source, ok := common.FindProxy(kind)
+	if !ok {
+		return statusError(404, v1.StatusReasonNotFound, fmt.Sprintf("resource %s is not cached", kind))
+	}
+	targetKind := r.Request.URL.Query().Get("kind")
+	if targetKind == "" {
+		return statusError(400, v1.StatusReasonBadRequest, "query parameter kind is required")
+	}
+	target, ok := common.FindProxy(targetKind)
+	if !ok {
+		return statusError(400, v1.StatusReasonBadRequest, fmt.Sprintf("resource %s is not cached", targetKind))
+	}
+	gvr := store.GroupVersionResource{
+		Group:    source.Group,
+		Version:  source.Version,
+		Resource: source.Resource,
+	}
+	targetGVR := store.GroupVersionResource{
+		Group:    target.Group,
+		Version:  target.Version,
+		Resource: target.Resource,
+	}
+	engine := relation.NewEngine(r.Store)
+	found := false
+	items := make([]interface{}, 0)
+	for _, c := range clusters {
+		obj := r.Store.Get(gvr, c, ns, name)
+		if obj == nil {
+			continue
+		}
+		found = true
+		related, err := engine.Related(c, gvr, obj, targetGVR)
+		if err != nil {
+			return statusError(400, v1.StatusReasonBadRequest, err.Error())
+		}
+		items = append(items, related...)
+	}
+	if !found {
+		return statusError(404, v1.StatusReasonNotFound,
+			fmt.Sprintf("%s %q not found in cluster %s", source.Resource, name, strings.Join(clusters, ",")))
+	}
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "List",
+		"metadata":   map[string]interface{}{},
+		"items":      items,
+	}
+}
@@ -0,0 +1,10 @@
+package extend
+
+import (
+	"github.com/DaoCloud/ckube/api"
+)
+
+// CacheStatus returns the usage and the limits of the cache, and how each resource is cached.
+func CacheStatus(r *api.ReqContext) interface{} {
+	return r.Store.Status()
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/DaoCloud/ckube/store"
+)
+
+// StreamingResponse is a response encoded to the writer piece by piece instead of being marshaled at once.
+type StreamingResponse interface {
+	EncodeJSON(w io.Writer) error
+}
+
+// List is the list response of cached resources, the items are encoded one by one so that
+// the memory of a request is not proportional to the size of the list. It can be encoded only once.
+type List struct {
+	APIVersion string
+	Kind       string
+	Metadata   map[string]interface{}
+	Items      store.Iterator
+}
+
+// EncodeJSON encodes the list as json.Marshal does for the map of the list.
+func (l *List) EncodeJSON(w io.Writer) error {
+	write := func(v interface{}) error {
+		bs, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(bs)
+		return err
+	}
+	if _, err := io.WriteString(w, `{"apiVersion":`); err != nil {
+		return err
+	}
+	if err := write(l.APIVersion); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, `,"items":[`); err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		item, ok := l.Items.Next()
+		if !ok {
+			break
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := write(item); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(w, `],"kind":`); err != nil {
+		return err
+	}
+	if err := write(l.Kind); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, `,"metadata":`); err != nil {
+		return err
+	}
+	if err := write(l.Metadata); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "}")
+	return err
+}
+
+func (l *List) MarshalJSON() ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := l.EncodeJSON(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DaoCloud/ckube/store"
+)
+
+func TestList_EncodeJSON(t *testing.T) {
+	metadata := map[string]interface{}{"remainingItemCount": int64(0), "selfLink": "/api/v1/pods?a=<b>"}
+	cases := []struct {
+		name  string
+		items []interface{}
+	}{
+		{
+			name:  "empty",
+			items: []interface{}{},
+		},
+		{
+			name:  "one",
+			items: testPods,
+		},
+		{
+			name:  "many",
+			items: append(append([]interface{}{}, testPods...), map[string]interface{}{"name": "a\"b"}, "c"),
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			l := &List{
+				APIVersion: "v1",
+				Kind:       "PodList",
+				Metadata:   metadata,
+				Items:      store.NewSliceIterator(c.items),
+			}
+			buf := bytes.Buffer{}
+			assert.NoError(t, l.EncodeJSON(&buf))
+			expect, _ := json.Marshal(map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "PodList",
+				"metadata":   metadata,
+				"items":      c.items,
+			})
+			assert.Equal(t, string(expect), buf.String())
+		})
+	}
+}
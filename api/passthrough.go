@@ -0,0 +1,94 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/log"
+)
+
+type proxyErrorResponder struct {
+	cluster string
+}
+
+func (p proxyErrorResponder) Error(w http.ResponseWriter, req *http.Request, err error) {
+	if errors.Is(err, errCircuitOpen) {
+		retryAfter := upstreamOf(p.cluster).breaker.retryAfter()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		bs, _ := json.Marshal(errorProxy(w, v1.Status{
+			Status:  v1.StatusFailure,
+			Message: fmt.Sprintf("api server of cluster %s is unavailable", p.cluster),
+			Reason:  v1.StatusReasonServiceUnavailable,
+			Code:    http.StatusServiceUnavailable,
+		}))
+		_, _ = w.Write(bs)
+		return
+	}
+	log.Warnf("cluster(%s): proxy %s error: %v", p.cluster, req.URL.Path, err)
+	bs, _ := json.Marshal(errorProxy(w, v1.Status{
+		Status:  v1.StatusFailure,
+		Message: err.Error(),
+		Reason:  v1.StatusReasonServiceUnavailable,
+		Code:    http.StatusBadGateway,
+	}))
+	_, _ = w.Write(bs)
+}
+
+// requestTimeout returns the timeout parameter of the request, or the default timeout of upstream.
+func requestTimeout(r *http.Request) time.Duration {
+	if timeout, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil && timeout > 0 {
+		return timeout
+	}
+	return time.Duration(common.GetConfig().Upstream.WithDefaults().TimeoutSeconds) * time.Second
+}
+
+// reverseProxy passes the request to api server of cluster with the transport of the cluster client,
+// the headers, status code and body of the response are written to the client as is.
+func reverseProxy(r *ReqContext, cluster string, modify func(*http.Response) error) interface{} {
+	c := r.ClusterClients[cluster].Discovery().RESTClient().(*rest.RESTClient)
+	target := c.Get().AbsPath(r.Request.URL.Path).URL()
+	target.RawQuery = r.Request.URL.RawQuery
+	log.Debugf("proxyPass url: %s", target)
+	_, rewritten := r.Request.Body.(*bytesBody)
+	idempotent := r.Request.Method == http.MethodPut || r.Request.Method == http.MethodDelete
+	if r.Request.Body != nil && (rewritten || idempotent) {
+		// the body may be rewritten after reading, and it's replayable for retries
+		bs, err := io.ReadAll(r.Request.Body)
+		if err != nil {
+			return err
+		}
+		r.Request.Body = wrapReader(bytes.NewReader(bs))
+		r.Request.ContentLength = int64(len(bs))
+		r.Request.GetBody = func() (io.ReadCloser, error) {
+			return wrapReader(bytes.NewReader(bs)), nil
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Request.Context(), requestTimeout(r.Request))
+	defer cancel()
+	p := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL = target
+			req.Host = target.Host
+			// the token of ckube must not be sent to the api server, and it prevents the credentials of cluster to be set
+			req.Header.Del("Authorization")
+		},
+		Transport:      newUpstreamTransport(c.Client.Transport, cluster),
+		ModifyResponse: modify,
+		ErrorHandler:   proxyErrorResponder{cluster: cluster}.Error,
+	}
+	p.ServeHTTP(r.Writer, r.Request.WithContext(ctx))
+	return nil
+}
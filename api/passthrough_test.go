@@ -0,0 +1,126 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestProxyPass(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer cluster-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Audit-Id", "audit-1")
+		w.Header().Add("Warning", `299 - "deprecated"`)
+		switch r.URL.Path {
+		case "/apis/apps/v1/namespaces/test/deployments/d1":
+			w.Header().Set("Content-Type", r.Header.Get("Accept"))
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte("conflict"))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			if r.Method != http.MethodHead {
+				_, _ = w.Write([]byte(fmt.Sprintf("%s %s?%s %s", r.Method, r.URL.Path, r.URL.RawQuery, body)))
+			}
+		}
+	}))
+	defer srv.Close()
+	client, _ := kubernetes.NewForConfig(&rest.Config{Host: srv.URL, BearerToken: "cluster-token"})
+	cases := []struct {
+		name         string
+		method       string
+		url          string
+		body         string
+		accept       string
+		expectCode   int
+		expectType   string
+		expectBody   string
+		expectHeader map[string]string
+	}{
+		{
+			name:       "get",
+			method:     http.MethodGet,
+			url:        "/api/v1/namespaces/test/configmaps?limit=1",
+			expectCode: http.StatusOK,
+			expectType: "text/plain",
+			expectBody: "GET /api/v1/namespaces/test/configmaps?limit=1 ",
+			expectHeader: map[string]string{
+				"Audit-Id": "audit-1",
+				"Warning":  `299 - "deprecated"`,
+			},
+		},
+		{
+			name:       "error status",
+			method:     http.MethodPut,
+			url:        "/apis/apps/v1/namespaces/test/deployments/d1",
+			body:       "{}",
+			accept:     "application/vnd.kubernetes.protobuf",
+			expectCode: http.StatusConflict,
+			expectType: "application/vnd.kubernetes.protobuf",
+			expectBody: "conflict",
+			expectHeader: map[string]string{
+				"Retry-After": "1",
+			},
+		},
+		{
+			name:       "head",
+			method:     http.MethodHead,
+			url:        "/api/v1/namespaces",
+			expectCode: http.StatusOK,
+			expectType: "text/plain",
+		},
+		{
+			name:       "options",
+			method:     http.MethodOptions,
+			url:        "/api/v1/namespaces",
+			expectCode: http.StatusOK,
+			expectType: "text/plain",
+			expectBody: "OPTIONS /api/v1/namespaces? ",
+		},
+		{
+			name:       "rewritten body",
+			method:     http.MethodDelete,
+			url:        "/api/v1/namespaces/test/configmaps/c1",
+			body:       `{"kind":"DeleteOptions"}`,
+			expectCode: http.StatusOK,
+			expectType: "text/plain",
+			expectBody: `DELETE /api/v1/namespaces/test/configmaps/c1? {}`,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			req := httptest.NewRequest(c.method, c.url, strings.NewReader(c.body))
+			req.Header.Set("Authorization", "Bearer ckube-token")
+			if c.accept != "" {
+				req.Header.Set("Accept", c.accept)
+			}
+			if c.name == "rewritten body" {
+				req.Body = wrapReader(strings.NewReader("{}"))
+			}
+			w := httptest.NewRecorder()
+			res := proxyPass(&ReqContext{
+				ClusterClients: map[string]kubernetes.Interface{"default": client},
+				Request:        req,
+				Writer:         w,
+			}, "default")
+			assert.Nil(t, res)
+			assert.Equal(t, c.expectCode, w.Code)
+			assert.Equal(t, c.expectType, w.Header().Get("Content-Type"))
+			assert.Equal(t, c.expectBody, w.Body.String())
+			for k, v := range c.expectHeader {
+				assert.Equal(t, v, w.Header().Get(k))
+			}
+		})
+	}
+}
@@ -8,17 +8,17 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	k8labels "k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/rest"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
 
 	"github.com/DaoCloud/ckube/common"
 	"github.com/DaoCloud/ckube/common/constants"
@@ -41,26 +41,6 @@ func getGVRFromReq(req *http.Request) store.GroupVersionResource {
 	return gvr
 }
 
-func findLabels(i interface{}) map[string]string {
-	meta := reflect.ValueOf(i).Elem().FieldByName("ObjectMeta")
-	if !meta.CanInterface() {
-		meta = reflect.ValueOf(i).Elem().FieldByName("metadata")
-		if !meta.CanInterface() {
-			return nil
-		}
-	}
-	metaInterface := meta.Interface()
-	labels := reflect.ValueOf(metaInterface).FieldByName("Labels")
-	if !labels.CanInterface() {
-		labels = reflect.ValueOf(metaInterface).FieldByName("labels")
-		if !labels.CanInterface() {
-			return nil
-		}
-	}
-	res := labels.Interface().(map[string]string)
-	return res
-}
-
 func errorProxy(w http.ResponseWriter, err v1.Status) interface{} {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(int(err.Code))
@@ -69,16 +49,48 @@ func errorProxy(w http.ResponseWriter, err v1.Status) interface{} {
 	return err
 }
 
+// observed reports whether the cache of gvr in cluster is not older than resourceVersion without blocking.
+func observed(r *ReqContext, gvr store.GroupVersionResource, cluster, resourceVersion string) bool {
+	ctx, cancel := context.WithCancel(r.Request.Context())
+	cancel()
+	return r.Store.WaitResourceVersion(ctx, gvr, cluster, resourceVersion) == nil
+}
+
+// notOlder reports whether the resourceVersion of obj is not older than rv.
+func notOlder(obj interface{}, rv uint64) bool {
+	oo, ok := obj.(v1.Object)
+	if !ok {
+		return false
+	}
+	cur, err := strconv.ParseUint(oo.GetResourceVersion(), 10, 64)
+	return err == nil && cur >= rv
+}
+
+// ProxySingleResources gets a single object from the store with the semantics of api server,
+// it proxies the request to api server if the store can not answer it.
 func ProxySingleResources(r *ReqContext, gvr store.GroupVersionResource, cluster, namespace, resource string) interface{} {
+	if namespaced, ok := isNamespaced(r, gvr, cluster); ok && namespaced != (namespace != "") {
+		// wrong scope, let api server answer it
+		return proxyPass(r, cluster)
+	}
 	res := r.Store.Get(gvr, cluster, namespace, resource)
+	// resourceVersion "" and "0" accept any version, otherwise the result must not be older than it.
+	if rv := r.Request.URL.Query().Get("resourceVersion"); rv != "" && rv != "0" {
+		want, err := strconv.ParseUint(rv, 10, 64)
+		if err != nil {
+			return proxyPass(r, cluster)
+		}
+		if !notOlder(res, want) && !observed(r, gvr, cluster, rv) && !staleRead(r, cluster) {
+			log.Debugf("cluster(%s): %v %s/%s of resourceVersion %s may be newer than cache, proxyPass to api server",
+				cluster, gvr, namespace, resource, rv)
+			return proxyPass(r, cluster)
+		}
+	}
 	if res == nil {
-		return errorProxy(r.Writer, v1.Status{
-			Status:  v1.StatusFailure,
-			Message: fmt.Sprintf("resource %v: %s/%s/%s not found", gvr, cluster, namespace, resource),
-			Reason:  v1.StatusReasonNotFound,
-			Details: nil,
-			Code:    404,
-		})
+		return errorProxy(r.Writer, errors.NewNotFound(schema.GroupResource{
+			Group:    gvr.Group,
+			Resource: gvr.Resource,
+		}, resource).ErrStatus)
 	}
 	return res
 }
@@ -119,6 +131,7 @@ func parsePaginateAndLabelsAndClean(r *http.Request) (*page.Paginate, *v1.LabelS
 		body := r.Body
 		opts, err := io.ReadAll(body)
 		if err == nil {
+			r.Body = wrapReader(bytes.NewBuffer(opts))
 			options := v1.DeleteOptions{}
 			_ = json.Unmarshal(opts, &options)
 			if len(options.DryRun) > 0 && strings.HasPrefix(options.DryRun[0], clusterPrefix) {
@@ -183,35 +196,100 @@ func parsePaginateAndLabelsAndClean(r *http.Request) (*page.Paginate, *v1.LabelS
 	return &paginate, labels, cluster, nil
 }
 
+// minResourceVersionTimeout is how long a request waits for the watcher to observe the minimum resourceVersion.
+const minResourceVersionTimeout = 3 * time.Second
+
+// minResourceVersion gets the minimum resourceVersion which the response should be based on
+// from query or header, and removes it from query.
+func minResourceVersion(r *http.Request) string {
+	query := r.URL.Query()
+	rv := query.Get(constants.MinResourceVersion)
+	if _, ok := query[constants.MinResourceVersion]; ok {
+		query.Del(constants.MinResourceVersion)
+		r.URL.RawQuery = query.Encode()
+	}
+	if rv == "" {
+		rv = r.Header.Get(constants.MinResourceVersionHeader)
+	}
+	return rv
+}
+
+// isCached reports whether the objects of gvr in cluster are cached, a resource expanded from patterns
+// is only cached in the clusters serving it, which is not checked for the lists of multiple clusters.
+func isCached(r *ReqContext, gvr store.GroupVersionResource, cluster string, multiCluster bool) bool {
+	if !r.Store.IsStoreGVR(gvr) {
+		return false
+	}
+	if multiCluster {
+		return true
+	}
+	p, ok := common.GetProxy(gvr.Group, gvr.Version, gvr.Resource)
+	return !ok || p.ServedBy(cluster)
+}
+
 func Proxy(r *ReqContext) interface{} {
 	// version := mux.Vars(r.Request)["version"]
 	namespace := mux.Vars(r.Request)["namespace"]
 	resourceName := mux.Vars(r.Request)["resource"]
 	gvr := getGVRFromReq(r.Request)
+	minRv := minResourceVersion(r.Request)
 	paginate, labels, cluster, err := parsePaginateAndLabelsAndClean(r.Request)
 	if err != nil {
-		return proxyPass(r, cluster)
+		return proxyPassWriteThrough(r, gvr, cluster)
 	}
 	if cluster == "" {
 		cluster = common.GetConfig().DefaultCluster
 	}
+	stale := false
 	for k, v := range r.Request.URL.Query() {
 		switch k {
 		case "labelSelector":
 		case "timeoutSeconds":
 		case "timeout":
 		case "limit":
+		case "resourceVersion":
+			if resourceName == "" {
+				if circuitOpen(cluster) {
+					// serve the list from cache while the api server is unavailable
+					stale = true
+					continue
+				}
+				// list from the resourceVersion is not supported
+				log.Warnf("got unexpected query key: %s, value: %v, proxyPass to api server", k, v)
+				return proxyPassWriteThrough(r, gvr, cluster)
+			}
 		default:
 			log.Warnf("got unexpected query key: %s, value: %v, proxyPass to api server", k, v)
-			return proxyPass(r, cluster)
+			return proxyPassWriteThrough(r, gvr, cluster)
 		}
 	}
 	if paginate == nil {
 		paginate = &page.Paginate{}
 	}
-	if !r.Store.IsStoreGVR(gvr) || r.Request.Method != "GET" {
+	if !isCached(r, gvr, cluster, len(paginate.GetClusters()) > 1) || r.Request.Method != "GET" {
 		log.Debugf("gvr %v no cached or method not GET", gvr)
-		return proxyPass(r, cluster)
+		return proxyPassWriteThrough(r, gvr, cluster)
+	}
+	if stale {
+		warnStale(r, cluster)
+	}
+	if minRv != "" {
+		if _, err := strconv.ParseUint(minRv, 10, 64); err != nil {
+			return errorProxy(r.Writer, v1.Status{
+				Status:  v1.StatusFailure,
+				Message: "invalid minimum resourceVersion",
+				Reason:  v1.StatusReasonBadRequest,
+				Details: nil,
+				Code:    400,
+			})
+		}
+		ctx, cancel := context.WithTimeout(r.Request.Context(), minResourceVersionTimeout)
+		err := r.Store.WaitResourceVersion(ctx, gvr, cluster, minRv)
+		cancel()
+		if err != nil && !staleRead(r, cluster) {
+			log.Warnf("cluster(%s): wait resourceVersion %s of %v error: %v, proxyPass to api server", cluster, minRv, gvr, err)
+			return proxyPass(r, cluster)
+		}
 	}
 	if resourceName != "" {
 		return ProxySingleResources(r, gvr, cluster, namespace, resourceName)
@@ -227,25 +305,12 @@ func Proxy(r *ReqContext) interface{} {
 	}
 	log.Debugf("got paginate %v", paginate)
 
-	items := make([]interface{}, 0)
-	var total int64
+	query := store.Query{
+		Namespace: namespace,
+		Paginate:  *paginate,
+	}
 	if labels != nil && (len(labels.MatchLabels) != 0 || len(labels.MatchExpressions) != 0) {
 		// exists label selector
-		res := r.Store.Query(gvr, store.Query{
-			Namespace: namespace,
-			Paginate: page.Paginate{
-				Sort:   paginate.Sort,
-				Search: paginate.Search,
-			}, // get all
-		})
-		if res.Error != nil {
-			return errorProxy(r.Writer, v1.Status{
-				Status:  v1.StatusFailure,
-				Message: "query error",
-				Reason:  v1.StatusReason(res.Error.Error()),
-				Code:    400,
-			})
-		}
 		sel, err := v1.LabelSelectorAsSelector(labels)
 		if err != nil {
 			return errorProxy(r.Writer, v1.Status{
@@ -256,48 +321,27 @@ func Proxy(r *ReqContext) interface{} {
 				Code:    400,
 			})
 		}
-		for _, item := range res.Items {
-			l := findLabels(item)
-			if sel.Matches(k8labels.Set(l)) {
-				items = append(items, item)
-			}
-		}
-
-		// manually slice items
-		var l = int64(len(items))
-		var start, end int64
-		if paginate.PageSize == 0 || paginate.Page == 0 {
-			// all resources
-			start = 0
-			end = l
-		} else {
-			start = (paginate.Page - 1) * paginate.PageSize
-			end = start + paginate.PageSize
-			if start >= l {
-				start = l
-			}
-			if end >= l {
-				end = l
-			}
-		}
-		items = items[start:end]
-		total = l
-	} else {
-		res := r.Store.Query(gvr, store.Query{
-			Namespace: namespace,
-			Paginate:  *paginate,
+		query.LabelSelector = sel.String()
+	}
+	res := r.Store.QueryIter(gvr, query)
+	if res.Error == store.ErrSnapshotExpired {
+		return errorProxy(r.Writer, v1.Status{
+			Status:  v1.StatusFailure,
+			Message: res.Error.Error(),
+			Reason:  v1.StatusReasonExpired,
+			Code:    http.StatusGone,
 		})
-		if res.Error != nil {
-			return errorProxy(r.Writer, v1.Status{
-				Status:  v1.StatusFailure,
-				Message: "query error",
-				Reason:  v1.StatusReason(res.Error.Error()),
-				Code:    400,
-			})
-		}
-		items = res.Items
-		total = res.Total
 	}
+	if res.Error != nil {
+		return errorProxy(r.Writer, v1.Status{
+			Status:  v1.StatusFailure,
+			Message: "query error",
+			Reason:  v1.StatusReason(res.Error.Error()),
+			Code:    400,
+		})
+	}
+	items := res.Iterator()
+	total := res.Total
 	apiVersion := ""
 	if gvr.Group == "" {
 		apiVersion = gvr.Version
@@ -311,7 +355,7 @@ func Proxy(r *ReqContext) interface{} {
 	} else {
 		// page starts with 1,
 		remainCount = total - (paginate.PageSize * paginate.Page)
-		if remainCount < 0 && len(items) == 0 && paginate.Page != 1 {
+		if remainCount < 0 && items.Len() == 0 && paginate.Page != 1 {
 			return errorProxy(r.Writer, v1.Status{
 				Status:  v1.StatusFailure,
 				Message: "out of page",
@@ -322,17 +366,24 @@ func Proxy(r *ReqContext) interface{} {
 			remainCount = 0
 		}
 	}
+	resPaginate := page.Paginate{
+		Page:     paginate.Page,
+		PageSize: paginate.PageSize,
+		Total:    total,
+		Sort:     res.Sort,
+		Snapshot: res.Snapshot,
+	}
 	if strings.Contains(r.Request.Header.Get("accept"), "application/json;as=Table") {
-		return serverPrint(items)
+		return serverPrint(store.Collect(items))
 	}
-	return map[string]interface{}{
-		"apiVersion": apiVersion,
-		"kind":       common.GetGVRKind(gvr.Group, gvr.Version, gvr.Resource),
-		"metadata": map[string]interface{}{
-			"selfLink":           r.Request.URL.Path,
+	return &List{
+		APIVersion: apiVersion,
+		Kind:       common.GetGVRKind(gvr.Group, gvr.Version, gvr.Resource),
+		Metadata: map[string]interface{}{
+			"selfLink":           page.ResSelfLink(r.Request.URL.Path, resPaginate),
 			"remainingItemCount": remainCount,
 		},
-		"items": items,
+		Items: items,
 	}
 }
 
@@ -416,80 +467,13 @@ func isWatchRequest(r *http.Request) bool {
 	return false
 }
 
-func proxyPassWatch(r *ReqContext, cluster string) interface{} {
-	q := r.Request.URL.Query()
-	q.Set("timeout", "30m")
-	if v, ok := q["labelSelector"]; ok {
-		if len(v) == 1 && v[0] == "<none>" {
-			delete(q, "labelSelector")
-		}
-	}
-	r.Request.URL.RawQuery = q.Encode()
-	u := r.Request.URL.String()
-	log.Debugf("proxyPass url: %s", u)
-	timeout := 30 * time.Minute
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	reader, err := getRequest(r, cluster, timeout).RequestURI(u).Stream(ctx)
-	if err != nil {
-		if es, ok := err.(*errors.StatusError); ok {
-			return errorProxy(r.Writer, es.ErrStatus)
-		}
-		return err
-	}
-	r.Writer.Header().Set("Content-Type", "application/json")
-	r.Writer.Header().Set("Transfer-Encoding", "chunked")
-	r.Writer.Header().Set("Connection", "keep-alive")
-	buf := bytes.NewBuffer([]byte{})
-	for {
-		t := make([]byte, 1)
-		_, err := reader.Read(t)
-		if err != nil {
-			_, _ = r.Writer.Write(buf.Bytes())
-			return nil
-		}
-		buf.Write(t)
-		if t[0] == '\n' {
-			_, _ = r.Writer.Write(buf.Bytes())
-			buf.Reset()
-		}
-		select {
-		case <-r.Request.Context().Done():
-			return nil
-		default:
-		}
-	}
-}
-
-func getRequest(r *ReqContext, cluster string, timeout time.Duration) *rest.Request {
-	c := r.ClusterClients[cluster].Discovery().RESTClient().(*rest.RESTClient)
-	c.Client.Timeout = timeout
-	var req *rest.Request
-	switch r.Request.Method {
-	case http.MethodGet:
-		return c.Get()
-	case http.MethodPost:
-		req = c.Post()
-	case http.MethodDelete:
-		req = c.Delete()
-	case http.MethodPut:
-		req = c.Put()
-	case http.MethodPatch:
-		req = c.Patch(types.PatchType(r.Request.Header.Get("Content-Type")))
-	default:
-		log.Errorf("unexpected method: %s", r.Request.Method)
-		return nil
-	}
-	// for k, v := range r.Request.Header {
-	//	if len(v) > 0 {
-	//		req = req.SetHeader(k, v[0])
-	//	}
-	// }
-	req = req.Body(r.Request.Body)
-	return req
+func proxyPass(r *ReqContext, cluster string) interface{} {
+	return proxyPassResponse(r, cluster, nil)
 }
 
-func proxyPass(r *ReqContext, cluster string) interface{} {
+// proxyPassResponse passes the request to api server of cluster as is, modify is called with
+// the response of api server before it's written to the client, except for watch and stream requests.
+func proxyPassResponse(r *ReqContext, cluster string, modify func(*http.Response) error) interface{} {
 	if cluster == "" {
 		cluster = common.GetConfig().DefaultCluster
 	}
@@ -504,18 +488,97 @@ func proxyPass(r *ReqContext, cluster string) interface{} {
 	if isWatchRequest(r.Request) {
 		return proxyPassWatch(r, cluster)
 	}
-	u := r.Request.URL.String()
-	log.Debugf("proxyPass url: %s", u)
-	timeout := time.Minute
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	res, err := getRequest(r, cluster, timeout).RequestURI(u).DoRaw(ctx)
-	if err != nil {
-		if es, ok := err.(*errors.StatusError); ok {
-			return errorProxy(r.Writer, es.ErrStatus)
+	if isStreamRequest(r.Request) {
+		return proxyPassStream(r, cluster)
+	}
+	return reverseProxy(r, cluster, modify)
+}
+
+func isDryRun(r *http.Request) bool {
+	if len(r.URL.Query()["dryRun"]) > 0 {
+		return true
+	}
+	if r.Method == http.MethodDelete && r.Body != nil {
+		bs, err := io.ReadAll(r.Body)
+		if err != nil {
+			return false
+		}
+		r.Body = wrapReader(bytes.NewBuffer(bs))
+		options := v1.DeleteOptions{}
+		_ = json.Unmarshal(bs, &options)
+		return len(options.DryRun) > 0
+	}
+	return false
+}
+
+// proxyPassWriteThrough passes the request to api server like proxyPass, and applies the response of
+// a successful mutation of cached resources to the store immediately, so that the following reads of
+// the client can see its write without waiting for the watch event.
+func proxyPassWriteThrough(r *ReqContext, gvr store.GroupVersionResource, cluster string) interface{} {
+	switch r.Request.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return proxyPass(r, cluster)
+	}
+	if cluster == "" {
+		cluster = common.GetConfig().DefaultCluster
+	}
+	if !isCached(r, gvr, cluster, false) || isDryRun(r.Request) {
+		return proxyPass(r, cluster)
+	}
+	namespace := mux.Vars(r.Request)["namespace"]
+	name := mux.Vars(r.Request)["resource"]
+	// the response is decoded to update the store, let the transport decompress it
+	r.Request.Header.Del("Accept-Encoding")
+	return proxyPassResponse(r, cluster, func(resp *http.Response) error {
+		if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+			return nil
 		}
+		bs, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		resp.Body = wrapReader(bytes.NewBuffer(bs))
+		if err := writeThrough(r.Store, gvr, cluster, r.Request.Method, namespace, name, bs); err != nil {
+			log.Warnf("cluster(%s): write through %v %s/%s error: %v", cluster, gvr, namespace, name, err)
+		}
+		return nil
+	})
+}
+
+// writeThrough applies the api server response res of a mutation to the store,
+// the store ignores it if the watch event with a newer resourceVersion has arrived.
+func writeThrough(s store.Store, gvr store.GroupVersionResource, cluster, method, namespace, name string, res []byte) error {
+	if method == http.MethodDelete && name == "" {
+		// delete collection, leave it to the watcher
+		return nil
+	}
+	obj, gvk, err := runtime.WithoutVersionDecoder{Decoder: scheme.Codecs.UniversalDeserializer()}.Decode(res, nil, nil)
+	if err != nil {
 		return err
 	}
-	r.Writer.Header().Set("Content-Type", "application/json")
-	return res
+	if gvk.Kind == "Status" {
+		if method == http.MethodDelete {
+			// the object has been deleted and api server returns a Status
+			return s.OnResourceDeleted(gvr, cluster, &v1.PartialObjectMetadata{
+				ObjectMeta: v1.ObjectMeta{Namespace: namespace, Name: name},
+			})
+		}
+		return nil
+	}
+	if kind := strings.TrimSuffix(common.GetGVRKind(gvr.Group, gvr.Version, gvr.Resource), "List"); gvk.Kind != kind {
+		return fmt.Errorf("unexpected kind %s of resource %v", gvk.Kind, gvr)
+	}
+	if method == http.MethodDelete {
+		oo, ok := obj.(v1.Object)
+		if !ok {
+			return fmt.Errorf("unexpected object %T", obj)
+		}
+		if oo.GetDeletionTimestamp() == nil {
+			return s.OnResourceDeleted(gvr, cluster, obj)
+		}
+		// graceful deletion or waiting for finalizers, the object still exists
+	}
+	return s.OnResourceModified(gvr, cluster, obj)
 }
@@ -2,16 +2,22 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
 
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
 
 	"github.com/DaoCloud/ckube/common"
 	"github.com/DaoCloud/ckube/store"
@@ -44,6 +50,22 @@ func (f fakeStore) Query(gvr store.GroupVersionResource, query store.Query) stor
 	return f.storeResources
 }
 
+func (f fakeStore) QueryIter(gvr store.GroupVersionResource, query store.Query) store.QueryResult {
+	if query.LabelSelector == "" {
+		return f.storeResources
+	}
+	sel, _ := labels.Parse(query.LabelSelector)
+	res := f.storeResources
+	res.Items = nil
+	for _, item := range f.storeResources.Items {
+		if sel.Matches(labels.Set(item.(metav1.Object).GetLabels())) {
+			res.Items = append(res.Items, item)
+		}
+	}
+	res.Total = int64(len(res.Items))
+	return res
+}
+
 func (f fakeStore) IsStoreGVR(gvr store.GroupVersionResource) bool {
 	return gvr.Group == "" && gvr.Version == "v1" && gvr.Resource == "pods"
 }
@@ -112,7 +134,7 @@ func TestProxy(t *testing.T) {
 					"apiVersion": "v1",
 					"items":      testPods,
 					"kind":       "PodList",
-					"metadata":   map[string]interface{}{"remainingItemCount": int64(0), "selfLink": "/api/v1/pods"}}),
+					"metadata":   map[string]interface{}{"remainingItemCount": int64(0), "selfLink": "/api/v1/pods?ckube.daocloud.io%2Fquery=eyJ0b3RhbCI6MX0"}}),
 		},
 		{
 			name:       "query pods with label selector",
@@ -154,7 +176,39 @@ func TestProxy(t *testing.T) {
 						},
 					}),
 					"kind":     "PodList",
-					"metadata": map[string]interface{}{"remainingItemCount": int64(0), "selfLink": "/api/v1/pods"}}),
+					"metadata": map[string]interface{}{"remainingItemCount": int64(0), "selfLink": "/api/v1/pods?ckube.daocloud.io%2Fquery=eyJ0b3RhbCI6MX0"}}),
+		},
+		{
+			name:       "query pods with snapshot",
+			path:       "/api/v1/pods",
+			contextMap: podsMap,
+			storeResources: store.QueryResult{
+				Iter:     store.NewSliceIterator(testPods),
+				Total:    1,
+				Snapshot: "s1",
+			},
+			expectCode: 0,
+			expectRes: map[string]interface{}{
+				"apiVersion": "v1",
+				"items":      testPods,
+				"kind":       "PodList",
+				"metadata":   map[string]interface{}{"remainingItemCount": int64(0), "selfLink": "/api/v1/pods?ckube.daocloud.io%2Fquery=eyJ0b3RhbCI6MSwic25hcHNob3QiOiJzMSJ9"}},
+		},
+		{
+			name:       "snapshot expired",
+			path:       "/api/v1/pods",
+			contextMap: podsMap,
+			storeResources: store.QueryResult{
+				Error: store.ErrSnapshotExpired,
+			},
+			expectCode: 410,
+			expectRes: metav1.Status{
+				TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+				Status:   metav1.StatusFailure,
+				Message:  store.ErrSnapshotExpired.Error(),
+				Reason:   metav1.StatusReasonExpired,
+				Code:     410,
+			},
 		},
 	}
 	for i, c := range cases {
@@ -176,8 +230,426 @@ func TestProxy(t *testing.T) {
 				Request:        req,
 				Writer:         &writer,
 			})
+			if bs, ok := c.expectRes.([]byte); ok {
+				// passed to api server
+				assert.Nil(t, res)
+				assert.Equal(t, http.StatusOK, writer.code)
+				assert.Equal(t, bs, writer.bs)
+				return
+			}
+			assert.Equal(t, c.expectCode, writer.code)
+			expect, _ := json.Marshal(c.expectRes)
+			bs, err := json.Marshal(res)
+			assert.NoError(t, err)
+			assert.JSONEq(t, string(expect), string(bs))
+		})
+	}
+}
+
+// recordStore records the changes applied to the store.
+type recordStore struct {
+	store.Store
+	events []string
+}
+
+func (r *recordStore) IsStoreGVR(gvr store.GroupVersionResource) bool {
+	return true
+}
+
+func (r *recordStore) OnResourceModified(gvr store.GroupVersionResource, cluster string, obj interface{}) error {
+	o := obj.(metav1.Object)
+	r.events = append(r.events, fmt.Sprintf("modified %s/%s %s", o.GetNamespace(), o.GetName(), o.GetResourceVersion()))
+	return nil
+}
+
+func (r *recordStore) OnResourceDeleted(gvr store.GroupVersionResource, cluster string, obj interface{}) error {
+	o := obj.(metav1.Object)
+	r.events = append(r.events, fmt.Sprintf("deleted %s/%s %s", o.GetNamespace(), o.GetName(), o.GetResourceVersion()))
+	return nil
+}
+
+func TestProxy_WriteThrough(t *testing.T) {
+	common.InitConfig(&common.Config{Proxies: []common.Proxy{
+		{
+			Group:    "",
+			Version:  "v1",
+			Resource: "pods",
+			ListKind: "PodList",
+		},
+	}})
+	pod := func(rv string, deleted bool) string {
+		p := v1.Pod{
+			TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "test",
+				Namespace:       "test",
+				ResourceVersion: rv,
+			},
+		}
+		if deleted {
+			now := metav1.Now()
+			p.DeletionTimestamp = &now
+		}
+		bs, _ := json.Marshal(p)
+		return string(bs)
+	}
+	collectionVars := map[string]string{"version": "v1", "namespace": "test", "resourceType": "pods"}
+	objectVars := map[string]string{"version": "v1", "namespace": "test", "resourceType": "pods", "resource": "test"}
+	cases := []struct {
+		name        string
+		method      string
+		path        string
+		vars        map[string]string
+		response    string
+		expectEvent []string
+	}{
+		{
+			name:        "create",
+			method:      http.MethodPost,
+			path:        "/api/v1/namespaces/test/pods",
+			vars:        collectionVars,
+			response:    pod("10", false),
+			expectEvent: []string{"modified test/test 10"},
+		},
+		{
+			name:        "update",
+			method:      http.MethodPut,
+			path:        "/api/v1/namespaces/test/pods/test?fieldManager=kubectl",
+			vars:        objectVars,
+			response:    pod("12", false),
+			expectEvent: []string{"modified test/test 12"},
+		},
+		{
+			name:     "dry run",
+			method:   http.MethodPut,
+			path:     "/api/v1/namespaces/test/pods/test?dryRun=All",
+			vars:     objectVars,
+			response: pod("13", false),
+		},
+		{
+			name:        "graceful delete",
+			method:      http.MethodDelete,
+			path:        "/api/v1/namespaces/test/pods/test",
+			vars:        objectVars,
+			response:    pod("14", true),
+			expectEvent: []string{"modified test/test 14"},
+		},
+		{
+			name:        "delete",
+			method:      http.MethodDelete,
+			path:        "/api/v1/namespaces/test/pods/test",
+			vars:        objectVars,
+			response:    pod("15", false),
+			expectEvent: []string{"deleted test/test 15"},
+		},
+		{
+			name:        "delete returns status",
+			method:      http.MethodDelete,
+			path:        "/api/v1/namespaces/test/pods/test",
+			vars:        objectVars,
+			response:    `{"kind":"Status","apiVersion":"v1","status":"Success"}`,
+			expectEvent: []string{"deleted test/test "},
+		},
+		{
+			name:     "delete collection",
+			method:   http.MethodDelete,
+			path:     "/api/v1/namespaces/test/pods",
+			vars:     collectionVars,
+			response: `{"kind":"PodList","apiVersion":"v1","items":[]}`,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, c.method, r.Method)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(c.response))
+			}))
+			defer srv.Close()
+			client, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+			assert.NoError(t, err)
+			req, _ := http.NewRequest(c.method, c.path, http.NoBody)
+			req = mux.SetURLVars(req, c.vars)
+			s := &recordStore{}
+			writer := fakeWriter{}
+			res := Proxy(&ReqContext{
+				ClusterClients: map[string]kubernetes.Interface{"default": client},
+				Store:          s,
+				Request:        req,
+				Writer:         &writer,
+			})
+			assert.Nil(t, res)
+			assert.Equal(t, c.response, string(writer.bs))
+			assert.Equal(t, c.expectEvent, s.events)
+		})
+	}
+}
+
+type versionStore struct {
+	fakeStore
+	observed uint64
+}
+
+func (v versionStore) WaitResourceVersion(ctx context.Context, gvr store.GroupVersionResource, cluster string, resourceVersion string) error {
+	if rv, _ := strconv.ParseUint(resourceVersion, 10, 64); rv <= v.observed {
+		return nil
+	}
+	return context.DeadlineExceeded
+}
+
+func TestProxy_MinResourceVersion(t *testing.T) {
+	common.InitConfig(&common.Config{Proxies: []common.Proxy{
+		{
+			Group:    "",
+			Version:  "v1",
+			Resource: "pods",
+			ListKind: "PodList",
+		},
+	}})
+	apiServerRes := `{"kind":"PodList","apiVersion":"v1","metadata":{"resourceVersion":"12"},"items":[]}`
+	cases := []struct {
+		name       string
+		path       string
+		header     string
+		expectCode int
+		expectRes  interface{}
+	}{
+		{
+			name: "observed",
+			path: "/api/v1/pods?minResourceVersion=10",
+			expectRes: map[string]interface{}{
+				"apiVersion": "v1",
+				"items":      testPods,
+				"kind":       "PodList",
+				"metadata":   map[string]interface{}{"remainingItemCount": int64(0), "selfLink": "/api/v1/pods?ckube.daocloud.io%2Fquery=eyJ0b3RhbCI6MX0"}},
+		},
+		{
+			name:      "not observed",
+			path:      "/api/v1/pods",
+			header:    "12",
+			expectRes: []byte(apiServerRes),
+		},
+		{
+			name:       "invalid",
+			path:       "/api/v1/pods?minResourceVersion=abc",
+			expectCode: 400,
+			expectRes: metav1.Status{
+				TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+				Status:   metav1.StatusFailure,
+				Message:  "invalid minimum resourceVersion",
+				Reason:   metav1.StatusReasonBadRequest,
+				Code:     400,
+			},
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Empty(t, r.URL.Query().Get("minResourceVersion"))
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(apiServerRes))
+			}))
+			defer srv.Close()
+			client, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+			assert.NoError(t, err)
+			req, _ := http.NewRequest(http.MethodGet, c.path, nil)
+			req = mux.SetURLVars(req, map[string]string{"version": "v1", "resourceType": "pods"})
+			if c.header != "" {
+				req.Header.Set("X-Ckube-Min-Resource-Version", c.header)
+			}
+			writer := fakeWriter{}
+			res := Proxy(&ReqContext{
+				ClusterClients: map[string]kubernetes.Interface{"default": client},
+				Store: versionStore{
+					fakeStore: fakeStore{storeResources: store.QueryResult{Items: testPods, Total: 1}},
+					observed:  10,
+				},
+				Request: req,
+				Writer:  &writer,
+			})
+			if bs, ok := c.expectRes.([]byte); ok {
+				// passed to api server
+				assert.Nil(t, res)
+				assert.Equal(t, http.StatusOK, writer.code)
+				assert.Equal(t, bs, writer.bs)
+				return
+			}
+			assert.Equal(t, c.expectCode, writer.code)
+			expect, _ := json.Marshal(c.expectRes)
+			bs, err := json.Marshal(res)
+			assert.NoError(t, err)
+			assert.JSONEq(t, string(expect), string(bs))
+		})
+	}
+}
+
+type singleStore struct {
+	versionStore
+	objs map[string]interface{}
+}
+
+func (s singleStore) IsStoreGVR(gvr store.GroupVersionResource) bool {
+	return gvr.Group == "" && gvr.Version == "v1" && (gvr.Resource == "pods" || gvr.Resource == "nodes")
+}
+
+func (s singleStore) Get(gvr store.GroupVersionResource, cluster string, namespace, name string) interface{} {
+	if o, ok := s.objs[gvr.Resource+"/"+namespace+"/"+name]; ok {
+		return o
+	}
+	return nil
+}
+
+func TestProxySingleResources(t *testing.T) {
+	common.InitConfig(&common.Config{Proxies: []common.Proxy{
+		{Version: "v1", Resource: "pods", ListKind: "PodList"},
+		{Version: "v1", Resource: "nodes", ListKind: "NodeList"},
+	}})
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "test", ResourceVersion: "10"}}
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", ResourceVersion: "8"}}
+	upstream := []byte(`{"kind":"Pod","apiVersion":"v1","metadata":{"name":"upstream"}}`)
+	notFound := metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  `pods "missing" not found`,
+		Reason:   metav1.StatusReasonNotFound,
+		Details:  &metav1.StatusDetails{Name: "missing", Kind: "pods"},
+		Code:     404,
+	}
+	cases := []struct {
+		name       string
+		path       string
+		vars       map[string]string
+		observed   uint64
+		expectCode int
+		expectRes  interface{}
+	}{
+		{
+			name:      "cached",
+			path:      "/api/v1/namespaces/test/pods/test",
+			vars:      map[string]string{"namespace": "test", "resource": "test"},
+			expectRes: pod,
+		},
+		{
+			name:       "not found",
+			path:       "/api/v1/namespaces/test/pods/missing",
+			vars:       map[string]string{"namespace": "test", "resource": "missing"},
+			expectCode: 404,
+			expectRes:  notFound,
+		},
+		{
+			name:       "not found any version",
+			path:       "/api/v1/namespaces/test/pods/missing?resourceVersion=0",
+			vars:       map[string]string{"namespace": "test", "resource": "missing"},
+			expectCode: 404,
+			expectRes:  notFound,
+		},
+		{
+			name:      "cached object is not older",
+			path:      "/api/v1/namespaces/test/pods/test?resourceVersion=10",
+			vars:      map[string]string{"namespace": "test", "resource": "test"},
+			expectRes: pod,
+		},
+		{
+			name:      "cached object may be older",
+			path:      "/api/v1/namespaces/test/pods/test?resourceVersion=20",
+			vars:      map[string]string{"namespace": "test", "resource": "test"},
+			observed:  15,
+			expectRes: upstream,
+		},
+		{
+			name:      "watcher observed the version",
+			path:      "/api/v1/namespaces/test/pods/test?resourceVersion=20",
+			vars:      map[string]string{"namespace": "test", "resource": "test"},
+			observed:  25,
+			expectRes: pod,
+		},
+		{
+			name:      "not found may be newer",
+			path:      "/api/v1/namespaces/test/pods/missing?resourceVersion=20",
+			vars:      map[string]string{"namespace": "test", "resource": "missing"},
+			observed:  15,
+			expectRes: upstream,
+		},
+		{
+			name:      "namespaced resource without namespace",
+			path:      "/api/v1/pods/test",
+			vars:      map[string]string{"resource": "test"},
+			expectRes: upstream,
+		},
+		{
+			name:      "cluster scoped resource",
+			path:      "/api/v1/nodes/node1",
+			vars:      map[string]string{"resourceType": "nodes", "resource": "node1"},
+			expectRes: node,
+		},
+		{
+			name:      "cluster scoped resource with namespace",
+			path:      "/api/v1/namespaces/test/nodes/node1",
+			vars:      map[string]string{"namespace": "test", "resourceType": "nodes", "resource": "node1"},
+			expectRes: upstream,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if r.URL.Path == "/api/v1" {
+					bs, _ := json.Marshal(metav1.APIResourceList{
+						GroupVersion: "v1",
+						APIResources: []metav1.APIResource{
+							{Name: "pods", Namespaced: true, Kind: "Pod"},
+							{Name: "nodes", Namespaced: false, Kind: "Node"},
+						},
+					})
+					_, _ = w.Write(bs)
+					return
+				}
+				_, _ = w.Write(upstream)
+			}))
+			defer srv.Close()
+			client, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+			assert.NoError(t, err)
+			vars := map[string]string{"version": "v1", "resourceType": "pods"}
+			for k, v := range c.vars {
+				vars[k] = v
+			}
+			req, _ := http.NewRequest(http.MethodGet, c.path, nil)
+			req = mux.SetURLVars(req, vars)
+			writer := fakeWriter{}
+			res := Proxy(&ReqContext{
+				ClusterClients: map[string]kubernetes.Interface{"default": client},
+				Store: singleStore{
+					versionStore: versionStore{observed: c.observed},
+					objs: map[string]interface{}{
+						"pods/test/test": pod,
+						"nodes//node1":   node,
+					},
+				},
+				Request: req,
+				Writer:  &writer,
+			})
+			if bs, ok := c.expectRes.([]byte); ok {
+				// passed to api server
+				assert.Nil(t, res)
+				assert.Equal(t, http.StatusOK, writer.code)
+				assert.Equal(t, bs, writer.bs)
+				return
+			}
 			assert.Equal(t, c.expectCode, writer.code)
 			assert.Equal(t, c.expectRes, res)
 		})
 	}
 }
+
+func TestIsCached(t *testing.T) {
+	common.InitConfig(&common.Config{Proxies: []common.Proxy{
+		{Version: "v1", Resource: "pods", ListKind: "PodList", Clusters: []string{"c1"}},
+	}})
+	r := &ReqContext{Store: fakeStore{}}
+	pods := store.GroupVersionResource{Version: "v1", Resource: "pods"}
+	assert.True(t, isCached(r, pods, "c1", false))
+	// the resource expanded from patterns is not served by c2
+	assert.False(t, isCached(r, pods, "c2", false))
+	assert.True(t, isCached(r, pods, "c2", true))
+	assert.False(t, isCached(r, store.GroupVersionResource{Version: "v1", Resource: "nodes"}, "c1", false))
+}
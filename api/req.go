@@ -5,10 +5,12 @@ import (
 
 	"github.com/DaoCloud/ckube/store"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 type ReqContext struct {
 	ClusterClients map[string]kubernetes.Interface
+	ClusterConfigs map[string]rest.Config
 	Store          store.Store
 	Request        *http.Request
 	Writer         http.ResponseWriter
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/proxy"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+
+	"github.com/DaoCloud/ckube/log"
+)
+
+// proxyResources are the resources with the proxy subresource.
+var proxyResources = map[string]bool{
+	"pods":     true,
+	"services": true,
+	"nodes":    true,
+}
+
+// isStreamRequest reports whether r is an upgrade request or a request to the subresources which stream
+// until the connection is closed, like exec, attach, port-forward, proxy and following logs.
+func isStreamRequest(r *http.Request) bool {
+	if httpstream.IsUpgradeRequest(r) {
+		return true
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	for i := 0; i+2 < len(parts); i++ {
+		if !proxyResources[parts[i]] {
+			continue
+		}
+		// {resource}/{name}/{subresource}
+		last := i+3 == len(parts)
+		switch parts[i+2] {
+		case "proxy":
+			return true
+		case "exec", "attach", "portforward":
+			if parts[i] == "pods" && last {
+				return true
+			}
+		case "log":
+			if parts[i] == "pods" && last {
+				follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+				return follow
+			}
+		}
+	}
+	return false
+}
+
+// IsLongRunning reports whether r is a watch, upgrade or streaming request, which may last long.
+func IsLongRunning(r *http.Request) bool {
+	return isWatchRequest(r) || isStreamRequest(r)
+}
+
+// upgradeTransportFor returns the transport for upgrade requests to the cluster of config,
+// which uses http/1.1 and sets the credentials of config to the upgrade requests.
+func upgradeTransportFor(config *rest.Config) (proxy.UpgradeRequestRoundTripper, error) {
+	transportConfig, err := config.TransportConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := transport.TLSConfigFor(transportConfig)
+	if err != nil {
+		return nil, err
+	}
+	rt := utilnet.SetOldTransportDefaults(&http.Transport{
+		TLSClientConfig: tlsConfig,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+	})
+	upgrader, err := transport.HTTPWrappersForConfig(transportConfig, proxy.MirrorRequest)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.NewUpgradeRequestRoundTripper(rt, upgrader), nil
+}
+
+// proxyPassStream proxies the upgrade and long-running streaming requests to the api server of cluster
+// without buffering, using the credentials of the cluster instead of the client's. The requests are limited
+// by the rate limiter and circuit breaker of cluster like the other requests.
+func proxyPassStream(r *ReqContext, cluster string) interface{} {
+	config, ok := r.ClusterConfigs[cluster]
+	if !ok {
+		return errorProxy(r.Writer, v1.Status{
+			Status:  v1.StatusFailure,
+			Message: "cluster not found",
+			Reason:  v1.StatusReason(fmt.Sprintf("request cluster not found: %s", cluster)),
+			Code:    404,
+		})
+	}
+	location, err := url.Parse(config.Host)
+	if err != nil {
+		return err
+	}
+	if location.Scheme == "" {
+		// host without scheme is allowed in rest config
+		if location, err = url.Parse("https://" + config.Host); err != nil {
+			return err
+		}
+	}
+	location.Path = strings.TrimSuffix(location.Path, "/") + r.Request.URL.Path
+	location.RawQuery = r.Request.URL.RawQuery
+	rt, err := rest.TransportFor(&config)
+	if err != nil {
+		return err
+	}
+	upgradeTransport, err := upgradeTransportFor(&config)
+	if err != nil {
+		return err
+	}
+	responder := proxyErrorResponder{cluster: cluster}
+	if httpstream.IsUpgradeRequest(r.Request) {
+		// upgrade requests are sent by the upgrade transport instead of rt
+		if err := upstreamOf(cluster).admit(r.Request.Context()); err != nil {
+			responder.Error(r.Writer, r.Request, err)
+			return nil
+		}
+	}
+	log.Debugf("proxyPass stream url: %s", location)
+	handler := proxy.NewUpgradeAwareHandler(location, newUpstreamTransport(rt, cluster), false, false, responder)
+	handler.UpgradeTransport = upgradeTransport
+	handler.UseLocationHost = true
+	// the token of ckube must not be sent to the api server, and it prevents the credentials of cluster to be set
+	r.Request.Header.Del("Authorization")
+	handler.ServeHTTP(r.Writer, r.Request)
+	return nil
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/rest"
+
+	"github.com/DaoCloud/ckube/common"
+)
+
+func TestIsStreamRequest(t *testing.T) {
+	cases := []struct {
+		name    string
+		url     string
+		upgrade bool
+		expect  bool
+	}{
+		{
+			name:   "exec",
+			url:    "/api/v1/namespaces/default/pods/p1/exec?command=sh",
+			expect: true,
+		},
+		{
+			name:   "port forward",
+			url:    "/api/v1/namespaces/default/pods/p1/portforward",
+			expect: true,
+		},
+		{
+			name:   "logs follow",
+			url:    "/api/v1/namespaces/default/pods/p1/log?follow=true",
+			expect: true,
+		},
+		{
+			name:   "logs",
+			url:    "/api/v1/namespaces/default/pods/p1/log",
+			expect: false,
+		},
+		{
+			name:   "service proxy",
+			url:    "/api/v1/namespaces/default/services/s1/proxy/healthz",
+			expect: true,
+		},
+		{
+			name:   "pod named exec",
+			url:    "/api/v1/namespaces/default/pods/exec",
+			expect: false,
+		},
+		{
+			name:   "list",
+			url:    "/api/v1/pods",
+			expect: false,
+		},
+		{
+			name:    "upgrade",
+			url:     "/apis/example.com/v1/namespaces/default/foos/f1/shell",
+			upgrade: true,
+			expect:  true,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, c.url, nil)
+			if c.upgrade {
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", "SPDY/3.1")
+			}
+			assert.Equal(t, c.expect, isStreamRequest(req))
+		})
+	}
+}
+
+func TestProxyPassStream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer cluster-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Upgrade") == "" {
+			_, _ = w.Write([]byte(r.URL.Path + "?" + r.URL.RawQuery))
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: SPDY/3.1\r\n\r\n")
+		_ = rw.Flush()
+		line, _ := rw.ReadString('\n')
+		_, _ = rw.WriteString("echo " + line)
+		_ = rw.Flush()
+	}))
+	defer upstream.Close()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, proxyPassStream(&ReqContext{
+			ClusterConfigs: map[string]rest.Config{"default": {Host: upstream.URL, BearerToken: "cluster-token"}},
+			Request:        r,
+			Writer:         w,
+		}, "default"))
+	}))
+	defer s.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/api/v1/namespaces/default/pods/p1/log?follow=true", nil)
+	req.Header.Set("Authorization", "Bearer ckube-token")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	bs, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "/api/v1/namespaces/default/pods/p1/log?follow=true", string(bs))
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, _ = fmt.Fprintf(conn, "POST /api/v1/namespaces/default/pods/p1/exec?command=sh HTTP/1.1\r\n"+
+		"Host: ckube\r\nConnection: Upgrade\r\nUpgrade: SPDY/3.1\r\nAuthorization: Bearer ckube-token\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(reader, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	_, _ = conn.Write([]byte("hello\n"))
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "echo hello\n", line)
+}
+
+func TestProxyPassStream_CircuitOpen(t *testing.T) {
+	common.InitConfig(&common.Config{
+		Upstream: common.Upstream{Retries: -1, BreakerFailures: 1, BreakerSeconds: 60},
+	})
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	do := func(upgrade bool) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/namespaces/default/pods/p1/log?follow=true", nil)
+		if upgrade {
+			req, _ = http.NewRequest(http.MethodPost, "/api/v1/namespaces/default/pods/p1/exec?command=sh", nil)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "SPDY/3.1")
+		}
+		w := httptest.NewRecorder()
+		assert.Nil(t, proxyPassStream(&ReqContext{
+			ClusterConfigs: map[string]rest.Config{"stream-circuit-open": {Host: upstream.URL}},
+			Request:        req,
+			Writer:         w,
+		}, "stream-circuit-open"))
+		return w
+	}
+
+	// the failure opens the circuit breaker
+	assert.Equal(t, http.StatusServiceUnavailable, do(false).Code)
+	assert.True(t, circuitOpen("stream-circuit-open"))
+
+	// streaming and upgrade requests fail fast
+	for _, upgrade := range []bool{false, true} {
+		w := do(upgrade)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/flowcontrol"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/log"
+)
+
+const (
+	retryBaseDelay = 100 * time.Millisecond
+	maxRetryDelay  = 10 * time.Second
+)
+
+// errCircuitOpen is returned without requesting the api server if the circuit breaker of the cluster is open.
+var errCircuitOpen = fmt.Errorf("api server is unavailable, circuit breaker is open")
+
+// breaker opens after threshold consecutive failures, and is half open after opened for openFor,
+// which allows one request to probe the api server.
+type breaker struct {
+	lock      sync.Mutex
+	threshold int
+	openFor   time.Duration
+	failures  int
+	openedAt  time.Time
+	probing   bool
+}
+
+func (b *breaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.openFor {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *breaker) done(success bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// cancel releases the probe without changing the state.
+func (b *breaker) cancel() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) isOpen() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.failures >= b.threshold
+}
+
+// retryAfter returns the duration until the breaker is half open.
+func (b *breaker) retryAfter() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if d := b.openFor - time.Since(b.openedAt); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// upstream is the rate limiter and circuit breaker of the api server of a cluster.
+type upstream struct {
+	conf    common.Upstream
+	limiter flowcontrol.RateLimiter
+	breaker *breaker
+}
+
+var (
+	upstreams     = map[string]*upstream{}
+	upstreamsLock sync.Mutex
+)
+
+// upstreamOf returns the upstream of cluster, which is recreated if the config is changed.
+func upstreamOf(cluster string) *upstream {
+	conf := common.GetConfig().Upstream.WithDefaults()
+	upstreamsLock.Lock()
+	defer upstreamsLock.Unlock()
+	if u, ok := upstreams[cluster]; ok && u.conf == conf {
+		return u
+	}
+	u := &upstream{
+		conf:    conf,
+		limiter: flowcontrol.NewTokenBucketRateLimiter(conf.QPS, conf.Burst),
+		breaker: &breaker{
+			threshold: conf.BreakerFailures,
+			openFor:   time.Duration(conf.BreakerSeconds) * time.Second,
+		},
+	}
+	upstreams[cluster] = u
+	return u
+}
+
+// admit waits for the rate limiter and fails fast if the circuit breaker is open, it's for the requests
+// not sent by upstreamTransport such as upgrade requests, which never probe a half open circuit breaker
+// since their results are not known.
+func (u *upstream) admit(ctx context.Context) error {
+	if err := u.limiter.Wait(ctx); err != nil {
+		return err
+	}
+	if u.breaker.isOpen() {
+		return errCircuitOpen
+	}
+	return nil
+}
+
+// upstreamTransport limits the requests to the api server, retries the idempotent requests failed
+// with 429 or 5xx, and fails fast if the circuit breaker is open, see unavailable for the failures
+// counted by the circuit breaker.
+type upstreamTransport struct {
+	rt       http.RoundTripper
+	cluster  string
+	upstream *upstream
+}
+
+func newUpstreamTransport(rt http.RoundTripper, cluster string) *upstreamTransport {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &upstreamTransport{
+		rt:       rt,
+		cluster:  cluster,
+		upstream: upstreamOf(cluster),
+	}
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := t.upstream
+	for retry := 0; ; retry++ {
+		if err := u.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+		if !u.breaker.allow() {
+			return nil, errCircuitOpen
+		}
+		resp, err := t.rt.RoundTrip(req)
+		if err != nil && req.Context().Err() != nil {
+			// canceled by the client or timed out, not the fault of api server
+			u.breaker.cancel()
+			return nil, err
+		}
+		u.breaker.done(!unavailable(resp, err))
+		failed := err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		if !failed || retry >= u.conf.Retries || !retryable(req) {
+			return resp, err
+		}
+		delay := retryDelay(retry, resp)
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			log.Warnf("cluster(%s): %s %s got %d, retry after %v", t.cluster, req.Method, req.URL.Path, resp.StatusCode, delay)
+		} else {
+			log.Warnf("cluster(%s): %s %s error: %v, retry after %v", t.cluster, req.Method, req.URL.Path, err, delay)
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// maxStatusPeek is the max size of a response body read to check whether it's a Status of the api server.
+const maxStatusPeek = 64 << 10
+
+// unavailable reports whether the api server is unavailable according to the result of a request,
+// which is counted by the circuit breaker. Transport errors and 502, 503 and 504 not answered by the
+// api server, such as the ones of a load balancer in front of it, are counted. A Status of the api server
+// is only counted if it's 503 with Retry-After, with which the api server asks the clients to back off.
+// The other failures answered by the api server, such as 429 of priority and fairness, 500 or 503 of
+// admission webhooks and aggregated apis, only fail the requests of a client.
+func unavailable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+	default:
+		return false
+	}
+	if !apiStatus(resp) {
+		return true
+	}
+	return resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != ""
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// apiStatus reports whether the body of resp is a Status, which is returned by the api server,
+// the body is kept for the client.
+func apiStatus(resp *http.Response) bool {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return false
+	}
+	bs, err := io.ReadAll(io.LimitReader(resp.Body, maxStatusPeek))
+	resp.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(bs), resp.Body), Closer: resp.Body}
+	if err != nil {
+		return false
+	}
+	status := v1.Status{}
+	return json.Unmarshal(bs, &status) == nil && status.Kind == "Status"
+}
+
+// retryable reports whether req is idempotent and can be sent again.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
+
+// retryDelay returns the delay before the retry, Retry-After of the response is honored.
+func retryDelay(retry int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			if d := time.Duration(seconds) * time.Second; d < maxRetryDelay {
+				return d
+			}
+			return maxRetryDelay
+		}
+	}
+	return wait.Jitter(retryBaseDelay<<retry, 0.5)
+}
+
+// circuitOpen reports whether the circuit breaker of cluster is open.
+func circuitOpen(cluster string) bool {
+	return upstreamOf(cluster).breaker.isOpen()
+}
+
+// warnStale sets the warning header to the response served from cache while the api server is unavailable.
+func warnStale(r *ReqContext, cluster string) {
+	r.Writer.Header().Add("Warning",
+		fmt.Sprintf(`299 - "api server of cluster %s is unavailable, the result may be stale"`, cluster))
+}
+
+// staleRead reports whether the cached read may be served even if it may be stale, because
+// the circuit breaker of cluster is open, the warning header is set if so.
+func staleRead(r *ReqContext, cluster string) bool {
+	if !circuitOpen(cluster) {
+		return false
+	}
+	warnStale(r, cluster)
+	return true
+}
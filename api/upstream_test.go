@@ -0,0 +1,350 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/store"
+)
+
+func TestBreaker(t *testing.T) {
+	b := &breaker{threshold: 2, openFor: 50 * time.Millisecond}
+	assert.True(t, b.allow())
+	b.done(false)
+	assert.False(t, b.isOpen())
+	b.done(true)
+	b.done(false)
+	b.done(false)
+	assert.True(t, b.isOpen())
+	assert.False(t, b.allow())
+	assert.True(t, b.retryAfter() > 0)
+	time.Sleep(60 * time.Millisecond)
+	// half open, only one probe is allowed
+	assert.True(t, b.allow())
+	assert.False(t, b.allow())
+	b.cancel()
+	assert.True(t, b.allow())
+	b.done(false)
+	assert.False(t, b.allow())
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, b.allow())
+	b.done(true)
+	assert.False(t, b.isOpen())
+	assert.True(t, b.allow())
+}
+
+func TestUpstreamTransport(t *testing.T) {
+	common.InitConfig(&common.Config{Upstream: common.Upstream{QPS: 1000, Burst: 1000, Retries: 2, BreakerFailures: 3}})
+	cases := []struct {
+		name          string
+		method        string
+		body          string
+		codes         []int
+		expectCode    int
+		expectErr     error
+		expectTries   int32
+		expectOpen    bool
+		expectBodies  []string
+		replayableOff bool
+	}{
+		{
+			name:        "get retried",
+			method:      http.MethodGet,
+			codes:       []int{503, 500, 200},
+			expectCode:  200,
+			expectTries: 3,
+		},
+		{
+			name:        "too many requests",
+			method:      http.MethodGet,
+			codes:       []int{429, 429, 429, 200},
+			expectCode:  429,
+			expectTries: 3,
+		},
+		{
+			name:        "bad gateway",
+			method:      http.MethodGet,
+			codes:       []int{502, 504, 503, 200},
+			expectCode:  503,
+			expectTries: 3,
+			expectOpen:  true,
+		},
+		{
+			name:        "post not retried",
+			method:      http.MethodPost,
+			body:        "{}",
+			codes:       []int{503, 200},
+			expectCode:  503,
+			expectTries: 1,
+		},
+		{
+			name:         "put replayed",
+			method:       http.MethodPut,
+			body:         `{"kind":"Pod"}`,
+			codes:        []int{500, 200},
+			expectCode:   200,
+			expectTries:  2,
+			expectBodies: []string{`{"kind":"Pod"}`, `{"kind":"Pod"}`},
+		},
+		{
+			name:          "put not replayable",
+			method:        http.MethodPut,
+			body:          `{"kind":"Pod"}`,
+			codes:         []int{500, 200},
+			expectCode:    500,
+			expectTries:   1,
+			replayableOff: true,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			var tries int32
+			bodies := []string{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&tries, 1)
+				bs, _ := io.ReadAll(r.Body)
+				bodies = append(bodies, string(bs))
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(c.codes[n-1])
+			}))
+			defer srv.Close()
+			req, _ := http.NewRequest(c.method, srv.URL, bytes.NewBufferString(c.body))
+			if c.replayableOff {
+				req.GetBody = nil
+			}
+			cluster := fmt.Sprintf("transport-%d", i)
+			resp, err := newUpstreamTransport(nil, cluster).RoundTrip(req)
+			assert.Equal(t, c.expectErr, err)
+			if err == nil {
+				assert.Equal(t, c.expectCode, resp.StatusCode)
+				_ = resp.Body.Close()
+			}
+			assert.Equal(t, c.expectTries, atomic.LoadInt32(&tries))
+			assert.Equal(t, c.expectOpen, circuitOpen(cluster))
+			if c.expectBodies != nil {
+				assert.Equal(t, c.expectBodies, bodies)
+			}
+		})
+	}
+}
+
+func TestProxy_CircuitOpen(t *testing.T) {
+	common.InitConfig(&common.Config{
+		DefaultCluster: "circuit-open",
+		Proxies: []common.Proxy{
+			{
+				Group:    "",
+				Version:  "v1",
+				Resource: "pods",
+				ListKind: "PodList",
+			},
+		},
+		Upstream: common.Upstream{Retries: -1, BreakerFailures: 1, BreakerSeconds: 60},
+	})
+	var tries int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tries, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	client, _ := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	do := func(path string, vars map[string]string) (*httptest.ResponseRecorder, interface{}) {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		req = mux.SetURLVars(req, vars)
+		w := httptest.NewRecorder()
+		res := Proxy(&ReqContext{
+			ClusterClients: map[string]kubernetes.Interface{"circuit-open": client},
+			Store: versionStore{
+				fakeStore: fakeStore{storeResources: store.QueryResult{Items: testPods, Total: 1}},
+				observed:  10,
+			},
+			Request: req,
+			Writer:  w,
+		})
+		return w, res
+	}
+	podVars := map[string]string{"version": "v1", "resourceType": "pods"}
+	configMapVars := map[string]string{"version": "v1", "resourceType": "configmaps"}
+
+	// the failure opens the circuit breaker
+	w, res := do("/api/v1/configmaps", configMapVars)
+	assert.Nil(t, res)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.True(t, circuitOpen("circuit-open"))
+
+	// fail fast
+	w, res = do("/api/v1/configmaps", configMapVars)
+	assert.Nil(t, res)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tries))
+
+	// stale reads are served from cache
+	warning := `299 - "api server of cluster circuit-open is unavailable, the result may be stale"`
+	for _, path := range []string{"/api/v1/pods?minResourceVersion=20", "/api/v1/pods?resourceVersion=20"} {
+		w, res = do(path, podVars)
+		assert.NotNil(t, res)
+		assert.Equal(t, warning, w.Header().Get("Warning"))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tries))
+}
+
+func TestUpstreamTransport_Admission(t *testing.T) {
+	common.InitConfig(&common.Config{Upstream: common.Upstream{QPS: 1000, Burst: 1000, BreakerFailures: 3}})
+	webhookStatus := `{"kind":"Status","apiVersion":"v1","status":"Failure","code":%d,` +
+		`"message":"Internal error occurred: failed calling webhook \"validate.example.io\": admission webhook is unavailable"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			// the writes of one client are rejected by a broken webhook
+			code := 500
+			if r.URL.Path == "/unavailable" {
+				code = 503
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			_, _ = fmt.Fprintf(w, webhookStatus, code)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	defer srv.Close()
+	tr := newUpstreamTransport(nil, "admission")
+	for _, path := range []string{"/", "/", "/unavailable", "/unavailable"} {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+path, bytes.NewBufferString("{}"))
+		resp, err := tr.RoundTrip(req)
+		assert.NoError(t, err)
+		bs, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		// the status is passed to the client
+		assert.Contains(t, string(bs), "admission webhook")
+	}
+	assert.False(t, circuitOpen("admission"))
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	resp, err := tr.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestUnavailable(t *testing.T) {
+	status := func(code int, reason metav1.StatusReason) string {
+		bs, _ := json.Marshal(metav1.Status{
+			TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+			Status:   metav1.StatusFailure,
+			Reason:   reason,
+			Code:     int32(code),
+		})
+		return string(bs)
+	}
+	cases := []struct {
+		name       string
+		err        error
+		code       int
+		json       bool
+		retryAfter string
+		body       string
+		expect     bool
+	}{
+		{
+			name:   "transport error",
+			err:    fmt.Errorf("connection refused"),
+			expect: true,
+		},
+		{
+			name:   "bad gateway of load balancer",
+			code:   http.StatusBadGateway,
+			body:   "<html>502 Bad Gateway</html>",
+			expect: true,
+		},
+		{
+			name:   "gateway timeout without body",
+			code:   http.StatusGatewayTimeout,
+			expect: true,
+		},
+		{
+			name:   "json not a status",
+			code:   http.StatusServiceUnavailable,
+			json:   true,
+			body:   `{"message":"no healthy upstream"}`,
+			expect: true,
+		},
+		{
+			name:       "api server backs off",
+			code:       http.StatusServiceUnavailable,
+			json:       true,
+			retryAfter: "1",
+			body:       status(http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable),
+			expect:     true,
+		},
+		{
+			name:   "aggregated api unavailable",
+			code:   http.StatusServiceUnavailable,
+			json:   true,
+			body:   status(http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable),
+			expect: false,
+		},
+		{
+			name:   "webhook denied with 503",
+			code:   http.StatusServiceUnavailable,
+			json:   true,
+			body:   status(http.StatusServiceUnavailable, ""),
+			expect: false,
+		},
+		{
+			name:   "request timeout",
+			code:   http.StatusGatewayTimeout,
+			json:   true,
+			body:   status(http.StatusGatewayTimeout, metav1.StatusReasonTimeout),
+			expect: false,
+		},
+		{
+			name:   "internal error",
+			code:   http.StatusInternalServerError,
+			body:   "internal error",
+			expect: false,
+		},
+		{
+			name:       "too many requests",
+			code:       http.StatusTooManyRequests,
+			retryAfter: "1",
+			expect:     false,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			var resp *http.Response
+			if c.err == nil {
+				resp = &http.Response{
+					StatusCode: c.code,
+					Header:     http.Header{},
+					Body:       io.NopCloser(bytes.NewBufferString(c.body)),
+				}
+				if c.json {
+					resp.Header.Set("Content-Type", "application/json")
+				}
+				if c.retryAfter != "" {
+					resp.Header.Set("Retry-After", c.retryAfter)
+				}
+			}
+			assert.Equal(t, c.expect, unavailable(resp, c.err))
+			if resp != nil {
+				// the body is kept for the client
+				bs, _ := io.ReadAll(resp.Body)
+				assert.Equal(t, c.body, string(bs))
+			}
+		})
+	}
+}
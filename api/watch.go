@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/framer"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+
+	"github.com/DaoCloud/ckube/log"
+)
+
+const (
+	// defaultWatchTimeout is the timeout of watch requests without timeoutSeconds.
+	defaultWatchTimeout = 30 * time.Minute
+	// maxWatchFrameSize is the max size of a watch event, the same as the limit of client-go.
+	maxWatchFrameSize = 16 * 1024 * 1024
+	watchFrameSize    = 32 * 1024
+)
+
+// watchFrameReader reads the frames of watch events from the upstream stream,
+// the frames are length delimited for protobuf and newline delimited for json.
+type watchFrameReader struct {
+	reader   io.ReadCloser
+	buf      []byte
+	protobuf bool
+}
+
+func newWatchFrameReader(body io.ReadCloser, contentType string) *watchFrameReader {
+	r := &watchFrameReader{buf: make([]byte, watchFrameSize)}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == runtime.ContentTypeProtobuf {
+		r.protobuf = true
+		r.reader = framer.NewLengthDelimitedFrameReader(body)
+	} else {
+		r.reader = framer.NewJSONFramedReader(body)
+	}
+	return r
+}
+
+// next returns the next frame, the frame is only valid until the next call.
+func (r *watchFrameReader) next() ([]byte, error) {
+	base := 0
+	for {
+		n, err := r.reader.Read(r.buf[base:])
+		if err == io.ErrShortBuffer {
+			if n == 0 {
+				return nil, fmt.Errorf("got short buffer with n=0, base=%d, cap=%d", base, cap(r.buf))
+			}
+			if len(r.buf) >= maxWatchFrameSize {
+				return nil, fmt.Errorf("watch event is larger than %d bytes", maxWatchFrameSize)
+			}
+			base += n
+			r.buf = append(r.buf, make([]byte, len(r.buf))...)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return r.buf[:base+n], nil
+	}
+}
+
+// decode decodes the frame to the watch event, the object of the event is left raw.
+func (r *watchFrameReader) decode(frame []byte) (*v1.WatchEvent, error) {
+	event := &v1.WatchEvent{}
+	if r.protobuf {
+		return event, event.Unmarshal(frame)
+	}
+	return event, json.Unmarshal(frame, event)
+}
+
+// encode encodes the frame to be written to the client in one write, so that it's flushed as a whole.
+func (r *watchFrameReader) encode(frame []byte) []byte {
+	if r.protobuf {
+		bs := make([]byte, 4, 4+len(frame))
+		binary.BigEndian.PutUint32(bs, uint32(len(frame)))
+		return append(bs, frame...)
+	}
+	return append(frame, '\n')
+}
+
+func (r *watchFrameReader) Close() error {
+	return r.reader.Close()
+}
+
+// watchTimeout returns the timeout of the watch request, which is timeoutSeconds if specified.
+func watchTimeout(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("timeoutSeconds")
+	if v == "" {
+		return defaultWatchTimeout, nil
+	}
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid timeoutSeconds %q", v)
+	}
+	if seconds == 0 {
+		return defaultWatchTimeout, nil
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// proxyPassWatch relays the watch events from api server to the client frame by frame,
+// the upstream request is canceled as soon as the client disconnects or the watch times out.
+// The watch is limited by the rate limiter and circuit breaker of cluster like the other requests.
+func proxyPassWatch(r *ReqContext, cluster string) interface{} {
+	timeout, err := watchTimeout(r.Request)
+	if err != nil {
+		return errorProxy(r.Writer, v1.Status{
+			Status:  v1.StatusFailure,
+			Message: err.Error(),
+			Reason:  v1.StatusReasonBadRequest,
+			Code:    400,
+		})
+	}
+	q := r.Request.URL.Query()
+	q.Set("timeoutSeconds", strconv.FormatInt(int64(timeout/time.Second), 10))
+	if v, ok := q["labelSelector"]; ok {
+		if len(v) == 1 && v[0] == "<none>" {
+			delete(q, "labelSelector")
+		}
+	}
+	r.Request.URL.RawQuery = q.Encode()
+	u := r.Request.URL.String()
+	log.Debugf("proxyPass url: %s", u)
+	ctx, cancel := context.WithTimeout(r.Request.Context(), timeout)
+	defer cancel()
+	c := r.ClusterClients[cluster].Discovery().RESTClient().(*rest.RESTClient)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Get().RequestURI(u).Timeout(0).URL().String(), nil)
+	if err != nil {
+		return err
+	}
+	if accept := r.Request.Header.Get("Accept"); accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	// the shared client may have a timeout shorter than the watch
+	client := *c.Client
+	client.Timeout = 0
+	client.Transport = newUpstreamTransport(c.Client.Transport, cluster)
+	resp, err := client.Do(req)
+	if err != nil {
+		proxyErrorResponder{cluster: cluster}.Error(r.Writer, r.Request, err)
+		return nil
+	}
+	defer resp.Body.Close()
+	contentType := resp.Header.Get("Content-Type")
+	r.Writer.Header().Set("Content-Type", contentType)
+	if resp.StatusCode != http.StatusOK {
+		r.Writer.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(r.Writer, resp.Body)
+		return nil
+	}
+	r.Writer.WriteHeader(http.StatusOK)
+	reader := newWatchFrameReader(resp.Body, contentType)
+	defer reader.Close()
+	for {
+		frame, err := reader.next()
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				log.Warnf("cluster(%s): read watch events of %s error: %v", cluster, r.Request.URL.Path, err)
+			}
+			return nil
+		}
+		event, err := reader.decode(frame)
+		if err != nil {
+			log.Warnf("cluster(%s): decode watch event of %s error: %v", cluster, r.Request.URL.Path, err)
+			return nil
+		}
+		if event.Type == string(watch.Error) {
+			log.Warnf("cluster(%s): watch %s got error event: %s", cluster, r.Request.URL.Path, event.Object.Raw)
+		}
+		if _, err := r.Writer.Write(reader.encode(frame)); err != nil {
+			return nil
+		}
+	}
+}
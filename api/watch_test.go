@@ -0,0 +1,222 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/DaoCloud/ckube/common"
+)
+
+type streamWriter struct {
+	lock   sync.Mutex
+	header http.Header
+	code   int
+	writes [][]byte
+	wrote  chan struct{}
+}
+
+func (w *streamWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *streamWriter) Write(bs []byte) (int, error) {
+	w.lock.Lock()
+	w.writes = append(w.writes, append([]byte{}, bs...))
+	w.lock.Unlock()
+	select {
+	case w.wrote <- struct{}{}:
+	default:
+	}
+	return len(bs), nil
+}
+
+func (w *streamWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+func TestProxyPassWatch(t *testing.T) {
+	events := []metav1.WatchEvent{
+		{Type: "ADDED", Object: runtime.RawExtension{Raw: []byte(`{"kind":"Pod","metadata":{"name":"p1"}}`)}},
+		{Type: "BOOKMARK", Object: runtime.RawExtension{Raw: []byte(`{"kind":"Pod","metadata":{"resourceVersion":"10"}}`)}},
+	}
+	jsonFrames := [][]byte{}
+	protoFrames := [][]byte{}
+	for _, e := range events {
+		bs, _ := json.Marshal(e)
+		jsonFrames = append(jsonFrames, append(bs, '\n'))
+		bs, _ = e.Marshal()
+		prefix := make([]byte, 4)
+		binary.BigEndian.PutUint32(prefix, uint32(len(bs)))
+		protoFrames = append(protoFrames, append(prefix, bs...))
+	}
+	var query string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		if r.URL.Query().Get("fieldSelector") == "bad" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"kind":"Status","code":400}`))
+			return
+		}
+		frames := jsonFrames
+		if r.Header.Get("Accept") == "application/vnd.kubernetes.protobuf;stream=watch" {
+			w.Header().Set("Content-Type", "application/vnd.kubernetes.protobuf;stream=watch")
+			frames = protoFrames
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		for _, f := range frames {
+			// split the frame to make sure the events are relayed as a whole
+			_, _ = w.Write(f[:3])
+			w.(http.Flusher).Flush()
+			_, _ = w.Write(f[3:])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer s.Close()
+	client, _ := kubernetes.NewForConfig(&rest.Config{Host: s.URL})
+	cases := []struct {
+		name        string
+		url         string
+		accept      string
+		expectCode  int
+		expectQuery string
+		expect      [][]byte
+	}{
+		{
+			name:        "json",
+			url:         "/api/v1/pods?watch=true&allowWatchBookmarks=true",
+			expectCode:  200,
+			expectQuery: "allowWatchBookmarks=true&timeoutSeconds=1800&watch=true",
+			expect:      jsonFrames,
+		},
+		{
+			name:        "protobuf",
+			url:         "/api/v1/pods?watch=true&timeoutSeconds=10",
+			accept:      "application/vnd.kubernetes.protobuf;stream=watch",
+			expectCode:  200,
+			expectQuery: "timeoutSeconds=10&watch=true",
+			expect:      protoFrames,
+		},
+		{
+			name:       "invalid timeout",
+			url:        "/api/v1/pods?watch=true&timeoutSeconds=x",
+			expectCode: 400,
+		},
+		{
+			name:        "upstream error",
+			url:         "/api/v1/pods?watch=true&fieldSelector=bad",
+			expectCode:  400,
+			expectQuery: "fieldSelector=bad&timeoutSeconds=1800&watch=true",
+			expect:      [][]byte{[]byte(`{"kind":"Status","code":400}`)},
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			query = ""
+			req, _ := http.NewRequest(http.MethodGet, c.url, nil)
+			if c.accept != "" {
+				req.Header.Set("Accept", c.accept)
+			}
+			w := &streamWriter{header: http.Header{}}
+			res := proxyPassWatch(&ReqContext{
+				ClusterClients: map[string]kubernetes.Interface{"default": client},
+				Request:        req,
+				Writer:         w,
+			}, "default")
+			if c.expectCode != 200 && c.expect == nil {
+				assert.Equal(t, int32(c.expectCode), res.(metav1.Status).Code)
+				return
+			}
+			assert.Nil(t, res)
+			assert.Equal(t, c.expectCode, w.code)
+			assert.Equal(t, c.expectQuery, query)
+			assert.Equal(t, c.expect, w.writes)
+		})
+	}
+}
+
+func TestProxyPassWatch_ClientDisconnect(t *testing.T) {
+	upstreamDone := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"type":"ADDED","object":{"kind":"Pod"}}` + "\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(upstreamDone)
+	}))
+	defer s.Close()
+	client, _ := kubernetes.NewForConfig(&rest.Config{Host: s.URL})
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/api/v1/pods?watch=1", nil)
+	w := &streamWriter{header: http.Header{}, wrote: make(chan struct{}, 1)}
+	returned := make(chan interface{})
+	go func() {
+		returned <- proxyPassWatch(&ReqContext{
+			ClusterClients: map[string]kubernetes.Interface{"default": client},
+			Request:        req,
+			Writer:         w,
+		}, "default")
+	}()
+	select {
+	case <-w.wrote:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event relayed")
+	}
+	cancel()
+	select {
+	case res := <-returned:
+		assert.Nil(t, res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not stopped after client disconnected")
+	}
+	select {
+	case <-upstreamDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request not canceled")
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	assert.True(t, bytes.Equal([]byte(`{"type":"ADDED","object":{"kind":"Pod"}}`+"\n"), w.writes[0]))
+}
+
+func TestProxyPassWatch_CircuitOpen(t *testing.T) {
+	common.InitConfig(&common.Config{
+		Upstream: common.Upstream{Retries: -1, BreakerFailures: 1, BreakerSeconds: 60},
+	})
+	var hits int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+	client, _ := kubernetes.NewForConfig(&rest.Config{Host: s.URL})
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/pods?watch=true", nil)
+		w := &streamWriter{header: http.Header{}}
+		assert.Nil(t, proxyPassWatch(&ReqContext{
+			ClusterClients: map[string]kubernetes.Interface{"watch-circuit-open": client},
+			Request:        req,
+			Writer:         w,
+		}, "watch-circuit-open"))
+		assert.Equal(t, http.StatusServiceUnavailable, w.code)
+	}
+	// the watch is counted by the circuit breaker, and fails fast once it's open
+	assert.True(t, circuitOpen("watch-circuit-open"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+}
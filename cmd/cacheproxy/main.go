@@ -14,6 +14,7 @@ import (
 	"sigs.k8s.io/yaml"
 
 	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/kube"
 	"github.com/DaoCloud/ckube/log"
 	"github.com/DaoCloud/ckube/server"
 	"github.com/DaoCloud/ckube/store"
@@ -65,19 +66,124 @@ func GetKubernetesClientWithFile(kubeconfig, context string) (kubernetes.Interfa
 	return clientset, err
 }
 
-func loadFromConfig(kubeConfig, configFile string) (map[string]kubernetes.Interface, watcher.Watcher, store.Store, error) {
-
+func readConfig(configFile string) (common.Config, error) {
 	cfg := common.Config{}
-	if bs, err := os.ReadFile(configFile); err != nil {
+	bs, err := os.ReadFile(configFile)
+	if err != nil {
 		log.Errorf("config file load error: %v", err)
-		return nil, nil, nil, err
-	} else {
-		err := json.Unmarshal(bs, &cfg)
-		if err != nil {
-			log.Errorf("config file load error: %v", err)
-			return nil, nil, nil, err
+		return cfg, err
+	}
+	if err := json.Unmarshal(bs, &cfg); err != nil {
+		log.Errorf("config file load error: %v", err)
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// offlineWatcher watches nothing, the store is loaded from a dump.
+type offlineWatcher struct{}
+
+func (offlineWatcher) Start() error {
+	return nil
+}
+
+func (offlineWatcher) Stop() error {
+	return nil
+}
+
+// loadFromDump loads the store from the dump file and serves it without clusters,
+// the config file is optional and the proxies of it are replaced by the resources in the dump.
+func loadFromDump(configFile, dumpFile string) (map[string]kubernetes.Interface, map[string]rest.Config, watcher.Watcher, store.Store, error) {
+	cfg := common.Config{}
+	if _, err := os.Stat(configFile); err == nil {
+		if cfg, err = readConfig(configFile); err != nil {
+			return nil, nil, nil, nil, err
 		}
 	}
+	if err := cfg.CacheLimit.Validate(); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	f, err := os.Open(dumpFile)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	defer f.Close()
+	header, m, err := memory.LoadDump(f, cfg.CacheLimit)
+	if err != nil {
+		log.Errorf("load dump %s error: %v", dumpFile, err)
+		return nil, nil, nil, nil, err
+	}
+	cfg.Proxies = header.Proxies
+	cfg.DefaultCluster = header.DefaultCluster
+	common.InitConfig(&cfg)
+	log.Infof("serving the dump created at %v offline, %d objects loaded", header.CreatedAt, m.Status().Objects)
+	prommonitor.Up.WithLabelValues(prommonitor.CkubeComponent).Set(1)
+	return map[string]kubernetes.Interface{}, map[string]rest.Config{}, offlineWatcher{}, m, nil
+}
+
+// newStore creates the memory store of the proxies in cfg, the patterns are skipped.
+func newStore(cfg common.Config) (store.Store, []store.GroupVersionResource, error) {
+	if err := cfg.CacheLimit.Validate(); err != nil {
+		return nil, nil, err
+	}
+	indexConf := map[store.GroupVersionResource]map[string]string{}
+	searchable := map[store.GroupVersionResource][]string{}
+	limits := map[store.GroupVersionResource]common.CacheLimit{}
+	storeGVRConfig := []store.GroupVersionResource{}
+	for _, proxy := range cfg.Proxies {
+		if proxy.IsPattern() {
+			continue
+		}
+		if err := proxy.Limit.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("proxy %s: %v", proxy.Resource, err)
+		}
+		gvr := store.GroupVersionResource{
+			Group:    proxy.Group,
+			Version:  proxy.Version,
+			Resource: proxy.Resource,
+		}
+		indexConf[gvr] = proxy.Index
+		searchable[gvr] = proxy.Searchable
+		limits[gvr] = proxy.Limit
+		storeGVRConfig = append(storeGVRConfig, store.GroupVersionResource{
+			Group:    proxy.Group,
+			Version:  proxy.Version,
+			Resource: proxy.Resource,
+		})
+	}
+	return memory.NewMemoryStore(indexConf, memory.WithSearchable(searchable), memory.WithLimits(cfg.CacheLimit, limits)), storeGVRConfig, nil
+}
+
+// loadFromManifests serves the manifests in dir without clusters, the objects of the proxies in the config file
+// are loaded as the objects of the default cluster and reloaded when the manifests are changed.
+func loadFromManifests(configFile, dir string) (map[string]kubernetes.Interface, map[string]rest.Config, watcher.Watcher, store.Store, error) {
+	cfg, err := readConfig(configFile)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	if cfg.DefaultCluster == "" {
+		cfg.DefaultCluster = "default"
+	}
+	common.InitConfig(&cfg)
+	m, storeGVRConfig, err := newStore(cfg)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	w := watcher.NewFileWatcher(dir, cfg.DefaultCluster, storeGVRConfig, m)
+	if err := w.Start(); err != nil {
+		log.Errorf("load manifests %s error: %v", dir, err)
+		return nil, nil, nil, nil, err
+	}
+	log.Infof("serving the manifests in %s offline, %d objects loaded", dir, m.Status().Objects)
+	prommonitor.Up.WithLabelValues(prommonitor.CkubeComponent).Set(1)
+	return map[string]kubernetes.Interface{}, map[string]rest.Config{}, w, m, nil
+}
+
+func loadFromConfig(kubeConfig, configFile string) (map[string]kubernetes.Interface, map[string]rest.Config, watcher.Watcher, store.Store, error) {
+	cfg, err := readConfig(configFile)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
 	clusterConfigs := map[string]rest.Config{}
 	clusterClients := map[string]kubernetes.Interface{}
 	kubecfg := kubeapi.Config{}
@@ -89,7 +195,7 @@ func loadFromConfig(kubeConfig, configFile string) (map[string]kubernetes.Interf
 			c := GetK8sConfigConfigWithFile(kubeConfig, "")
 			if c == nil {
 				log.Errorf("init k8s config from service account error")
-				return nil, nil, nil, fmt.Errorf("init k8s config error")
+				return nil, nil, nil, nil, fmt.Errorf("init k8s config error")
 			}
 			if cfg.DefaultCluster == "" {
 				cfg.DefaultCluster = "default"
@@ -97,7 +203,7 @@ func loadFromConfig(kubeConfig, configFile string) (map[string]kubernetes.Interf
 			clusterConfigs[cfg.DefaultCluster] = *c
 			client, err := GetKubernetesClientWithFile(kubeConfig, "")
 			if err != nil {
-				return nil, nil, nil, err
+				return nil, nil, nil, nil, err
 			}
 			clusterClients[cfg.DefaultCluster] = client
 		} else {
@@ -108,14 +214,14 @@ func loadFromConfig(kubeConfig, configFile string) (map[string]kubernetes.Interf
 		bs, err := os.ReadFile(kubeConfig)
 		if err != nil {
 			log.Errorf("read kube config error: %v", err)
-			return nil, nil, nil, err
+			return nil, nil, nil, nil, err
 		}
 		err = yaml.Unmarshal(bs, &kubecfg)
 		if err != nil {
 			err = json.Unmarshal(bs, &kubecfg)
 			if err != nil {
 				log.Errorf("parse kube config %s error: %v", kubeConfig, err)
-				return nil, nil, nil, err
+				return nil, nil, nil, nil, err
 			}
 		}
 		log.Debugf("got kube config: %s", bs)
@@ -125,68 +231,80 @@ func loadFromConfig(kubeConfig, configFile string) (map[string]kubernetes.Interf
 			c := GetK8sConfigConfigWithFile(kubeConfig, ctx.Name)
 			if c == nil {
 				log.Errorf("init k8s config error")
-				return nil, nil, nil, fmt.Errorf("init k8s config error")
+				return nil, nil, nil, nil, fmt.Errorf("init k8s config error")
 			}
 			clusterConfigs[ctx.Name] = *c
 			client, err := GetKubernetesClientWithFile(kubeConfig, ctx.Name)
 			if err != nil {
 				log.Errorf("init k8s client error: %v", err)
-				return nil, nil, nil, err
+				return nil, nil, nil, nil, err
 			}
 			clusterClients[ctx.Name] = client
 		}
 	}
+	proxies, err := kube.DiscoverProxies(clusterClients, cfg.Proxies)
+	if err != nil {
+		log.Errorf("discovery proxies error: %v", err)
+		return nil, nil, nil, nil, err
+	}
+	cfg.Proxies = proxies
 	common.InitConfig(&cfg)
 
 	// 记录组件运行状态
 	prommonitor.Up.WithLabelValues(prommonitor.CkubeComponent).Set(1)
 
-	indexConf := map[store.GroupVersionResource]map[string]string{}
-	storeGVRConfig := []store.GroupVersionResource{}
-	for _, proxy := range cfg.Proxies {
-		indexConf[store.GroupVersionResource{
-			Group:    proxy.Group,
-			Version:  proxy.Version,
-			Resource: proxy.Resource,
-		}] = proxy.Index
-		storeGVRConfig = append(storeGVRConfig, store.GroupVersionResource{
-			Group:    proxy.Group,
-			Version:  proxy.Version,
-			Resource: proxy.Resource,
-		})
+	m, storeGVRConfig, err := newStore(cfg)
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
-	m := memory.NewMemoryStore(indexConf)
 	w := watcher.NewWatcher(clusterConfigs, storeGVRConfig, m)
 	_ = w.Start()
-	return clusterClients, w, m, nil
+	return clusterClients, clusterConfigs, w, m, nil
 }
 
 func main() {
 	configFile := ""
 	listen := ":80"
 	kubeConfig := ""
+	dumpFile := ""
+	manifestsDir := ""
 	debug := false
 	defaultConfig := path.Join(os.Getenv("HOME"), ".kube/config")
 	flag.StringVar(&configFile, "c", "config/local.json", "config file path")
 	flag.StringVar(&listen, "a", ":80", "listen port")
 	flag.StringVar(&kubeConfig, "k", "", "kube config file name")
+	flag.StringVar(&dumpFile, "dump", "", "serve the cache dump file offline without clusters")
+	flag.StringVar(&manifestsDir, "manifests", "", "serve the manifests in the directory offline without clusters")
 	flag.BoolVar(&debug, "d", false, "debug mode")
 	flag.Parse()
 	if debug {
 		log.SetDebug()
 	}
-	clis, w, s, err := loadFromConfig(kubeConfig, configFile)
-	if err != nil {
-		log.Errorf("load from config file error: %v", err)
-		os.Exit(1)
+	load := func() (map[string]kubernetes.Interface, map[string]rest.Config, watcher.Watcher, store.Store, error) {
+		return loadFromConfig(kubeConfig, configFile)
 	}
-	ser := server.NewMuxServer(listen, clis, s)
 	files := []string{configFile}
-	if kubeConfig == "" {
+	if dumpFile != "" {
+		load = func() (map[string]kubernetes.Interface, map[string]rest.Config, watcher.Watcher, store.Store, error) {
+			return loadFromDump(configFile, dumpFile)
+		}
+		files = append(files, dumpFile)
+	} else if manifestsDir != "" {
+		// the changes of the manifests are watched by the file watcher
+		load = func() (map[string]kubernetes.Interface, map[string]rest.Config, watcher.Watcher, store.Store, error) {
+			return loadFromManifests(configFile, manifestsDir)
+		}
+	} else if kubeConfig == "" {
 		files = append(files, defaultConfig)
 	} else {
 		files = append(files, kubeConfig)
 	}
+	clis, configs, w, s, err := load()
+	if err != nil {
+		log.Errorf("load from config file error: %v", err)
+		os.Exit(1)
+	}
+	ser := server.NewMuxServer(listen, clis, configs, s)
 	fixedWatcher, err := utils.NewFixedFileWatcher(files)
 	if err != nil {
 		log.Errorf("create watcher error: %v", err)
@@ -205,16 +323,19 @@ func main() {
 					log.Errorf("got file watcher error type: file: %s", e.Name)
 					// do reload
 				}
-				clis, rw, rs, err := loadFromConfig(kubeConfig, configFile)
+				clis, configs, rw, rs, err := load()
 				if err != nil {
 					prommonitor.ConfigReload.WithLabelValues("failed").Inc()
 					log.Errorf("watcher: reload config error: %v", err)
 					continue
 				}
 				prommonitor.Resources.Reset()
+				prommonitor.CacheObjects.Reset()
+				prommonitor.CacheBytes.Reset()
+				prommonitor.CacheMode.Reset()
 				_ = w.Stop()
 				w = rw
-				ser.ResetStore(rs, clis) // reset store
+				ser.ResetStore(rs, clis, configs) // reset store
 				prommonitor.ConfigReload.WithLabelValues("success").Inc()
 				log.Infof("auto reloaded config successfully")
 			}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// dump downloads the dump of the cache from ckube, which can be served by `cacheproxy -dump` offline.
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	server := fs.String("server", "http://127.0.0.1:80", "address of ckube")
+	token := fs.String("token", "", "token of ckube")
+	output := fs.String("o", "ckube.dump.gz", "output file")
+	_ = fs.Parse(args)
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*server, "/")+"/custom/v1/cache/dump", nil)
+	if err != nil {
+		return err
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bs, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("dump error: %s: %s", resp.Status, bs)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = checkGzip(*output)
+	}
+	if err != nil {
+		_ = os.Remove(*output)
+		return err
+	}
+	fmt.Printf("dumped %d bytes to %s\n", n, *output)
+	return nil
+}
+
+// checkGzip reads the gzip stream of file to the end, the dump is incomplete if ckube fails in the middle of writing it.
+func checkGzip(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("dump is incomplete: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return fmt.Errorf("dump is incomplete: %v", err)
+	}
+	return gz.Close()
+}
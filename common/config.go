@@ -1,11 +1,63 @@
 package common
 
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
 type Proxy struct {
 	Group    string            `json:"group"`
 	Version  string            `json:"version"`
 	Resource string            `json:"resource"`
 	ListKind string            `json:"list_kind"`
 	Index    map[string]string `json:"index"`
+	// Searchable are the index keys maintained in full text index.
+	Searchable []string `json:"searchable,omitempty"`
+	// Namespaced and Verbs are filled from the discovery of api server if not set.
+	Namespaced *bool    `json:"namespaced,omitempty"`
+	Verbs      []string `json:"verbs,omitempty"`
+	// CRDSelector selects the CRDs to cache by labels, Group limits the group of them if set.
+	CRDSelector string `json:"crd_selector,omitempty"`
+	// Limit bounds the cached objects of the resource, it does not apply to patterns.
+	Limit CacheLimit `json:"limit,omitempty"`
+	// Clusters are the clusters serving a resource expanded from a pattern, the resource is only
+	// cached in them, empty means all clusters.
+	Clusters []string `json:"-"`
+}
+
+// ResourceAll in a proxy caches all resources in the group.
+const ResourceAll = "*"
+
+// DefaultIndex is the index of resources expanded from a pattern proxy without index.
+var DefaultIndex = map[string]string{
+	"namespace":  "{.metadata.namespace}",
+	"name":       "{.metadata.name}",
+	"labels":     "{.metadata.labels}",
+	"created_at": "{.metadata.creationTimestamp}",
+}
+
+// IsPattern reports whether the proxy is a pattern which is expanded to resources by the watcher.
+func (p Proxy) IsPattern() bool {
+	return p.Resource == ResourceAll || p.CRDSelector != ""
+}
+
+// ServedBy reports whether the resource of the proxy is cached in cluster.
+func (p Proxy) ServedBy(cluster string) bool {
+	if len(p.Clusters) == 0 {
+		return true
+	}
+	for _, c := range p.Clusters {
+		if c == cluster {
+			return true
+		}
+	}
+	return false
+}
+
+// Kind returns the kind of the resources of the proxy.
+func (p Proxy) Kind() string {
+	return strings.TrimSuffix(p.ListKind, "List")
 }
 
 //type Cluster struct {
@@ -15,28 +67,224 @@ type Proxy struct {
 type Config struct {
 	Proxies []Proxy `json:"proxies"`
 	//Clusters       map[string]Cluster `json:"clusters"`
-	DefaultCluster string `json:"default_cluster"`
-	Token          string `json:"token"`
+	DefaultCluster string   `json:"default_cluster"`
+	Token          string   `json:"token"`
+	Upstream       Upstream `json:"upstream"`
+	// FlowControl limits the concurrent requests served by ckube, it's disabled without priority levels.
+	FlowControl FlowControl `json:"flow_control"`
+	// CacheLimit bounds all cached objects.
+	CacheLimit CacheLimit `json:"cache_limit"`
+}
+
+const (
+	// LimitPolicyRefuse refuses the resources which start caching after the global limit is exceeded,
+	// or the resource itself for the limit of a resource, the refused resources are passed to api servers.
+	LimitPolicyRefuse = "refuse"
+	// LimitPolicyMetadataOnly caches only the metadata of the objects stored after the limit is exceeded.
+	LimitPolicyMetadataOnly = "metadata_only"
+	// LimitPolicyEvictOldest evicts the least recently updated objects of the resource,
+	// or of the largest resource for the global limit.
+	LimitPolicyEvictOldest = "evict_oldest"
+	// LimitPolicyPassthrough stops caching the resource, or the largest resource for the global limit,
+	// and passes its requests to api servers.
+	LimitPolicyPassthrough = "passthrough"
+)
+
+// CacheLimit bounds the number and the size of the cached objects, no limit if zero.
+type CacheLimit struct {
+	MaxObjects int64 `json:"max_objects,omitempty"`
+	// MaxBytes limits the size of objects, which is estimated by the size of their json.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	// Policy applies once the limit is exceeded, it's LimitPolicyRefuse if not set.
+	Policy string `json:"policy,omitempty"`
+}
+
+// Enabled reports whether any limit is set.
+func (l CacheLimit) Enabled() bool {
+	return l.MaxObjects > 0 || l.MaxBytes > 0
+}
+
+// Exceeded reports whether objects or bytes exceed the limit.
+func (l CacheLimit) Exceeded(objects, bytes int64) bool {
+	return (l.MaxObjects > 0 && objects > l.MaxObjects) || (l.MaxBytes > 0 && bytes > l.MaxBytes)
+}
+
+// WithDefaults returns the limit with the default policy.
+func (l CacheLimit) WithDefaults() CacheLimit {
+	if l.Policy == "" {
+		l.Policy = LimitPolicyRefuse
+	}
+	return l
+}
+
+// Validate checks the policy of the limit.
+func (l CacheLimit) Validate() error {
+	switch l.Policy {
+	case "", LimitPolicyRefuse, LimitPolicyMetadataOnly, LimitPolicyEvictOldest, LimitPolicyPassthrough:
+		return nil
+	}
+	return fmt.Errorf("unsupported cache limit policy %q", l.Policy)
+}
+
+// Upstream protects the api servers from the requests passed by ckube, the zero values are replaced by defaults.
+type Upstream struct {
+	// QPS and Burst limit the requests passed to the api server of each cluster.
+	QPS   float32 `json:"qps"`
+	Burst int     `json:"burst"`
+	// TimeoutSeconds is the timeout of the requests without timeout parameter.
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// Retries is the max retries of idempotent requests failed with 429 or 5xx, negative to disable.
+	Retries int `json:"retries"`
+	// BreakerFailures consecutive failures open the circuit breaker of the cluster for BreakerSeconds.
+	BreakerFailures int `json:"breaker_failures"`
+	BreakerSeconds  int `json:"breaker_seconds"`
+}
+
+// FlowControl classifies the requests to priority levels by flow schemas like API Priority and Fairness,
+// the requests matching no flow schema are not limited.
+type FlowControl struct {
+	PriorityLevels []PriorityLevel `json:"priority_levels"`
+	FlowSchemas    []FlowSchema    `json:"flow_schemas"`
+}
+
+// PriorityLevel limits the concurrent requests of the flow schemas referring to it.
+type PriorityLevel struct {
+	Name string `json:"name"`
+	// Concurrency is the max executing requests, no limit if it's 0.
+	Concurrency int `json:"concurrency"`
+	// QueueLength is the max waiting requests of each flow, the requests exceeding are rejected immediately.
+	QueueLength int `json:"queue_length"`
+	// QueueTimeoutSeconds is the max waiting time of the queued requests, 10 seconds if not set.
+	QueueTimeoutSeconds int `json:"queue_timeout_seconds"`
 }
 
-var cfg *Config
+// FlowSchema matches the requests which match all of its non-empty conditions, the first matched schema is used.
+type FlowSchema struct {
+	Name          string `json:"name"`
+	PriorityLevel string `json:"priority_level"`
+	// Users matches the user impersonated or in basic auth.
+	Users []string `json:"users,omitempty"`
+	// Tokens matches the bearer token.
+	Tokens []string `json:"tokens,omitempty"`
+	// Paths matches the prefix of request path.
+	Paths []string `json:"paths,omitempty"`
+	// Resources matches the resource (pods), resource with group (deployments.apps) or `*`.
+	Resources []string `json:"resources,omitempty"`
+	// Distinguisher distinguishes the flows of the schema by `user` or `token` to be queued fairly.
+	Distinguisher string `json:"distinguisher,omitempty"`
+}
+
+// WithDefaults returns the upstream with the zero values replaced by defaults.
+func (u Upstream) WithDefaults() Upstream {
+	if u.QPS == 0 {
+		u.QPS = 100
+	}
+	if u.Burst == 0 {
+		u.Burst = 200
+	}
+	if u.TimeoutSeconds == 0 {
+		u.TimeoutSeconds = 60
+	}
+	if u.Retries == 0 {
+		u.Retries = 3
+	}
+	if u.BreakerFailures == 0 {
+		u.BreakerFailures = 5
+	}
+	if u.BreakerSeconds == 0 {
+		u.BreakerSeconds = 30
+	}
+	return u
+}
+
+var (
+	cfg     *Config
+	cfgLock sync.RWMutex
+)
 
 func InitConfig(c *Config) {
 	if c.DefaultCluster == "" {
 		c.DefaultCluster = "default"
 	}
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
 	cfg = c
 }
 
 func GetConfig() Config {
+	cfgLock.RLock()
+	defer cfgLock.RUnlock()
 	return *cfg
 }
 
-func GetGVRKind(g, v, r string) string {
+// AddProxy adds a proxy expanded from a pattern, it returns false if the resource is already configured.
+func AddProxy(p Proxy) bool {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	for _, e := range cfg.Proxies {
+		if e.Group == p.Group && e.Version == p.Version && e.Resource == p.Resource {
+			return false
+		}
+	}
+	// copy on write, the proxies got before are not changed
+	proxies := make([]Proxy, 0, len(cfg.Proxies)+1)
+	proxies = append(proxies, cfg.Proxies...)
+	cfg.Proxies = append(proxies, p)
+	return true
+}
+
+// SetProxyClusters sets the clusters serving the resource expanded from a pattern.
+func SetProxyClusters(g, v, r string, clusters []string) {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	proxies := make([]Proxy, 0, len(cfg.Proxies))
+	for _, p := range cfg.Proxies {
+		if p.Group == g && p.Version == v && p.Resource == r {
+			p.Clusters = clusters
+		}
+		proxies = append(proxies, p)
+	}
+	cfg.Proxies = proxies
+}
+
+// RemoveProxy removes the proxy of a resource expanded from a pattern when no cluster serves it,
+// it returns false if the resource is not configured.
+func RemoveProxy(g, v, r string) bool {
+	cfgLock.Lock()
+	defer cfgLock.Unlock()
+	proxies := make([]Proxy, 0, len(cfg.Proxies))
 	for _, p := range cfg.Proxies {
+		if p.Group != g || p.Version != v || p.Resource != r {
+			proxies = append(proxies, p)
+		}
+	}
+	removed := len(proxies) != len(cfg.Proxies)
+	cfg.Proxies = proxies
+	return removed
+}
+
+// GetProxy finds the configured proxy of the group, version and resource.
+func GetProxy(g, v, r string) (Proxy, bool) {
+	for _, p := range GetConfig().Proxies {
 		if p.Group == g && p.Version == v && p.Resource == r {
-			return p.ListKind
+			return p, true
+		}
+	}
+	return Proxy{}, false
+}
+
+func GetGVRKind(g, v, r string) string {
+	p, _ := GetProxy(g, v, r)
+	return p.ListKind
+}
+
+// FindProxy finds the configured proxy by resource name (pods), resource with group
+// (deployments.apps) or kind (Deployment).
+func FindProxy(s string) (Proxy, bool) {
+	for _, p := range GetConfig().Proxies {
+		if p.Resource == s || p.Resource+"."+p.Group == s || strings.EqualFold(p.Kind(), s) {
+			return p, true
 		}
 	}
-	return ""
+	return Proxy{}, false
 }
@@ -1,29 +1,51 @@
 package constants
 
 const (
-	PaginateKey          = "ckube.daocloud.io/query"
-	AdvancedSearchPrefix = "__ckube_as__:"
-	SortASC              = "asc"
-	SortDesc             = "desc"
-	KeyTypeSep           = "!"
-	KeyTypeInt           = "int"
-	KeyTypeStr           = "str"
-	SearchPartsSep       = ';'
-	DSMClusterAnno       = "ckube.doacloud.io/cluster"
-	ClusterPrefix        = "dsm-cluster-"
-	IndexAnno            = "ckube.daocloud.io/indexes"
+	PaginateKey              = "ckube.daocloud.io/query"
+	AdvancedSearchPrefix     = "__ckube_as__:"
+	RelationSearchPrefix     = "__ckube_rel__:"
+	FullTextSearchPrefix     = "__ckube_fts__:"
+	SortScore                = "_score"
+	SortASC                  = "asc"
+	SortDesc                 = "desc"
+	SortNulls                = "nulls"
+	SortNullsFirst           = "first"
+	SortNullsLast            = "last"
+	KeyTypeSep               = "!"
+	KeyTypeInt               = "int"
+	KeyTypeStr               = "str"
+	KeyTypeTime              = "time"
+	SearchPartsSep           = ';'
+	DSMClusterAnno           = "ckube.doacloud.io/cluster"
+	ClusterPrefix            = "dsm-cluster-"
+	IndexAnno                = "ckube.daocloud.io/indexes"
+	HighlightAnno            = "ckube.daocloud.io/highlights"
+	MetadataOnlyAnno         = "ckube.daocloud.io/metadata-only"
+	MinResourceVersion       = "minResourceVersion"
+	MinResourceVersionHeader = "X-Ckube-Min-Resource-Version"
 )
 
 var (
 	_ = PaginateKey
 	_ = AdvancedSearchPrefix
+	_ = RelationSearchPrefix
+	_ = FullTextSearchPrefix
+	_ = SortScore
 	_ = SortASC
 	_ = SortDesc
+	_ = SortNulls
+	_ = SortNullsFirst
+	_ = SortNullsLast
 	_ = KeyTypeSep
 	_ = KeyTypeInt
 	_ = KeyTypeStr
+	_ = KeyTypeTime
 	_ = SearchPartsSep
 	_ = DSMClusterAnno
 	_ = ClusterPrefix
 	_ = IndexAnno
+	_ = HighlightAnno
+	_ = MetadataOnlyAnno
+	_ = MinResourceVersion
+	_ = MinResourceVersionHeader
 )
@@ -4,7 +4,10 @@ go 1.19
 
 require (
 	github.com/fsnotify/fsnotify v1.4.9
+	github.com/golang/protobuf v1.4.3
+	github.com/googleapis/gnostic v0.5.1
 	github.com/gorilla/mux v1.8.0
+	github.com/klauspost/compress v1.15.15
 	github.com/prometheus/client_golang v1.7.1
 	github.com/samber/lo v1.27.0
 	github.com/sirupsen/logrus v1.8.1
@@ -22,15 +25,14 @@ require (
 	github.com/evanphx/json-patch v4.9.0+incompatible // indirect
 	github.com/go-logr/logr v0.4.0 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
-	github.com/golang/protobuf v1.4.3 // indirect
 	github.com/google/go-cmp v0.5.2 // indirect
 	github.com/google/gofuzz v1.2.0 // indirect
-	github.com/googleapis/gnostic v0.5.1 // indirect
 	github.com/imdario/mergo v0.3.5 // indirect
 	github.com/json-iterator/go v1.1.10 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.1 // indirect
+	github.com/mxk/go-flowrate v0.0.0-20140419014527-cca7078d478f // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/prometheus/client_model v0.2.0 // indirect
@@ -0,0 +1,153 @@
+package kube
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/log"
+)
+
+// cachingVerbs are the verbs required to cache a resource.
+var cachingVerbs = []string{"list", "watch"}
+
+func findResource(list *v1.APIResourceList, resource string) (v1.APIResource, bool) {
+	for _, r := range list.APIResources {
+		if r.Name == resource {
+			return r, true
+		}
+	}
+	return v1.APIResource{}, false
+}
+
+func hasVerb(verbs []string, verb string) bool {
+	for _, v := range verbs {
+		if v == verb {
+			return true
+		}
+	}
+	return false
+}
+
+// DiscoverProxies fills list kind, namespaced and verbs of the proxies from the discovery of clusters,
+// and validates that the proxies can be cached. The configured values take precedence over discovery,
+// a proxy not served by a cluster is only warned unless its kind can not be known.
+func DiscoverProxies(clients map[string]kubernetes.Interface, proxies []common.Proxy) ([]common.Proxy, error) {
+	clusters := make([]string, 0, len(clients))
+	for c := range clients {
+		clusters = append(clusters, c)
+	}
+	sort.Strings(clusters)
+	// cluster - group version - resources, nil if the discovery failed
+	lists := map[string]map[string]*v1.APIResourceList{}
+	res := make([]common.Proxy, 0, len(proxies))
+	for _, p := range proxies {
+		if p.IsPattern() {
+			// expanded by the watcher
+			res = append(res, p)
+			continue
+		}
+		gv := schema.GroupVersion{Group: p.Group, Version: p.Version}.String()
+		discovered := false
+		for _, c := range clusters {
+			if lists[c] == nil {
+				lists[c] = map[string]*v1.APIResourceList{}
+			}
+			list, ok := lists[c][gv]
+			if !ok {
+				var err error
+				list, err = clients[c].Discovery().ServerResourcesForGroupVersion(gv)
+				if err != nil {
+					log.Warnf("cluster(%s): discovery resources of %s error: %v", c, gv, err)
+					list = nil
+				}
+				lists[c][gv] = list
+			}
+			if list == nil {
+				continue
+			}
+			r, ok := findResource(list, p.Resource)
+			if !ok {
+				log.Warnf("cluster(%s): resource %s is not served in %s", c, p.Resource, gv)
+				continue
+			}
+			for _, verb := range cachingVerbs {
+				if !hasVerb(r.Verbs, verb) {
+					return nil, fmt.Errorf("cluster(%s): resource %s of %s does not support %s", c, p.Resource, gv, verb)
+				}
+			}
+			if discovered {
+				continue
+			}
+			discovered = true
+			if listKind := r.Kind + "List"; p.ListKind == "" {
+				p.ListKind = listKind
+			} else if p.ListKind != listKind {
+				log.Warnf("cluster(%s): list kind of %s in %s is %s, but %s configured", c, p.Resource, gv, listKind, p.ListKind)
+			}
+			if p.Namespaced == nil {
+				namespaced := r.Namespaced
+				p.Namespaced = &namespaced
+			}
+			if len(p.Verbs) == 0 {
+				p.Verbs = r.Verbs
+			}
+		}
+		if p.ListKind == "" {
+			return nil, fmt.Errorf("can not discover the kind of resource %s in %s, please set list_kind", p.Resource, gv)
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+// scopeMissTTL is how long an unknown scope is cached, so that a degraded api server
+// is not asked again by every request of the resource.
+const scopeMissTTL = 30 * time.Second
+
+type scopeKey struct {
+	cluster  string
+	gv       string
+	resource string
+}
+
+type scope struct {
+	namespaced bool
+	ok         bool
+	// expire is zero for the known scopes, which are never changed
+	expire time.Time
+}
+
+// scopes caches the scopes of resources, scopeKey - scope.
+var scopes sync.Map
+
+// ResourceScope reports whether resource of gv is namespaced in cluster according to the discovery,
+// ok is false if the resource is not served or the discovery failed. The scopes of all resources of gv
+// are cached from one discovery, the unknown scopes are cached for scopeMissTTL.
+func ResourceScope(client kubernetes.Interface, cluster string, gv schema.GroupVersion, resource string) (namespaced bool, ok bool) {
+	key := scopeKey{cluster: cluster, gv: gv.String(), resource: resource}
+	if v, ok := scopes.Load(key); ok {
+		if s := v.(scope); s.expire.IsZero() || time.Now().Before(s.expire) {
+			return s.namespaced, s.ok
+		}
+	}
+	list, err := client.Discovery().ServerResourcesForGroupVersion(key.gv)
+	if err != nil {
+		log.Warnf("cluster(%s): discovery resources of %s error: %v", cluster, key.gv, err)
+	} else {
+		for _, r := range list.APIResources {
+			scopes.Store(scopeKey{cluster: cluster, gv: key.gv, resource: r.Name}, scope{namespaced: r.Namespaced, ok: true})
+		}
+		if r, ok := findResource(list, resource); ok {
+			return r.Namespaced, true
+		}
+	}
+	scopes.Store(key, scope{expire: time.Now().Add(scopeMissTTL)})
+	return false, false
+}
@@ -0,0 +1,135 @@
+package kube
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/DaoCloud/ckube/common"
+)
+
+func fakeClient(lists ...*v1.APIResourceList) kubernetes.Interface {
+	c := fake.NewSimpleClientset()
+	c.Resources = lists
+	return c
+}
+
+func TestDiscoverProxies(t *testing.T) {
+	verbs := v1.Verbs{"get", "list", "watch"}
+	core := &v1.APIResourceList{
+		GroupVersion: "v1",
+		APIResources: []v1.APIResource{
+			{Name: "pods", Kind: "Pod", Namespaced: true, Verbs: verbs},
+			{Name: "nodes", Kind: "Node", Verbs: verbs},
+			{Name: "bindings", Kind: "Binding", Namespaced: true, Verbs: v1.Verbs{"create"}},
+		},
+	}
+	apps := &v1.APIResourceList{
+		GroupVersion: "apps/v1",
+		APIResources: []v1.APIResource{
+			{Name: "deployments", Kind: "Deployment", Namespaced: true, Verbs: verbs},
+		},
+	}
+	yes, no := true, false
+	cases := []struct {
+		name    string
+		clients map[string]kubernetes.Interface
+		proxies []common.Proxy
+		expect  []common.Proxy
+		err     error
+	}{
+		{
+			name:    "fill from discovery",
+			clients: map[string]kubernetes.Interface{"c1": fakeClient(core), "c2": fakeClient(core, apps)},
+			proxies: []common.Proxy{
+				{Version: "v1", Resource: "pods"},
+				{Version: "v1", Resource: "nodes"},
+				{Group: "apps", Version: "v1", Resource: "deployments"},
+			},
+			expect: []common.Proxy{
+				{Version: "v1", Resource: "pods", ListKind: "PodList", Namespaced: &yes, Verbs: verbs},
+				{Version: "v1", Resource: "nodes", ListKind: "NodeList", Namespaced: &no, Verbs: verbs},
+				{Group: "apps", Version: "v1", Resource: "deployments", ListKind: "DeploymentList", Namespaced: &yes, Verbs: verbs},
+			},
+		},
+		{
+			name:    "configured values take precedence",
+			clients: map[string]kubernetes.Interface{"c1": fakeClient(core)},
+			proxies: []common.Proxy{
+				{Version: "v1", Resource: "pods", ListKind: "MyPodList", Namespaced: &no, Verbs: []string{"list"}},
+			},
+			expect: []common.Proxy{
+				{Version: "v1", Resource: "pods", ListKind: "MyPodList", Namespaced: &no, Verbs: []string{"list"}},
+			},
+		},
+		{
+			name:    "not served but configured",
+			clients: map[string]kubernetes.Interface{"c1": fakeClient(core)},
+			proxies: []common.Proxy{
+				{Group: "apps", Version: "v1", Resource: "deployments", ListKind: "DeploymentList"},
+			},
+			expect: []common.Proxy{
+				{Group: "apps", Version: "v1", Resource: "deployments", ListKind: "DeploymentList"},
+			},
+		},
+		{
+			name:    "unknown kind",
+			clients: map[string]kubernetes.Interface{"c1": fakeClient(core)},
+			proxies: []common.Proxy{
+				{Group: "apps", Version: "v1", Resource: "deployments"},
+			},
+			err: fmt.Errorf("can not discover the kind of resource deployments in apps/v1, please set list_kind"),
+		},
+		{
+			name:    "can not watch",
+			clients: map[string]kubernetes.Interface{"c1": fakeClient(core)},
+			proxies: []common.Proxy{
+				{Version: "v1", Resource: "bindings"},
+			},
+			err: fmt.Errorf("cluster(c1): resource bindings of v1 does not support list"),
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			res, err := DiscoverProxies(c.clients, c.proxies)
+			assert.Equal(t, c.err, err)
+			assert.Equal(t, c.expect, res)
+		})
+	}
+}
+
+func TestResourceScope(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	c.Resources = []*v1.APIResourceList{{
+		GroupVersion: "v1",
+		APIResources: []v1.APIResource{
+			{Name: "pods", Namespaced: true},
+			{Name: "nodes"},
+		},
+	}}
+	gv := schema.GroupVersion{Version: "v1"}
+	namespaced, ok := ResourceScope(c, "scope", gv, "pods")
+	assert.True(t, ok)
+	assert.True(t, namespaced)
+	// the scopes of the group version are cached from one discovery
+	namespaced, ok = ResourceScope(c, "scope", gv, "nodes")
+	assert.True(t, ok)
+	assert.False(t, namespaced)
+	assert.Len(t, c.Actions(), 1)
+
+	// unknown scopes are cached too
+	_, ok = ResourceScope(c, "scope", gv, "unknown")
+	assert.False(t, ok)
+	_, ok = ResourceScope(c, "scope", gv, "unknown")
+	assert.False(t, ok)
+	_, ok = ResourceScope(c, "scope", schema.GroupVersion{Group: "apps", Version: "v1"}, "deployments")
+	assert.False(t, ok)
+	_, ok = ResourceScope(c, "scope", schema.GroupVersion{Group: "apps", Version: "v1"}, "deployments")
+	assert.False(t, ok)
+	assert.Len(t, c.Actions(), 3)
+}
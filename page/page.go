@@ -4,14 +4,17 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"reflect"
+	"net/url"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/DaoCloud/ckube/common/constants"
 	"github.com/DaoCloud/ckube/kube"
+	"k8s.io/apimachinery/pkg/api/meta"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 type Paginate struct {
@@ -20,6 +23,9 @@ type Paginate struct {
 	Total    int64  `json:"total,omitempty" form:"total" `
 	Sort     string `json:"sort,omitempty" form:"sort"`
 	Search   string `json:"search,omitempty" form:"search"`
+	// Snapshot is the id of the snapshot returned with the first page, the following pages
+	// with it are read from the same snapshot until it expires.
+	Snapshot string `json:"snapshot,omitempty" form:"snapshot"`
 }
 
 func (p *Paginate) Match(m map[string]string) (bool, error) {
@@ -83,6 +89,11 @@ func Match(m map[string]string, searchParts []string) (bool, error) {
 	if search == "" {
 		return true, nil
 	}
+	if strings.HasPrefix(search, constants.RelationSearchPrefix) ||
+		strings.HasPrefix(search, constants.FullTextSearchPrefix) {
+		// relation search and full text search are evaluated by the store.
+		return true, nil
+	}
 	if strings.HasPrefix(search, constants.AdvancedSearchPrefix) {
 		if len(search) == len(constants.AdvancedSearchPrefix) {
 			return false, fmt.Errorf("search format error")
@@ -138,6 +149,72 @@ func Match(m map[string]string, searchParts []string) (bool, error) {
 	return reverse, nil
 }
 
+// FullTextTerms returns the lower case terms of full text search parts, e.g. `__ckube_fts__:nginx web`.
+func (p *Paginate) FullTextTerms() []string {
+	terms := []string{}
+	for _, part := range p.SearchParts() {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, constants.FullTextSearchPrefix) {
+			continue
+		}
+		terms = append(terms, strings.FieldsFunc(strings.ToLower(part[len(constants.FullTextSearchPrefix):]), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})...)
+	}
+	return terms
+}
+
+// RelationSelectors parses the relation search parts, e.g. `__ckube_rel__:owner.kind=Deployment,owner.name=web`,
+// to selectors of related objects grouped by relation (the part of key before the first `.`).
+func (p *Paginate) RelationSelectors() (map[string]labels.Selector, error) {
+	groups := map[string]*v1.LabelSelector{}
+	group := func(key string) (*v1.LabelSelector, string, error) {
+		i := strings.Index(key, ".")
+		if i <= 0 || i == len(key)-1 {
+			return nil, "", fmt.Errorf("relation search key %q format error, expect <relation>.<key>", key)
+		}
+		rel := key[:i]
+		if _, ok := groups[rel]; !ok {
+			groups[rel] = &v1.LabelSelector{MatchLabels: map[string]string{}}
+		}
+		return groups[rel], key[i+1:], nil
+	}
+	for _, part := range p.SearchParts() {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, constants.RelationSearchPrefix) {
+			continue
+		}
+		s, err := kube.ParseToLabelSelector(part[len(constants.RelationSearchPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range s.MatchLabels {
+			g, key, err := group(k)
+			if err != nil {
+				return nil, err
+			}
+			g.MatchLabels[key] = v
+		}
+		for _, r := range s.MatchExpressions {
+			g, key, err := group(r.Key)
+			if err != nil {
+				return nil, err
+			}
+			r.Key = key
+			g.MatchExpressions = append(g.MatchExpressions, r)
+		}
+	}
+	res := map[string]labels.Selector{}
+	for rel, g := range groups {
+		s, err := v1.LabelSelectorAsSelector(g)
+		if err != nil {
+			return nil, err
+		}
+		res[rel] = s
+	}
+	return res, nil
+}
+
 func (p *Paginate) SearchSelector() (*v1.LabelSelector, error) {
 	s := v1.LabelSelector{}
 	parts := p.SearchParts()
@@ -293,12 +370,29 @@ func QueryDeleteOptions(options v1.DeleteOptions, cluster string) (v1.DeleteOpti
 	return options, nil
 }
 
-func QueryListOptions(options v1.ListOptions, page Paginate) (v1.ListOptions, error) {
+func encodePaginate(page Paginate) string {
 	bs, _ := json.Marshal(page)
 	if string(bs) == "{}" {
+		return ""
+	}
+	return base64.StdEncoding.WithPadding(base64.NoPadding).EncodeToString(bs)
+}
+
+func decodePaginate(s string) (Paginate, error) {
+	p := Paginate{}
+	bs, err := base64.StdEncoding.WithPadding(base64.NoPadding).DecodeString(s)
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal(bs, &p)
+	return p, err
+}
+
+func QueryListOptions(options v1.ListOptions, page Paginate) (v1.ListOptions, error) {
+	s := encodePaginate(page)
+	if s == "" {
 		return options, nil
 	}
-	s := base64.StdEncoding.WithPadding(base64.NoPadding).EncodeToString(bs)
 	//if options.LabelSelector == "" {
 	//	options.LabelSelector = fmt.Sprintf("%s notin (%s)", common.PaginateKey, s)
 	//	return options
@@ -326,25 +420,57 @@ func QueryListOptions(options v1.ListOptions, page Paginate) (v1.ListOptions, er
 	return options, nil
 }
 
+// ResSelfLink builds the selfLink of a list response served by ckube,
+// the paginate actually applied (with total) is carried in the query of the link.
+func ResSelfLink(path string, page Paginate) string {
+	s := encodePaginate(page)
+	if s == "" {
+		return path
+	}
+	return path + "?" + url.Values{constants.PaginateKey: []string{s}}.Encode()
+}
+
+// ResPaginate reads the paginate returned by ckube from a list response.
+// ok is false if the list was not served by ckube.
+func ResPaginate(l v1.ListInterface) (Paginate, bool) {
+	u, err := url.Parse(l.GetSelfLink())
+	if err != nil {
+		return Paginate{}, false
+	}
+	s := u.Query().Get(constants.PaginateKey)
+	if s == "" {
+		return Paginate{}, false
+	}
+	p, err := decodePaginate(s)
+	if err != nil {
+		return Paginate{}, false
+	}
+	return p, true
+}
+
 func MakeupResPaginate(l v1.ListInterface, page Paginate) Paginate {
+	if p, ok := ResPaginate(l); ok {
+		page.Page = p.Page
+		page.PageSize = p.PageSize
+		page.Sort = p.Sort
+		page.Total = p.Total
+		page.Snapshot = p.Snapshot
+		return page
+	}
+	// response not served by ckube, derive total from remainingItemCount.
 	remain := l.GetRemainingItemCount()
-	val := reflect.ValueOf(l).Elem()
 	items := 0
-	for i := 0; i < val.NumField(); i++ {
-		valueField := val.Field(i)
-		typeField := val.Type().Field(i)
-
-		f := valueField.Interface()
-		val := reflect.ValueOf(f)
-		if typeField.Name == "Items" {
-			items = val.Len()
-		}
+	if o, ok := l.(runtime.Object); ok {
+		items = meta.LenList(o)
 	}
 	if remain == nil {
 		var i int64 = 0
 		remain = &i
 	}
-	page.Total = *remain + (page.Page-1)*page.PageSize + int64(items)
+	page.Total = *remain + int64(items)
+	if page.Page > 1 {
+		page.Total += (page.Page - 1) * page.PageSize
+	}
 	return page
 }
 
@@ -366,3 +366,101 @@ func TestGetObjectCluster(t *testing.T) {
 		})
 	}
 }
+
+func TestMakeupResPaginate(t *testing.T) {
+	var remain int64 = 3
+	cases := []struct {
+		name   string
+		list   v1.ListInterface
+		page   Paginate
+		expect Paginate
+	}{
+		{
+			name: "served by ckube",
+			list: &v12.PodList{
+				ListMeta: v1.ListMeta{
+					SelfLink: ResSelfLink("/api/v1/pods", Paginate{
+						Page:     5,
+						PageSize: 10,
+						Total:    12,
+						Sort:     "name",
+					}),
+				},
+			},
+			page: Paginate{
+				Page:     5,
+				PageSize: 10,
+				Search:   "name=test",
+			},
+			expect: Paginate{
+				Page:     5,
+				PageSize: 10,
+				Total:    12,
+				Sort:     "name",
+				Search:   "name=test",
+			},
+		},
+		{
+			name: "remaining item count",
+			list: &v12.PodList{
+				ListMeta: v1.ListMeta{
+					SelfLink:           "/api/v1/pods",
+					RemainingItemCount: &remain,
+				},
+				Items: []v12.Pod{{}, {}},
+			},
+			page: Paginate{
+				Page:     2,
+				PageSize: 2,
+			},
+			expect: Paginate{
+				Page:     2,
+				PageSize: 2,
+				Total:    7,
+			},
+		},
+		{
+			name: "no page",
+			list: &v12.PodList{
+				Items: []v12.Pod{{}, {}},
+			},
+			expect: Paginate{
+				Total: 2,
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expect, MakeupResPaginate(c.list, c.page))
+		})
+	}
+}
+
+func TestPaginate_RelationSelectors(t *testing.T) {
+	p := Paginate{
+		Search: "name=test; __ckube_rel__:owner.kind=Deployment,owner.name=web; __ckube_rel__:node.labels.zone in (a, b)",
+	}
+	rels, err := p.RelationSelectors()
+	assert.NoError(t, err)
+	assert.Len(t, rels, 2)
+	assert.Equal(t, "kind=Deployment,name=web", rels["owner"].String())
+	assert.Equal(t, "labels.zone in (a,b)", rels["node"].String())
+	match, err := p.Match(map[string]string{"name": "test"})
+	assert.NoError(t, err)
+	assert.True(t, match)
+
+	p = Paginate{
+		Search: "__ckube_rel__:owner=web",
+	}
+	_, err = p.RelationSelectors()
+	assert.Error(t, err)
+}
+
+func TestPaginate_FullTextTerms(t *testing.T) {
+	p := Paginate{Search: "__ckube_fts__:Nginx 1.21; name=web; __ckube_fts__:redis"}
+	assert.Equal(t, []string{"nginx", "1", "21", "redis"}, p.FullTextTerms())
+	ok, err := p.Match(map[string]string{"name": "web"})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Empty(t, (&Paginate{Search: "name=web"}).FullTextTerms())
+}
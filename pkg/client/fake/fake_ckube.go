@@ -27,6 +27,9 @@ import (
 	"github.com/DaoCloud/ckube/watcher"
 )
 
+// fakeVerbs are the verbs of the resources in the discovery of the fake server.
+var fakeVerbs = []string{"create", "delete", "get", "list", "update", "watch"}
+
 type fakeCkubeServer struct {
 	store         store.Store
 	ser           server.Server
@@ -43,16 +46,29 @@ func NewFakeCKubeServer(listenAddr string, config string) (CkubeServer, error) {
 		return nil, err
 	}
 	cfg.Token = ""
+	for i := range cfg.Proxies {
+		// the discovery of the fake server is built from the config, and it serves writes
+		if len(cfg.Proxies[i].Verbs) == 0 {
+			cfg.Proxies[i].Verbs = fakeVerbs
+		}
+	}
 	common.InitConfig(&cfg)
 	indexConf := map[store.GroupVersionResource]map[string]string{}
+	searchable := map[store.GroupVersionResource][]string{}
 	for _, proxy := range cfg.Proxies {
-		indexConf[store.GroupVersionResource{
+		if proxy.IsPattern() {
+			// patterns are not expanded in fake server
+			continue
+		}
+		gvr := store.GroupVersionResource{
 			Group:    proxy.Group,
 			Version:  proxy.Version,
 			Resource: proxy.Resource,
-		}] = proxy.Index
+		}
+		indexConf[gvr] = proxy.Index
+		searchable[gvr] = proxy.Searchable
 	}
-	m := memory.NewMemoryStore(indexConf)
+	m := memory.NewMemoryStore(indexConf, memory.WithSearchable(searchable))
 	addr := "http://" + func() string {
 		parts := strings.Split(listenAddr, ":")
 		if parts[0] == "" {
@@ -68,7 +84,7 @@ func NewFakeCKubeServer(listenAddr string, config string) (CkubeServer, error) {
 		},
 		watchChanMap: make(map[string]chan Event),
 	}
-	ser := server.NewMuxServer(listenAddr, nil, m, s.registerFakeRoute)
+	ser := server.NewMuxServer(listenAddr, nil, nil, m, s.registerFakeRoute)
 	s.ser = ser
 	go ser.Run() // nolint: errcheck
 	for i := 0; i < 5; i++ {
@@ -95,15 +111,22 @@ func (s *fakeCkubeServer) Stop() {
 
 func (s *fakeCkubeServer) Clean() {
 	indexConf := map[store.GroupVersionResource]map[string]string{}
+	searchable := map[store.GroupVersionResource][]string{}
 	for _, proxy := range common.GetConfig().Proxies {
-		indexConf[store.GroupVersionResource{
+		if proxy.IsPattern() {
+			// patterns are not expanded in fake server
+			continue
+		}
+		gvr := store.GroupVersionResource{
 			Group:    proxy.Group,
 			Version:  proxy.Version,
 			Resource: proxy.Resource,
-		}] = proxy.Index
+		}
+		indexConf[gvr] = proxy.Index
+		searchable[gvr] = proxy.Searchable
 	}
-	m := memory.NewMemoryStore(indexConf)
-	s.ser.ResetStore(m, nil)
+	m := memory.NewMemoryStore(indexConf, memory.WithSearchable(searchable))
+	s.ser.ResetStore(m, nil, nil)
 	s.store = m
 }
 
@@ -148,11 +171,6 @@ func (s *fakeCkubeServer) registerFakeRoute(r *mux.Router) {
 	} {
 		r.Path(p).Methods("GET").HandlerFunc(s.watch)
 	}
-	r.Path("/version").Methods("GET").HandlerFunc(version)
-	r.Path("/api").Methods("GET").HandlerFunc(api)
-	r.Path("/apis").Methods("GET").HandlerFunc(apis)
-	r.Path("/apis/{group}/{version}").Methods("GET").HandlerFunc(resources)
-	r.Path("/api/{version}").Methods("GET").HandlerFunc(resources)
 }
 
 func jsonResp(writer http.ResponseWriter, status int, v interface{}) {
@@ -174,88 +192,6 @@ func (w *wh) ServeHTTP(writer http.ResponseWriter, r *http.Request) {
 	w.s.watch(writer, r)
 }
 
-func resources(writer http.ResponseWriter, r *http.Request) {
-	group := mux.Vars(r)["group"]
-	version := mux.Vars(r)["version"]
-	res := metav1.APIResourceList{}
-	if group == "" {
-		res.GroupVersion = version
-	} else {
-		res.GroupVersion = fmt.Sprintf("%s/%s", group, version)
-	}
-	for _, p := range common.GetConfig().Proxies {
-		res.APIResources = append(res.APIResources, metav1.APIResource{
-			Name:         p.Resource,
-			SingularName: "",
-			Namespaced:   true,
-			Group:        group,
-			Version:      version,
-			Kind:         strings.TrimSuffix(p.ListKind, "List"),
-			Verbs: metav1.Verbs{
-				"create",
-				"delete",
-				"deletecollection",
-				"get",
-				"list",
-				"patch",
-				"update",
-				"watch",
-			},
-		})
-	}
-	jsonResp(writer, 200, res)
-}
-
-func api(writer http.ResponseWriter, r *http.Request) {
-	a := metav1.APIVersions{
-		Versions: []string{"v1"},
-	}
-	jsonResp(writer, 200, a)
-}
-
-func apis(writer http.ResponseWriter, r *http.Request) {
-	a := metav1.APIGroupList{}
-
-	for _, p := range common.GetConfig().Proxies {
-		find := false
-		for _, g := range a.Groups {
-			if g.Name == p.Group {
-				g.Versions = append(g.Versions, metav1.GroupVersionForDiscovery{
-					GroupVersion: fmt.Sprintf("%s/%s", p.Group, p.Version),
-					Version:      p.Version,
-				})
-				find = true
-				break
-			}
-		}
-		if !find {
-			a.Groups = append(a.Groups, metav1.APIGroup{
-				Name:                       p.Group,
-				Versions:                   nil,
-				PreferredVersion:           metav1.GroupVersionForDiscovery{},
-				ServerAddressByClientCIDRs: nil,
-			})
-		}
-	}
-	jsonResp(writer, 200, a)
-}
-
-func version(writer http.ResponseWriter, r *http.Request) {
-	// todo fixme
-	v := map[string]string{
-		"major":        "1",
-		"minor":        "23",
-		"gitVersion":   "v1.23.5",
-		"gitCommit":    "c285e781331a3785a7f436042c65c5641ce8a9e9",
-		"gitTreeState": "clean",
-		"buildDate":    "2022-03-16T15:52:18Z",
-		"goVersion":    "go1.17.8",
-		"compiler":     "gc",
-		"platform":     "linux/amd64",
-	}
-	jsonResp(writer, 200, v)
-}
-
 func (s *fakeCkubeServer) watch(writer http.ResponseWriter, r *http.Request) {
 	group := mux.Vars(r)["group"]
 	version := mux.Vars(r)["version"]
@@ -8,7 +8,9 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 
@@ -42,6 +44,26 @@ func TestNewFakeCKubeServer(t *testing.T) {
         "labels": "{.metadata.labels}",
         "created_at": "{.metadata.creationTimestamp}"
       }
+    },
+    {
+      "group": "apps",
+      "version": "v1",
+      "resource": "deployments",
+      "list_kind": "DeploymentList",
+      "index": {
+        "namespace": "{.metadata.namespace}",
+        "name": "{.metadata.name}"
+      }
+    },
+    {
+      "group": "apps",
+      "version": "v1",
+      "resource": "replicasets",
+      "list_kind": "ReplicaSetList",
+      "index": {
+        "namespace": "{.metadata.namespace}",
+        "name": "{.metadata.name}"
+      }
     }
   ]
 }
@@ -84,7 +106,7 @@ func TestNewFakeCKubeServer(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, v1.DNSPolicy("ClusterFirst"), p1.Spec.DNSPolicy)
 		_, err = cli.CoreV1().Pods("test").Get(context.Background(), "pod1", goptc2)
-		assert.Error(t, err)
+		assert.True(t, errors.IsNotFound(err))
 	})
 	t.Run("list pods", func(t *testing.T) {
 		p := page.Paginate{}
@@ -118,7 +140,7 @@ func TestNewFakeCKubeServer(t *testing.T) {
 		assert.NoError(t, err)
 		goptc1, _ := page.QueryGetOptions(metav1.GetOptions{}, "c1")
 		_, err = cli.CoreV1().Pods("test").Get(context.Background(), "pod1", goptc1)
-		assert.Error(t, err)
+		assert.True(t, errors.IsNotFound(err))
 	})
 
 	t.Run("events", func(t *testing.T) {
@@ -215,6 +237,26 @@ func TestNewFakeCKubeServer(t *testing.T) {
 		}, events)
 	})
 	t.Run("custom api", func(t *testing.T) {
+		_, err := cli.AppsV1().Deployments("test").Create(context.Background(), &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test",
+				Namespace: "test",
+			},
+		}, metav1.CreateOptions{})
+		assert.NoError(t, err)
+		_, err = cli.AppsV1().ReplicaSets("test").Create(context.Background(), &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "test-xxxx",
+				Namespace: "test",
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						Kind: "Deployment",
+						Name: "test",
+					},
+				},
+			},
+		}, metav1.CreateOptions{})
+		assert.NoError(t, err)
 		_, _ = cli.CoreV1().Pods("test").Create(context.Background(), &v1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "test-xxxx-asd",
@@ -263,4 +305,32 @@ func TestNewFakeCKubeServer(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Len(t, svcs, 1)
 	})
+	t.Run("related api", func(t *testing.T) {
+		bs, err := cli.Discovery().RESTClient().
+			Get().
+			RequestURI("/custom/v1/namespaces/test/services/test-svc/related?kind=pods").
+			DoRaw(context.Background())
+		assert.NoError(t, err)
+		pods := v1.PodList{}
+		err = json.Unmarshal(bs, &pods)
+		assert.NoError(t, err)
+		assert.Len(t, pods.Items, 1)
+		assert.Equal(t, "test-xxxx-asd", pods.Items[0].Name)
+	})
+	t.Run("discovery", func(t *testing.T) {
+		_, err := cli.Discovery().ServerVersion()
+		assert.NoError(t, err)
+		resources, err := cli.Discovery().ServerResourcesForGroupVersion("apps/v1")
+		assert.NoError(t, err)
+		if assert.Len(t, resources.APIResources, 2) {
+			assert.Equal(t, "deployments", resources.APIResources[0].Name)
+			assert.Equal(t, "Deployment", resources.APIResources[0].Kind)
+			assert.True(t, resources.APIResources[0].Namespaced)
+			assert.Contains(t, resources.APIResources[0].Verbs, "create")
+		}
+		groups, err := cli.Discovery().ServerGroups()
+		assert.NoError(t, err)
+		// the legacy group and apps
+		assert.Len(t, groups.Groups, 2)
+	})
 }
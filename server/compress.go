@@ -0,0 +1,180 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/DaoCloud/ckube/api"
+	"github.com/DaoCloud/ckube/log"
+)
+
+const (
+	// minCompressSize is the min size of the responses to be compressed, small responses are not worth it.
+	minCompressSize = 16 * 1024
+	// responseBufferSize is the size of the buffer between the encoder and the response writer,
+	// which avoids flushing the small writes of streaming encoders.
+	responseBufferSize = 32 * 1024
+)
+
+const (
+	encodingGzip = "gzip"
+	encodingZstd = "zstd"
+)
+
+var (
+	gzipWriters = sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	zstdEncoders = sync.Pool{New: func() interface{} {
+		e, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		return e
+	}}
+)
+
+// negotiateEncoding returns the content encoding accepted by the Accept-Encoding header,
+// zstd is preferred to gzip if their qvalues are the same, empty if none is accepted.
+func negotiateEncoding(acceptEncoding string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				v, err := strconv.ParseFloat(strings.TrimPrefix(p, "q="), 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+		switch coding {
+		case encodingZstd, encodingGzip:
+		case "*":
+			coding = encodingZstd
+		default:
+			continue
+		}
+		if q > bestQ || (q == bestQ && q > 0 && coding == encodingZstd) {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compressor returns the writer compressing to w with encoding and the function to return it to the pool.
+func compressor(encoding string, w io.Writer) (io.WriteCloser, func()) {
+	switch encoding {
+	case encodingZstd:
+		e := zstdEncoders.Get().(*zstd.Encoder)
+		e.Reset(w)
+		return e, func() { zstdEncoders.Put(e) }
+	case encodingGzip:
+		g := gzipWriters.Get().(*gzip.Writer)
+		g.Reset(w)
+		return g, func() { gzipWriters.Put(g) }
+	}
+	return nil, nil
+}
+
+// compressWriter writes the response with status, the response is compressed with encoding once
+// it's larger than minCompressSize, so that the size need not be known before writing.
+type compressWriter struct {
+	writer   http.ResponseWriter
+	status   int
+	encoding string
+	buf      []byte
+	out      io.Writer
+	bw       *bufio.Writer
+	cw       io.WriteCloser
+	put      func()
+}
+
+func newCompressWriter(writer http.ResponseWriter, r *http.Request, status int) *compressWriter {
+	writer.Header().Add("Vary", "Accept-Encoding")
+	return &compressWriter{
+		writer:   writer,
+		status:   status,
+		encoding: negotiateEncoding(r.Header.Get("Accept-Encoding")),
+	}
+}
+
+// start writes the header and the buffered data, the rest is written to out directly.
+func (w *compressWriter) start(compress bool) error {
+	w.bw = bufio.NewWriterSize(w.writer, responseBufferSize)
+	w.out = w.bw
+	if compress && w.encoding != "" {
+		w.writer.Header().Set("Content-Encoding", w.encoding)
+		w.cw, w.put = compressor(w.encoding, w.bw)
+		w.out = w.cw
+	}
+	w.writer.WriteHeader(w.status)
+	buf := w.buf
+	w.buf = nil
+	_, err := w.out.Write(buf)
+	return err
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.out == nil {
+		if len(w.buf)+len(p) < minCompressSize {
+			w.buf = append(w.buf, p...)
+			return len(p), nil
+		}
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return w.out.Write(p)
+}
+
+// Close writes the buffered data and finishes the compression.
+func (w *compressWriter) Close() error {
+	if w.out == nil {
+		if err := w.start(false); err != nil {
+			return err
+		}
+	}
+	if w.cw != nil {
+		err := w.cw.Close()
+		w.put()
+		w.cw = nil
+		if err != nil {
+			return err
+		}
+	}
+	return w.bw.Flush()
+}
+
+// compressedJsonResp writes v as json like jsonResp, the large responses are compressed
+// with the encoding accepted by the client.
+func compressedJsonResp(writer http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	b, _ := json.Marshal(v)
+	writer.Header().Set("Content-Type", "application/json")
+	w := newCompressWriter(writer, r, status)
+	_, _ = w.Write(b)
+	_ = w.Close()
+}
+
+// streamingJsonResp encodes v to the writer piece by piece, and compresses it like compressedJsonResp.
+func streamingJsonResp(writer http.ResponseWriter, r *http.Request, status int, v api.StreamingResponse) {
+	writer.Header().Set("Content-Type", "application/json")
+	w := newCompressWriter(writer, r, status)
+	if err := v.EncodeJSON(w); err != nil {
+		// the status is written, the client will get an incomplete json
+		log.Warnf("%s:%s encode response error: %v", r.Method, r.URL.Path, err)
+	}
+	if err := w.Close(); err != nil {
+		log.Debugf("%s:%s write response error: %v", r.Method, r.URL.Path, err)
+	}
+}
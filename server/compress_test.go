@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DaoCloud/ckube/api"
+	"github.com/DaoCloud/ckube/store"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		name           string
+		acceptEncoding string
+		expect         string
+	}{
+		{name: "empty", acceptEncoding: "", expect: ""},
+		{name: "gzip", acceptEncoding: "gzip", expect: encodingGzip},
+		{name: "zstd preferred", acceptEncoding: "gzip, deflate, br, zstd", expect: encodingZstd},
+		{name: "qvalue", acceptEncoding: "zstd;q=0.5, gzip", expect: encodingGzip},
+		{name: "disabled", acceptEncoding: "zstd;q=0, gzip;q=0", expect: ""},
+		{name: "wildcard", acceptEncoding: "*", expect: encodingZstd},
+		{name: "unsupported", acceptEncoding: "br, deflate", expect: ""},
+		{name: "case insensitive", acceptEncoding: "GZIP", expect: encodingGzip},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			assert.Equal(t, c.expect, negotiateEncoding(c.acceptEncoding))
+		})
+	}
+}
+
+func TestCompressedJsonResp(t *testing.T) {
+	large := map[string]string{"data": strings.Repeat("a", minCompressSize)}
+	small := map[string]string{"data": "a"}
+	cases := []struct {
+		name           string
+		acceptEncoding string
+		v              interface{}
+		expectEncoding string
+	}{
+		{name: "small", acceptEncoding: "gzip", v: small, expectEncoding: ""},
+		{name: "not accepted", acceptEncoding: "", v: large, expectEncoding: ""},
+		{name: "gzip", acceptEncoding: "gzip", v: large, expectEncoding: encodingGzip},
+		{name: "zstd", acceptEncoding: "gzip, zstd", v: large, expectEncoding: encodingZstd},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+			r.Header.Set("Accept-Encoding", c.acceptEncoding)
+			w := httptest.NewRecorder()
+			compressedJsonResp(w, r, http.StatusOK, c.v)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+			assert.Equal(t, c.expectEncoding, w.Header().Get("Content-Encoding"))
+			expect, _ := json.Marshal(c.v)
+			assert.True(t, bytes.Equal(expect, decodeBody(t, c.expectEncoding, w.Body)))
+		})
+	}
+}
+
+func decodeBody(t *testing.T, encoding string, body io.Reader) []byte {
+	switch encoding {
+	case encodingGzip:
+		gr, err := gzip.NewReader(body)
+		assert.NoError(t, err)
+		body = gr
+	case encodingZstd:
+		zr, err := zstd.NewReader(body)
+		assert.NoError(t, err)
+		defer zr.Close()
+		body = zr
+	}
+	bs, err := io.ReadAll(body)
+	assert.NoError(t, err)
+	return bs
+}
+
+func TestStreamingJsonResp(t *testing.T) {
+	items := func(n int) []interface{} {
+		res := []interface{}{}
+		for i := 0; i < n; i++ {
+			res = append(res, map[string]string{"name": fmt.Sprintf("pod-%d", i)})
+		}
+		return res
+	}
+	cases := []struct {
+		name           string
+		acceptEncoding string
+		items          []interface{}
+		expectEncoding string
+	}{
+		{name: "empty", acceptEncoding: "gzip", items: items(0), expectEncoding: ""},
+		{name: "small", acceptEncoding: "zstd", items: items(10), expectEncoding: ""},
+		{name: "not accepted", acceptEncoding: "", items: items(2000), expectEncoding: ""},
+		{name: "gzip", acceptEncoding: "gzip", items: items(2000), expectEncoding: encodingGzip},
+		{name: "zstd", acceptEncoding: "zstd", items: items(2000), expectEncoding: encodingZstd},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+			r.Header.Set("Accept-Encoding", c.acceptEncoding)
+			w := httptest.NewRecorder()
+			metadata := map[string]interface{}{"remainingItemCount": 0}
+			streamingJsonResp(w, r, http.StatusOK, &api.List{
+				APIVersion: "v1",
+				Kind:       "PodList",
+				Metadata:   metadata,
+				Items:      store.NewSliceIterator(c.items),
+			})
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.Equal(t, c.expectEncoding, w.Header().Get("Content-Encoding"))
+			expect, _ := json.Marshal(map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "PodList",
+				"metadata":   metadata,
+				"items":      c.items,
+			})
+			assert.Equal(t, string(expect), string(decodeBody(t, c.expectEncoding, w.Body)))
+		})
+	}
+}
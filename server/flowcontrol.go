@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/log"
+	"github.com/DaoCloud/ckube/utils/prommonitor"
+)
+
+const (
+	defaultQueueTimeout = 10 * time.Second
+	// rejectRetryAfter is the Retry-After seconds of the rejected requests.
+	rejectRetryAfter = 1
+)
+
+var errTooManyRequests = fmt.Errorf("too many requests")
+
+// waiter is a request waiting in the queue of a flow.
+type waiter struct {
+	ready chan struct{}
+}
+
+// priorityLevel limits the executing requests, the requests exceeding are queued by flows
+// and dispatched round-robin among the flows when the executing requests finish.
+type priorityLevel struct {
+	conf      common.PriorityLevel
+	lock      sync.Mutex
+	executing int
+	queues    map[string][]*waiter
+	// flows with waiting requests in dispatching order
+	flows []string
+}
+
+func newPriorityLevel(conf common.PriorityLevel) *priorityLevel {
+	return &priorityLevel{
+		conf:   conf,
+		queues: map[string][]*waiter{},
+	}
+}
+
+func (p *priorityLevel) queueTimeout() time.Duration {
+	if p.conf.QueueTimeoutSeconds > 0 {
+		return time.Duration(p.conf.QueueTimeoutSeconds) * time.Second
+	}
+	return defaultQueueTimeout
+}
+
+// acquire waits for a seat to execute the request of flow, the seat must be released after executing.
+func (p *priorityLevel) acquire(ctx context.Context, flow string, queued func()) error {
+	p.lock.Lock()
+	if p.conf.Concurrency <= 0 || (p.executing < p.conf.Concurrency && len(p.flows) == 0) {
+		p.executing++
+		p.lock.Unlock()
+		return nil
+	}
+	q := p.queues[flow]
+	if len(q) >= p.conf.QueueLength {
+		p.lock.Unlock()
+		return errTooManyRequests
+	}
+	w := &waiter{ready: make(chan struct{})}
+	if len(q) == 0 {
+		p.flows = append(p.flows, flow)
+	}
+	p.queues[flow] = append(q, w)
+	p.lock.Unlock()
+	queued()
+
+	timer := time.NewTimer(p.queueTimeout())
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-timer.C:
+		err = errTooManyRequests
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	select {
+	case <-w.ready:
+		// dispatched while giving up, give the seat to others
+		p.executing--
+		p.dispatchLocked()
+		return err
+	default:
+	}
+	q = p.queues[flow]
+	for i := range q {
+		if q[i] == w {
+			q = append(q[:i:i], q[i+1:]...)
+			break
+		}
+	}
+	if len(q) > 0 {
+		p.queues[flow] = q
+	} else {
+		delete(p.queues, flow)
+		p.removeFlowLocked(flow)
+	}
+	return err
+}
+
+func (p *priorityLevel) release() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.executing--
+	p.dispatchLocked()
+}
+
+func (p *priorityLevel) dispatchLocked() {
+	for p.executing < p.conf.Concurrency && len(p.flows) > 0 {
+		flow := p.flows[0]
+		p.flows = p.flows[1:]
+		q := p.queues[flow]
+		w := q[0]
+		if len(q) > 1 {
+			p.queues[flow] = q[1:]
+			p.flows = append(p.flows, flow)
+		} else {
+			delete(p.queues, flow)
+		}
+		p.executing++
+		close(w.ready)
+	}
+}
+
+func (p *priorityLevel) removeFlowLocked(flow string) {
+	for i, f := range p.flows {
+		if f == flow {
+			p.flows = append(p.flows[:i:i], p.flows[i+1:]...)
+			return
+		}
+	}
+}
+
+// flowController classifies the requests by flow schemas and admits them by the priority levels.
+type flowController struct {
+	conf    common.FlowControl
+	schemas []common.FlowSchema
+	levels  map[string]*priorityLevel
+}
+
+func newFlowController(conf common.FlowControl) *flowController {
+	f := &flowController{
+		conf:   conf,
+		levels: map[string]*priorityLevel{},
+	}
+	for _, l := range conf.PriorityLevels {
+		f.levels[l.Name] = newPriorityLevel(l)
+	}
+	for _, s := range conf.FlowSchemas {
+		if _, ok := f.levels[s.PriorityLevel]; !ok {
+			log.Warnf("priority level %s of flow schema %s not found, ignored", s.PriorityLevel, s.Name)
+			continue
+		}
+		f.schemas = append(f.schemas, s)
+	}
+	return f
+}
+
+func requestUser(r *http.Request) string {
+	if u := r.Header.Get("Impersonate-User"); u != "" {
+		return u
+	}
+	u, _, _ := r.BasicAuth()
+	return u
+}
+
+func requestToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+func matchAny(patterns []string, match func(string) bool) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if match(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSchema(s common.FlowSchema, r *http.Request) bool {
+	user, token := requestUser(r), requestToken(r)
+	resource, group := mux.Vars(r)["resourceType"], mux.Vars(r)["group"]
+	return matchAny(s.Users, func(p string) bool {
+		return p == user
+	}) && matchAny(s.Tokens, func(p string) bool {
+		return token != "" && p == token
+	}) && matchAny(s.Paths, func(p string) bool {
+		return strings.HasPrefix(r.URL.Path, p)
+	}) && matchAny(s.Resources, func(p string) bool {
+		if resource == "" {
+			return false
+		}
+		return p == "*" || p == resource || (group != "" && p == resource+"."+group)
+	})
+}
+
+// classify returns the matched flow schema and the flow of the request.
+func (f *flowController) classify(r *http.Request) (common.FlowSchema, string, bool) {
+	for _, s := range f.schemas {
+		if !matchSchema(s, r) {
+			continue
+		}
+		flow := s.Name
+		switch s.Distinguisher {
+		case "user":
+			flow += "/" + requestUser(r)
+		case "token":
+			flow += "/" + requestToken(r)
+		}
+		return s, flow, true
+	}
+	return common.FlowSchema{}, "", false
+}
+
+// admit waits until the request is admitted, the returned function must be called after the request is served.
+func (f *flowController) admit(r *http.Request) (func(), error) {
+	s, flow, ok := f.classify(r)
+	if !ok {
+		return func() {}, nil
+	}
+	level := f.levels[s.PriorityLevel]
+	inQueue := prommonitor.FlowControlInQueue.WithLabelValues(s.Name, s.PriorityLevel)
+	queued := false
+	st := time.Now()
+	err := level.acquire(r.Context(), flow, func() {
+		queued = true
+		inQueue.Inc()
+	})
+	if queued {
+		inQueue.Dec()
+		prommonitor.FlowControlWaitSeconds.WithLabelValues(s.Name, s.PriorityLevel).Observe(time.Since(st).Seconds())
+	}
+	if err != nil {
+		result := "canceled"
+		if err == errTooManyRequests {
+			result = "rejected"
+			if queued {
+				result = "timeout"
+			}
+		}
+		prommonitor.FlowControlRequests.WithLabelValues(s.Name, s.PriorityLevel, result).Inc()
+		return nil, err
+	}
+	prommonitor.FlowControlRequests.WithLabelValues(s.Name, s.PriorityLevel, "executed").Inc()
+	executing := prommonitor.FlowControlExecuting.WithLabelValues(s.Name, s.PriorityLevel)
+	executing.Inc()
+	return func() {
+		executing.Dec()
+		level.release()
+	}, nil
+}
+
+// admission returns the flow controller of current config for the route, nil if flow control is disabled
+// or the route is not an api route.
+func (m *muxServer) admission(route route) *flowController {
+	if !route.authRequired {
+		return nil
+	}
+	conf := common.GetConfig().FlowControl
+	if len(conf.PriorityLevels) == 0 {
+		return nil
+	}
+	m.flowLock.Lock()
+	defer m.flowLock.Unlock()
+	if m.flow == nil || !reflect.DeepEqual(m.flow.conf, conf) {
+		m.flow = newFlowController(conf)
+	}
+	return m.flow
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DaoCloud/ckube/common"
+)
+
+func TestFlowController_Classify(t *testing.T) {
+	f := newFlowController(common.FlowControl{
+		PriorityLevels: []common.PriorityLevel{{Name: "low", Concurrency: 1}, {Name: "high", Concurrency: 10}},
+		FlowSchemas: []common.FlowSchema{
+			{Name: "admin", PriorityLevel: "high", Users: []string{"admin"}},
+			{Name: "ci", PriorityLevel: "low", Tokens: []string{"ci-token"}, Distinguisher: "token"},
+			{Name: "lists", PriorityLevel: "low", Resources: []string{"pods", "deployments.apps"}, Distinguisher: "user"},
+			{Name: "custom", PriorityLevel: "high", Paths: []string{"/custom/"}},
+			{Name: "unknown", PriorityLevel: "unknown"},
+		},
+	})
+	cases := []struct {
+		name         string
+		path         string
+		vars         map[string]string
+		header       map[string]string
+		expectSchema string
+		expectFlow   string
+	}{
+		{
+			name:         "user",
+			path:         "/api/v1/pods",
+			vars:         map[string]string{"resourceType": "pods"},
+			header:       map[string]string{"Impersonate-User": "admin"},
+			expectSchema: "admin",
+			expectFlow:   "admin",
+		},
+		{
+			name:         "token",
+			path:         "/api/v1/services",
+			header:       map[string]string{"Authorization": "Bearer ci-token"},
+			expectSchema: "ci",
+			expectFlow:   "ci/ci-token",
+		},
+		{
+			name:         "resource",
+			path:         "/api/v1/pods",
+			vars:         map[string]string{"resourceType": "pods"},
+			header:       map[string]string{"Impersonate-User": "alice"},
+			expectSchema: "lists",
+			expectFlow:   "lists/alice",
+		},
+		{
+			name:         "resource with group",
+			path:         "/apis/apps/v1/deployments",
+			vars:         map[string]string{"group": "apps", "resourceType": "deployments"},
+			expectSchema: "lists",
+			expectFlow:   "lists/",
+		},
+		{
+			name:         "path",
+			path:         "/custom/v1/pods/p1/related",
+			expectSchema: "custom",
+			expectFlow:   "custom",
+		},
+		{
+			name: "no match",
+			path: "/api/v1/services",
+			vars: map[string]string{"resourceType": "services"},
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, c.path, nil)
+			req = mux.SetURLVars(req, c.vars)
+			for k, v := range c.header {
+				req.Header.Set(k, v)
+			}
+			s, flow, ok := f.classify(req)
+			assert.Equal(t, c.expectSchema != "", ok)
+			assert.Equal(t, c.expectSchema, s.Name)
+			assert.Equal(t, c.expectFlow, flow)
+		})
+	}
+}
+
+func TestPriorityLevel(t *testing.T) {
+	ctx := context.Background()
+	p := newPriorityLevel(common.PriorityLevel{Name: "test", Concurrency: 1, QueueLength: 2, QueueTimeoutSeconds: 5})
+	assert.NoError(t, p.acquire(ctx, "a", func() {}))
+
+	// flow a queues 2 requests before flow b, they are dispatched round-robin
+	lock := sync.Mutex{}
+	order := []string{}
+	wg := sync.WaitGroup{}
+	queued := make(chan struct{})
+	for _, flow := range []string{"a", "a", "b"} {
+		wg.Add(1)
+		go func(flow string) {
+			defer wg.Done()
+			err := p.acquire(ctx, flow, func() { queued <- struct{}{} })
+			assert.NoError(t, err)
+			lock.Lock()
+			order = append(order, flow)
+			lock.Unlock()
+			p.release()
+		}(flow)
+		<-queued
+	}
+	// the queue of flow a is full
+	assert.Equal(t, errTooManyRequests, p.acquire(ctx, "a", func() {}))
+	p.release()
+	wg.Wait()
+	assert.Equal(t, []string{"a", "b", "a"}, order)
+
+	// canceled or timed out in queue
+	assert.NoError(t, p.acquire(ctx, "a", func() {}))
+	cctx, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	assert.Equal(t, context.Canceled, p.acquire(cctx, "a", func() {}))
+	tctx, tcancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer tcancel()
+	assert.Equal(t, context.DeadlineExceeded, p.acquire(tctx, "b", func() {}))
+	assert.Empty(t, p.flows)
+	assert.Empty(t, p.queues)
+	p.release()
+	assert.Equal(t, 0, p.executing)
+}
@@ -49,9 +49,102 @@ var (
 			authRequired:  true,
 			successStatus: 200,
 		},
+		// related resources
 		{
-			path:          "/apis/{group}/{version}/namespaces/{namespace}/{resourceType}",
+			path:          "/custom/v1/namespaces/{namespace}/{kind}/{name}/related",
+			method:        "GET",
+			handler:       extend.Related,
+			authRequired:  true,
+			successStatus: 200,
+		},
+		{
+			path:          "/custom/v1/clusters/{cluster}/namespaces/{namespace}/{kind}/{name}/related",
+			method:        "GET",
+			handler:       extend.Related,
+			authRequired:  true,
+			successStatus: 200,
+		},
+		{
+			path:          "/custom/v1/clusters/{cluster}/{kind}/{name}/related",
+			method:        "GET",
+			handler:       extend.Related,
+			authRequired:  true,
+			successStatus: 200,
+		},
+		{
+			path:          "/custom/v1/{kind}/{name}/related",
+			method:        "GET",
+			handler:       extend.Related,
+			authRequired:  true,
+			successStatus: 200,
+		},
+		// cache status
+		{
+			path:          "/custom/v1/cache/status",
+			method:        "GET",
+			handler:       extend.CacheStatus,
+			authRequired:  true,
+			successStatus: 200,
+		},
+		{
+			path:          "/custom/v1/cache/dump",
+			method:        "GET",
+			handler:       extend.CacheDump,
+			authRequired:  true,
+			successStatus: 200,
+		},
+		// discovery and openapi
+		{
+			path:          "/version",
+			method:        "GET",
+			handler:       api.Discovery,
+			authRequired:  true,
+			successStatus: 200,
+		},
+		{
+			path:          "/api",
 			method:        "GET",
+			handler:       api.Discovery,
+			authRequired:  true,
+			successStatus: 200,
+		},
+		{
+			path:          "/api/{version}",
+			method:        "GET",
+			handler:       api.Discovery,
+			authRequired:  true,
+			successStatus: 200,
+		},
+		{
+			path:          "/apis",
+			method:        "GET",
+			handler:       api.Discovery,
+			authRequired:  true,
+			successStatus: 200,
+		},
+		{
+			path:          "/apis/{group}",
+			method:        "GET",
+			handler:       api.Discovery,
+			authRequired:  true,
+			successStatus: 200,
+		},
+		{
+			path:          "/apis/{group}/{version}",
+			method:        "GET",
+			handler:       api.Discovery,
+			authRequired:  true,
+			successStatus: 200,
+		},
+		{
+			path:          "/openapi/",
+			prefix:        true,
+			handler:       api.Discovery,
+			authRequired:  true,
+			successStatus: 200,
+		},
+		{
+			path:          "/apis/{group}/{version}/namespaces/{namespace}/{resourceType}",
 			handler:       api.Proxy,
 			authRequired:  true,
 			successStatus: 200,
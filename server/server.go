@@ -1,16 +1,21 @@
 package server
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 
 	"github.com/DaoCloud/ckube/api"
 	"github.com/DaoCloud/ckube/common"
@@ -25,7 +30,7 @@ import (
 type Server interface {
 	Run() error
 	Stop() error
-	ResetStore(store store.Store, clis map[string]kubernetes.Interface)
+	ResetStore(store store.Store, clis map[string]kubernetes.Interface, configs map[string]rest.Config)
 }
 
 type muxServer struct {
@@ -35,6 +40,9 @@ type muxServer struct {
 	server         *http.Server
 	store          store.Store
 	clusterClients map[string]kubernetes.Interface
+	clusterConfigs map[string]rest.Config
+	flowLock       sync.Mutex
+	flow           *flowController
 }
 
 type statusWriter struct {
@@ -59,6 +67,22 @@ func (w *statusWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Hijack hijacks the connection for upgrade requests, the deadlines of the server are cleared
+// for the long-running connections like exec and port-forward.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection of %T can not be hijacked", w.ResponseWriter)
+	}
+	conn, rw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.status = http.StatusSwitchingProtocols
+	_ = conn.SetDeadline(time.Time{})
+	return conn, rw, nil
+}
+
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		st := time.Now()
@@ -79,13 +103,16 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func NewMuxServer(listenAddr string, clusterClients map[string]kubernetes.Interface, s store.Store, externalRouter ...func(*mux.Router)) Server {
+func NewMuxServer(listenAddr string, clusterClients map[string]kubernetes.Interface, clusterConfigs map[string]rest.Config,
+	s store.Store, externalRouter ...func(*mux.Router)) Server {
 	ser := muxServer{
 		clusterClients: clusterClients,
+		clusterConfigs: clusterConfigs,
 		store:          s,
 		ListenAddr:     listenAddr,
 		router:         mux.NewRouter(),
 	}
+	// the external routes take precedence over the routes of ckube
 	for _, h := range externalRouter {
 		h(ser.router)
 	}
@@ -116,9 +143,10 @@ func (m *muxServer) Stop() error {
 	return m.server.Shutdown(ctx)
 }
 
-func (m *muxServer) ResetStore(s store.Store, clis map[string]kubernetes.Interface) {
+func (m *muxServer) ResetStore(s store.Store, clis map[string]kubernetes.Interface, configs map[string]rest.Config) {
 	m.store = s
 	m.clusterClients = clis
+	m.clusterConfigs = configs
 }
 
 func jsonResp(writer http.ResponseWriter, status int, v interface{}) {
@@ -162,8 +190,30 @@ func (m *muxServer) registerRoutes(router *mux.Router, handleRoutes []route) {
 						return
 					}
 				}
+				if fc := m.admission(route); fc != nil {
+					done, err := fc.admit(r)
+					if err != nil {
+						if err == errTooManyRequests {
+							writer.Header().Set("Retry-After", strconv.Itoa(rejectRetryAfter))
+							jsonResp(writer, http.StatusTooManyRequests, v1.Status{
+								Status:  v1.StatusFailure,
+								Message: "too many requests, please try again later",
+								Reason:  v1.StatusReasonTooManyRequests,
+								Code:    http.StatusTooManyRequests,
+							})
+						}
+						return
+					}
+					if api.IsLongRunning(r) {
+						// long-running requests do not occupy the seats after admitted
+						done()
+					} else {
+						defer done()
+					}
+				}
 				var res = route.handler(&api.ReqContext{
 					ClusterClients: m.clusterClients,
+					ClusterConfigs: m.clusterConfigs,
 					Store:          m.store,
 					Request:        r,
 					Writer:         writer,
@@ -186,10 +236,13 @@ func (m *muxServer) registerRoutes(router *mux.Router, handleRoutes []route) {
 				case []byte:
 					_, _ = writer.Write(res)
 					return
+				case api.StreamingResponse:
+					streamingJsonResp(writer, r, route.successStatus, res)
+					return
 				default:
 					status = route.successStatus
 				}
-				jsonResp(writer, status, res)
+				compressedJsonResp(writer, r, status, res)
 			})
 		}(r)
 	}
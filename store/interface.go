@@ -1,6 +1,9 @@
 package store
 
 import (
+	"context"
+	"io"
+
 	"github.com/DaoCloud/ckube/page"
 )
 
@@ -9,15 +12,31 @@ type Sort func(i, j int) bool
 
 type Query struct {
 	Namespace string
+	// LabelSelector selects the objects by their labels, it's in the string form of labels.Selector.
+	LabelSelector string
 	page.Paginate
 }
 
 type Store interface {
 	IsStoreGVR(gvr GroupVersionResource) bool
+	// AddResource starts storing gvr which is not configured at startup, it does nothing if gvr is stored.
+	AddResource(gvr GroupVersionResource, index map[string]string, searchable []string) error
+	// RemoveResource stops storing gvr added by AddResource and drops its objects.
+	RemoveResource(gvr GroupVersionResource) error
 	Clean(gvr GroupVersionResource, cluster string) error
 	OnResourceAdded(gvr GroupVersionResource, cluster string, obj interface{}) error
 	OnResourceModified(gvr GroupVersionResource, cluster string, obj interface{}) error
 	OnResourceDeleted(gvr GroupVersionResource, cluster string, obj interface{}) error
 	Query(gvr GroupVersionResource, query Query) QueryResult
+	// QueryIter is like Query, but the items are yielded by Iter of the result instead of being materialized in Items.
+	QueryIter(gvr GroupVersionResource, query Query) QueryResult
 	Get(gvr GroupVersionResource, cluster string, namespace, name string) interface{}
+	// OnResourceVersion records the resourceVersion observed by the watcher of gvr in cluster.
+	OnResourceVersion(gvr GroupVersionResource, cluster string, resourceVersion string) error
+	// WaitResourceVersion blocks until the watcher of gvr in cluster has observed resourceVersion or ctx is done.
+	WaitResourceVersion(ctx context.Context, gvr GroupVersionResource, cluster string, resourceVersion string) error
+	// Status returns the usage and the limits of the store.
+	Status() Status
+	// Dump writes the cached objects with their indexes to w, which can be loaded by the store offline.
+	Dump(w io.Writer) error
 }
@@ -0,0 +1,94 @@
+package memory
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/DaoCloud/ckube/page"
+	"github.com/DaoCloud/ckube/store"
+)
+
+const benchNamespaces = 1000
+
+func benchPod(i int, rv uint64) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "pod-" + strconv.Itoa(i),
+			Namespace:       "ns-" + strconv.Itoa(i%benchNamespaces),
+			UID:             "uid",
+			ResourceVersion: strconv.FormatUint(rv, 10),
+			Labels:          map[string]string{"app": strconv.Itoa(i % 10)},
+		},
+	}
+}
+
+// benchStore returns a store with objects pods, the query cache and snapshots are disabled
+// to measure the store itself.
+func benchStore(objects int) (store.Store, *uint64) {
+	m := NewMemoryStore(testIndexConf, WithQueryCache(0), WithSnapshotTTL(0))
+	rv := uint64(0)
+	for i := 0; i < objects; i++ {
+		rv++
+		_ = m.OnResourceAdded(podsGVR, "test", benchPod(i, rv))
+	}
+	return m, &rv
+}
+
+// benchMixed runs writes and queries in parallel, writePercent of the operations are writes.
+func benchMixed(b *testing.B, m store.Store, rv *uint64, objects, writePercent int) {
+	var seed int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			i := r.Intn(objects)
+			if r.Intn(100) < writePercent {
+				_ = m.OnResourceModified(podsGVR, "test", benchPod(i, atomic.AddUint64(rv, 1)))
+				continue
+			}
+			if r.Intn(2) == 0 {
+				m.Get(podsGVR, "test", "ns-"+strconv.Itoa(i%benchNamespaces), "pod-"+strconv.Itoa(i))
+				continue
+			}
+			res := m.Query(podsGVR, store.Query{
+				Namespace: "ns-" + strconv.Itoa(i%benchNamespaces),
+				Paginate:  page.Paginate{Page: 1, PageSize: 10, Search: "name=pod-" + strconv.Itoa(i%10)},
+			})
+			if res.Error != nil {
+				b.Fatal(res.Error)
+			}
+		}
+	})
+}
+
+// BenchmarkStore measures the throughput of write-heavy and query-heavy workloads,
+// run with `go test -run=^$ -bench=BenchmarkStore -benchtime=5s ./store/memory/`.
+func BenchmarkStore(b *testing.B) {
+	for _, objects := range []int{100000, 1000000} {
+		m, rv := benchStore(objects)
+		for _, w := range []struct {
+			name         string
+			writePercent int
+		}{
+			{name: "write-heavy", writePercent: 90},
+			{name: "query-heavy", writePercent: 10},
+		} {
+			b.Run(fmt.Sprintf("objects=%d/%s", objects, w.name), func(b *testing.B) {
+				benchMixed(b, m, rv, objects, w.writePercent)
+			})
+		}
+		b.Run(fmt.Sprintf("objects=%d/list-all", objects), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m.Query(podsGVR, store.Query{Paginate: page.Paginate{Page: 1, PageSize: 10}})
+			}
+		})
+	}
+}
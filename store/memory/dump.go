@@ -0,0 +1,222 @@
+package memory
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/store"
+)
+
+// dumpFormatVersion is the version of the dump format, it's changed if the format is not compatible.
+const dumpFormatVersion = 1
+
+// DumpHeader is the first record of a dump, which describes the cached resources.
+type DumpHeader struct {
+	Version        int       `json:"version"`
+	CreatedAt      time.Time `json:"created_at"`
+	DefaultCluster string    `json:"default_cluster"`
+	// Proxies are the configurations of the cached resources.
+	Proxies []common.Proxy `json:"proxies"`
+	// ResourceVersions are the resourceVersions observed by the watchers.
+	ResourceVersions []DumpResourceVersion `json:"resource_versions,omitempty"`
+}
+
+type DumpResourceVersion struct {
+	Group           string `json:"group"`
+	Version         string `json:"version"`
+	Resource        string `json:"resource"`
+	Cluster         string `json:"cluster"`
+	ResourceVersion uint64 `json:"resource_version"`
+}
+
+// dumpObject is a cached object with its index.
+type dumpObject struct {
+	Group       string            `json:"group"`
+	Version     string            `json:"version"`
+	Resource    string            `json:"resource"`
+	Cluster     string            `json:"cluster"`
+	Kind        string            `json:"kind"`
+	Index       map[string]string `json:"index"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Size        int64             `json:"size"`
+	Object      json.RawMessage   `json:"object"`
+}
+
+// Dump writes the cached objects with their indexes as gzip compressed json lines, the header is the first line.
+// Each shard is read under its own lock, the dump is not a point-in-time view of the whole store.
+func (m *memoryStore) Dump(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	header := DumpHeader{
+		Version:        dumpFormatVersion,
+		CreatedAt:      time.Now(),
+		DefaultCluster: common.GetConfig().DefaultCluster,
+	}
+	m.resources.ForEach(func(gvr store.GroupVersionResource, g *gvrStore) {
+		if !g.cached() {
+			return
+		}
+		p, ok := common.GetProxy(gvr.Group, gvr.Version, gvr.Resource)
+		if !ok {
+			p = common.Proxy{Group: gvr.Group, Version: gvr.Version, Resource: gvr.Resource, Index: g.index}
+		}
+		p.Limit = g.limit
+		header.Proxies = append(header.Proxies, p)
+	})
+	m.versions.lock.Lock()
+	for k, rv := range m.versions.versions {
+		header.ResourceVersions = append(header.ResourceVersions, DumpResourceVersion{
+			Group:           k.gvr.Group,
+			Version:         k.gvr.Version,
+			Resource:        k.gvr.Resource,
+			Cluster:         k.cluster,
+			ResourceVersion: rv,
+		})
+	}
+	m.versions.lock.Unlock()
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	var err error
+	m.resources.ForEach(func(gvr store.GroupVersionResource, g *gvrStore) {
+		if err != nil || !g.cached() {
+			return
+		}
+		kind := strings.TrimSuffix(common.GetGVRKind(gvr.Group, gvr.Version, gvr.Resource), "List")
+		var objs []*entry
+		g.clusters.ForEach(func(cname clusterName, c *clusterStore) {
+			if err != nil {
+				return
+			}
+			objs = c.appendObjects(objs[:0], "")
+			for _, e := range objs {
+				o := dumpObject{
+					Group:       gvr.Group,
+					Version:     gvr.Version,
+					Resource:    gvr.Resource,
+					Cluster:     string(cname),
+					Kind:        kind,
+					Index:       e.Index,
+					Annotations: e.Annotations,
+					Size:        e.size,
+				}
+				if ro, ok := e.Obj.(runtime.Object); ok {
+					if k := ro.GetObjectKind().GroupVersionKind().Kind; k != "" {
+						o.Kind = k
+					}
+				}
+				if o.Object, err = json.Marshal(e.Obj); err != nil {
+					return
+				}
+				if err = enc.Encode(o); err != nil {
+					return
+				}
+			}
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// decodeObject decodes the object of o to the registered type of its kind, or unstructured if the kind is unknown.
+func decodeObject(o dumpObject) (interface{}, error) {
+	gvk := schema.GroupVersionKind{Group: o.Group, Version: o.Version, Kind: o.Kind}
+	var obj runtime.Object
+	switch {
+	case o.Kind == "PartialObjectMetadata":
+		obj = &v1.PartialObjectMetadata{}
+	case scheme.Scheme.Recognizes(gvk):
+		var err error
+		if obj, err = scheme.Scheme.New(gvk); err != nil {
+			return nil, err
+		}
+	default:
+		u := &unstructured.Unstructured{}
+		if err := json.Unmarshal(o.Object, &u.Object); err != nil {
+			return nil, err
+		}
+		if u.GetKind() == "" {
+			// the type meta of typed objects is not set by watchers
+			u.SetGroupVersionKind(gvk)
+		}
+		return u, nil
+	}
+	if err := json.Unmarshal(o.Object, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// LoadDump creates a memory store from the dump read from r, the indexes of the objects are not rebuilt.
+// The objects are bounded by global and the limits of the resources in the dump.
+func LoadDump(r io.Reader, global common.CacheLimit) (DumpHeader, store.Store, error) {
+	header := DumpHeader{}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return header, nil, err
+	}
+	defer gz.Close()
+	dec := json.NewDecoder(bufio.NewReader(gz))
+	if err := dec.Decode(&header); err != nil {
+		return header, nil, fmt.Errorf("read dump header error: %v", err)
+	}
+	if header.Version != dumpFormatVersion {
+		return header, nil, fmt.Errorf("unsupported dump version %d", header.Version)
+	}
+	indexConf := map[store.GroupVersionResource]map[string]string{}
+	searchable := map[store.GroupVersionResource][]string{}
+	limits := map[store.GroupVersionResource]common.CacheLimit{}
+	for _, p := range header.Proxies {
+		gvr := store.GroupVersionResource{Group: p.Group, Version: p.Version, Resource: p.Resource}
+		indexConf[gvr] = p.Index
+		searchable[gvr] = p.Searchable
+		limits[gvr] = p.Limit
+	}
+	m := NewMemoryStore(indexConf, WithSearchable(searchable), WithLimits(global, limits)).(*memoryStore)
+	for {
+		o := dumpObject{}
+		if err := dec.Decode(&o); err == io.EOF {
+			break
+		} else if err != nil {
+			return header, nil, fmt.Errorf("read dump error: %v", err)
+		}
+		gvr := store.GroupVersionResource{Group: o.Group, Version: o.Version, Resource: o.Resource}
+		g, err := m.cachedResource(gvr)
+		if g == nil {
+			if err == nil {
+				// dropped by limits
+				continue
+			}
+			return header, nil, err
+		}
+		obj, err := decodeObject(o)
+		if err != nil {
+			return header, nil, fmt.Errorf("decode %v object error: %v", gvr, err)
+		}
+		m.setObject(gvr, g, o.Cluster, o.Index["namespace"], o.Index["name"], store.Object{
+			Index:       o.Index,
+			Annotations: o.Annotations,
+			Obj:         obj,
+		}, o.Size)
+	}
+	// the clusters are created by the objects, so the watermarks are set after loading them
+	for _, v := range header.ResourceVersions {
+		gvr := store.GroupVersionResource{Group: v.Group, Version: v.Version, Resource: v.Resource}
+		m.observe(gvr, v.Cluster, v.ResourceVersion)
+	}
+	return header, m, nil
+}
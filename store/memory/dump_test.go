@@ -0,0 +1,76 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/page"
+	"github.com/DaoCloud/ckube/store"
+)
+
+func TestMemoryStore_Dump(t *testing.T) {
+	podsGVR := store.GroupVersionResource{Version: "v1", Resource: "pods"}
+	crGVR := store.GroupVersionResource{Group: "example.io", Version: "v1", Resource: "foos"}
+	common.InitConfig(&common.Config{
+		DefaultCluster: "c1",
+		Proxies: []common.Proxy{
+			{Version: podsGVR.Version, Resource: podsGVR.Resource, ListKind: "PodList",
+				Index: testIndexConf[store.GroupVersionResource{Version: "corev1", Resource: "pods"}], Searchable: []string{"name"}},
+			{Group: crGVR.Group, Version: crGVR.Version, Resource: crGVR.Resource, ListKind: "FooList",
+				Index: map[string]string{"namespace": "{.metadata.namespace}", "name": "{.metadata.name}"}},
+		},
+	})
+	conf := map[store.GroupVersionResource]map[string]string{
+		podsGVR: testIndexConf[store.GroupVersionResource{Version: "corev1", Resource: "pods"}],
+		crGVR:   {"namespace": "{.metadata.namespace}", "name": "{.metadata.name}"},
+	}
+	m := NewMemoryStore(conf, WithSearchable(map[store.GroupVersionResource][]string{podsGVR: {"name"}}))
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "c1", testPod("pod-1")))
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "c2", testPod("pod-2")))
+	foo := &unstructured.Unstructured{}
+	foo.SetAPIVersion("example.io/v1")
+	foo.SetKind("Foo")
+	foo.SetNamespace("test")
+	foo.SetName("foo-1")
+	assert.NoError(t, m.OnResourceAdded(crGVR, "c1", foo))
+	assert.NoError(t, m.OnResourceVersion(podsGVR, "c1", "10"))
+
+	buf := bytes.NewBuffer(nil)
+	assert.NoError(t, m.Dump(buf))
+	header, loaded, err := LoadDump(buf, common.CacheLimit{})
+	assert.NoError(t, err)
+	assert.Equal(t, "c1", header.DefaultCluster)
+	assert.Len(t, header.Proxies, 2)
+	assert.Equal(t, m.Status().Objects, loaded.Status().Objects)
+	assert.Equal(t, m.Status().Bytes, loaded.Status().Bytes)
+
+	// typed objects are decoded to their types
+	pod, ok := loaded.Get(podsGVR, "c2", "test", "pod-2").(*corev1.Pod)
+	if assert.True(t, ok) {
+		assert.Equal(t, "pod-2", pod.Name)
+	}
+	_, ok = loaded.Get(crGVR, "c1", "test", "foo-1").(*unstructured.Unstructured)
+	assert.True(t, ok)
+
+	query := store.Query{Paginate: page.Paginate{Search: "__ckube_fts__:pod"}}
+	_ = query.Clusters([]string{"c1", "c2"})
+	expected := m.Query(podsGVR, query)
+	res := loaded.Query(podsGVR, query)
+	assert.NoError(t, res.Error)
+	assert.Equal(t, int64(2), res.Total)
+	assert.Equal(t, expected.Items, res.Items)
+
+	assert.NoError(t, loaded.WaitResourceVersion(context.Background(), podsGVR, "c1", "10"))
+	c := loaded.(*memoryStore).resources.Get(podsGVR).clusters.Get("c1")
+	assert.Equal(t, uint64(10), atomic.LoadUint64(&c.watermark))
+
+	_, _, err = LoadDump(bytes.NewBufferString("not a dump"), common.CacheLimit{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,142 @@
+package memory
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// textIndex is an inverted index of the tokens in the searchable index fields of a gvr.
+type textIndex struct {
+	lock   sync.RWMutex
+	fields []string
+	// terms term - object key - fields contain the term
+	terms map[string]map[string][]string
+	// objTerms object key - terms of the object, used to remove the object from terms
+	objTerms map[string][]string
+}
+
+// textMatch is the result of full text search for an object.
+type textMatch struct {
+	score int
+	// fields index field - matched query terms
+	fields map[string][]string
+}
+
+func newTextIndex(fields []string) *textIndex {
+	return &textIndex{
+		fields:   fields,
+		terms:    map[string]map[string][]string{},
+		objTerms: map[string][]string{},
+	}
+}
+
+func objectKey(cluster, namespace, name string) string {
+	return cluster + "/" + namespace + "/" + name
+}
+
+// tokenize splits s into lower case terms by any character which is not a letter or a number.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func (t *textIndex) deleteLocked(key string) {
+	for _, term := range t.objTerms[key] {
+		delete(t.terms[term], key)
+		if len(t.terms[term]) == 0 {
+			delete(t.terms, term)
+		}
+	}
+	delete(t.objTerms, key)
+}
+
+func (t *textIndex) set(key string, index map[string]string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.deleteLocked(key)
+	terms := []string{}
+	for _, f := range t.fields {
+		for _, term := range tokenize(index[f]) {
+			if _, ok := t.terms[term]; !ok {
+				t.terms[term] = map[string][]string{}
+			}
+			if fs := t.terms[term][key]; len(fs) == 0 || fs[len(fs)-1] != f {
+				if len(fs) == 0 {
+					terms = append(terms, term)
+				}
+				t.terms[term][key] = append(fs, f)
+			}
+		}
+	}
+	t.objTerms[key] = terms
+}
+
+func (t *textIndex) delete(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.deleteLocked(key)
+}
+
+// clean removes all objects of cluster.
+func (t *textIndex) clean(cluster string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	prefix := cluster + "/"
+	for key := range t.objTerms {
+		if strings.HasPrefix(key, prefix) {
+			t.deleteLocked(key)
+		}
+	}
+}
+
+// search finds objects which contain all the query terms, a query term matches the indexed terms it prefixes.
+// An exact term matched in a field scores 2, a prefix matched scores 1.
+func (t *textIndex) search(queryTerms []string) map[string]*textMatch {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	var res map[string]*textMatch
+	for _, q := range queryTerms {
+		matched := map[string]*textMatch{}
+		for term, objs := range t.terms {
+			if !strings.HasPrefix(term, q) {
+				continue
+			}
+			score := 1
+			if term == q {
+				score = 2
+			}
+			for key, fields := range objs {
+				if res != nil && res[key] == nil {
+					continue
+				}
+				m, ok := matched[key]
+				if !ok {
+					m = &textMatch{fields: map[string][]string{}}
+					if res != nil {
+						m = res[key]
+					}
+					matched[key] = m
+				}
+				m.score += score * len(fields)
+				for _, f := range fields {
+					if fs := m.fields[f]; len(fs) == 0 || fs[len(fs)-1] != q {
+						m.fields[f] = append(fs, q)
+					}
+				}
+			}
+		}
+		res = matched
+		if len(res) == 0 {
+			break
+		}
+	}
+	for _, m := range res {
+		for _, fs := range m.fields {
+			sort.Strings(fs)
+		}
+	}
+	return res
+}
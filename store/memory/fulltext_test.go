@@ -0,0 +1,43 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenize(t *testing.T) {
+	assert.Equal(t, []string{"nginx", "web", "v1", "2"}, tokenize("Nginx-web:v1.2"))
+	assert.Equal(t, []string{"中文", "test"}, tokenize("中文 test"))
+	assert.Empty(t, tokenize(" -_/"))
+}
+
+func TestTextIndex(t *testing.T) {
+	ti := newTextIndex([]string{"name", "image"})
+	ti.set("c1/test/web", map[string]string{"name": "web", "image": "nginx:1.21", "other": "redis"})
+	ti.set("c1/test/web-redis", map[string]string{"name": "web-redis", "image": "redis:6"})
+	ti.set("c2/test/nginx", map[string]string{"name": "nginx", "image": "nginx"})
+
+	res := ti.search([]string{"redis"})
+	assert.Len(t, res, 1)
+	assert.Equal(t, map[string][]string{"name": {"redis"}, "image": {"redis"}}, res["c1/test/web-redis"].fields)
+	assert.Equal(t, 4, res["c1/test/web-redis"].score)
+
+	res = ti.search([]string{"web", "ngi"})
+	assert.Len(t, res, 1)
+	assert.Equal(t, map[string][]string{"name": {"web"}, "image": {"ngi"}}, res["c1/test/web"].fields)
+	assert.Equal(t, 3, res["c1/test/web"].score)
+
+	res = ti.search([]string{"nginx"})
+	assert.Len(t, res, 2)
+	assert.Equal(t, 4, res["c2/test/nginx"].score)
+	assert.Equal(t, 2, res["c1/test/web"].score)
+
+	ti.set("c1/test/web", map[string]string{"name": "web", "image": "httpd"})
+	assert.Len(t, ti.search([]string{"nginx"}), 1)
+	ti.delete("c1/test/web-redis")
+	assert.Len(t, ti.search([]string{"redis"}), 0)
+	ti.clean("c2")
+	assert.Len(t, ti.search([]string{"nginx"}), 0)
+	assert.Len(t, ti.search([]string{"web"}), 1)
+}
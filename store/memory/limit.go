@@ -0,0 +1,432 @@
+package memory
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/common/constants"
+	"github.com/DaoCloud/ckube/log"
+	"github.com/DaoCloud/ckube/store"
+	"github.com/DaoCloud/ckube/utils/prommonitor"
+)
+
+// cacheMode is how the objects of a gvr are cached.
+const (
+	modeFull int32 = iota
+	modeMetadataOnly
+	modePassthrough
+	modeRefused
+)
+
+var modeNames = map[int32]string{
+	modeFull:         store.ModeFull,
+	modeMetadataOnly: store.ModeMetadataOnly,
+	modePassthrough:  store.ModePassthrough,
+	modeRefused:      store.ModeRefused,
+}
+
+// limits bounds the objects held by the store.
+type limits struct {
+	global common.CacheLimit
+	// resources limits of each gvr, the gvrs added at runtime are only bounded by the global limit.
+	resources map[store.GroupVersionResource]common.CacheLimit
+	// metadataOnly is set once the global limit with metadata only policy is exceeded.
+	metadataOnly int32
+	// lock serializes the enforcement of limits once they are exceeded.
+	lock sync.Mutex
+}
+
+// WithLimits bounds all objects by global and the objects of each gvr by resources.
+func WithLimits(global common.CacheLimit, resources map[store.GroupVersionResource]common.CacheLimit) Option {
+	return func(m *memoryStore) {
+		m.limits.global = global.WithDefaults()
+		m.limits.resources = map[store.GroupVersionResource]common.CacheLimit{}
+		for gvr, l := range resources {
+			if l.Enabled() {
+				m.limits.resources[gvr] = l.WithDefaults()
+			}
+		}
+		m.resources.ForEach(func(gvr store.GroupVersionResource, g *gvrStore) {
+			m.initLimit(gvr, g)
+		})
+	}
+}
+
+// initLimit sets the limit of g, it must be called before g is shared.
+func (m *memoryStore) initLimit(gvr store.GroupVersionResource, g *gvrStore) {
+	g.limit = m.limits.resources[gvr]
+	if (g.limit.Enabled() && g.limit.Policy == common.LimitPolicyEvictOldest) ||
+		(m.limits.global.Enabled() && m.limits.global.Policy == common.LimitPolicyEvictOldest) {
+		g.queue = &evictQueue{}
+	}
+}
+
+func (g *gvrStore) getMode() int32 {
+	return atomic.LoadInt32(&g.mode)
+}
+
+// cached reports whether the objects of g are cached.
+func (g *gvrStore) cached() bool {
+	mode := g.getMode()
+	return mode == modeFull || mode == modeMetadataOnly
+}
+
+func (m *memoryStore) setMode(gvr store.GroupVersionResource, g *gvrStore, mode int32) {
+	old := atomic.SwapInt32(&g.mode, mode)
+	if old == mode {
+		return
+	}
+	log.Warnf("memory store: cache limit exceeded, resource %v is cached as %s", gvr, modeNames[mode])
+	prommonitor.CacheMode.WithLabelValues(gvr.Group, gvr.Version, gvr.Resource, modeNames[old]).Set(0)
+	prommonitor.CacheMode.WithLabelValues(gvr.Group, gvr.Version, gvr.Resource, modeNames[mode]).Set(1)
+}
+
+// addUsage accounts the change of objects of gvr in cluster c.
+func (m *memoryStore) addUsage(gvr store.GroupVersionResource, g *gvrStore, c *clusterStore, objects, bytes int64) {
+	c.usage.add(objects, bytes)
+	g.usage.add(objects, bytes)
+	m.usage.add(objects, bytes)
+	gvrObjects, gvrBytes := g.usage.load()
+	prommonitor.CacheObjects.WithLabelValues(gvr.Group, gvr.Version, gvr.Resource).Set(float64(gvrObjects))
+	prommonitor.CacheBytes.WithLabelValues(gvr.Group, gvr.Version, gvr.Resource).Set(float64(gvrBytes))
+}
+
+// refuse reports whether the objects of g should be refused, because g starts caching after the global limit
+// is exceeded. It's decided by the first object stored, g is not refused after its objects are cleaned.
+func (m *memoryStore) refuse(gvr store.GroupVersionResource, g *gvrStore) bool {
+	if atomic.LoadInt32(&g.admitted) == 1 {
+		return false
+	}
+	if m.limits.global.Policy == common.LimitPolicyRefuse && m.limits.global.Exceeded(m.usage.load()) {
+		m.drop(gvr, g, modeRefused)
+		return true
+	}
+	atomic.StoreInt32(&g.admitted, 1)
+	return false
+}
+
+// enforce applies the policies of the limits exceeded after the objects of gvr are changed.
+func (m *memoryStore) enforce(gvr store.GroupVersionResource, g *gvrStore) {
+	gvrExceeded := g.limit.Exceeded(g.usage.load())
+	globalExceeded := m.limits.global.Exceeded(m.usage.load())
+	if !gvrExceeded && !globalExceeded {
+		return
+	}
+	m.limits.lock.Lock()
+	defer m.limits.lock.Unlock()
+	if gvrExceeded {
+		switch g.limit.Policy {
+		case common.LimitPolicyMetadataOnly:
+			if g.getMode() == modeFull {
+				m.cacheMetadataOnly(gvr, g)
+			}
+		case common.LimitPolicyEvictOldest:
+			for g.limit.Exceeded(g.usage.load()) && m.evictOldest(gvr, g) {
+			}
+		case common.LimitPolicyPassthrough:
+			m.drop(gvr, g, modePassthrough)
+		default:
+			m.drop(gvr, g, modeRefused)
+		}
+	}
+	if !globalExceeded {
+		return
+	}
+	switch m.limits.global.Policy {
+	case common.LimitPolicyMetadataOnly:
+		if atomic.CompareAndSwapInt32(&m.limits.metadataOnly, 0, 1) {
+			log.Warnf("memory store: cache limit exceeded, only metadata of objects are cached")
+		}
+		m.resources.ForEach(func(gvr store.GroupVersionResource, g *gvrStore) {
+			if g.getMode() == modeFull {
+				m.cacheMetadataOnly(gvr, g)
+			}
+		})
+	case common.LimitPolicyEvictOldest:
+		for m.limits.global.Exceeded(m.usage.load()) {
+			lgvr, lg := m.largest()
+			if lg == nil || !m.evictOldest(lgvr, lg) {
+				break
+			}
+		}
+	case common.LimitPolicyPassthrough:
+		for m.limits.global.Exceeded(m.usage.load()) {
+			lgvr, lg := m.largest()
+			if lg == nil {
+				break
+			}
+			m.drop(lgvr, lg, modePassthrough)
+		}
+	}
+}
+
+// largest returns the cached gvr which holds the most bytes, or objects if bytes are not limited.
+func (m *memoryStore) largest() (store.GroupVersionResource, *gvrStore) {
+	var (
+		largestGVR store.GroupVersionResource
+		largest    *gvrStore
+		max        int64
+	)
+	m.resources.ForEach(func(gvr store.GroupVersionResource, g *gvrStore) {
+		if !g.cached() {
+			return
+		}
+		objects, bytes := g.usage.load()
+		v := objects
+		if m.limits.global.MaxBytes > 0 {
+			v = bytes
+		}
+		if v > max {
+			largestGVR, largest, max = gvr, g, v
+		}
+	})
+	return largestGVR, largest
+}
+
+// cacheMetadataOnly caches only the metadata of the objects of g, the cached objects are replaced by their metadata.
+func (m *memoryStore) cacheMetadataOnly(gvr store.GroupVersionResource, g *gvrStore) {
+	// the writers check the mode under the read lock, no full object is stored after it's switched
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.getMode() != modeFull {
+		return
+	}
+	m.setMode(gvr, g, modeMetadataOnly)
+	g.clusters.ForEach(func(_ clusterName, c *clusterStore) {
+		for i := range c.shards {
+			if freed := c.shards[i].toMetadataOnly(gvr); freed != 0 {
+				m.addUsage(gvr, g, c, 0, -freed)
+			}
+		}
+	})
+	m.queryCache.invalidate(gvr)
+}
+
+// drop stops caching g, the requests of it are passed to api servers.
+func (m *memoryStore) drop(gvr store.GroupVersionResource, g *gvrStore, mode int32) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	m.setMode(gvr, g, mode)
+	g.clusters.ForEach(func(cname clusterName, c *clusterStore) {
+		objects, bytes := c.usage.load()
+		m.addUsage(gvr, g, c, -objects, -bytes)
+		if g.text != nil {
+			g.text.clean(string(cname))
+		}
+		c.counts.Range(func(ns, _ interface{}) bool {
+			prommonitor.Resources.WithLabelValues(string(cname), gvr.Group, gvr.Version, gvr.Resource, string(ns.(namespaceName))).Set(0)
+			return true
+		})
+	})
+	g.clusters.Clear()
+	if g.queue != nil {
+		g.queue.clear()
+	}
+	m.queryCache.invalidate(gvr)
+}
+
+// evictOldest evicts the least recently updated object of g, it returns false if g has no objects to evict.
+func (m *memoryStore) evictOldest(gvr store.GroupVersionResource, g *gvrStore) bool {
+	if g.queue == nil {
+		return false
+	}
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	if !g.cached() {
+		return false
+	}
+	for {
+		k, ok := g.queue.pop()
+		if !ok {
+			return false
+		}
+		c := g.clusters.Get(k.cluster)
+		if c == nil {
+			continue
+		}
+		e := c.shard(k.namespace, k.name).evict(k.namespace, k.name, k.seq)
+		if e == nil {
+			// updated or deleted since queued
+			continue
+		}
+		m.addUsage(gvr, g, c, -1, -e.size)
+		prommonitor.Resources.WithLabelValues(string(k.cluster), gvr.Group, gvr.Version, gvr.Resource, string(k.namespace)).
+			Set(float64(c.count(k.namespace, -1)))
+		if g.text != nil {
+			g.text.delete(objectKey(string(k.cluster), string(k.namespace), k.name))
+		}
+		atomic.AddInt64(&g.evicted, 1)
+		prommonitor.CacheEvicted.WithLabelValues(gvr.Group, gvr.Version, gvr.Resource).Inc()
+		m.queryCache.invalidate(gvr)
+		return true
+	}
+}
+
+type evictKey struct {
+	cluster   clusterName
+	namespace namespaceName
+	name      string
+	seq       uint64
+}
+
+// evictQueue queues the objects in the order they are stored, an object is queued again when it's
+// updated, the stale keys are skipped when popped.
+type evictQueue struct {
+	lock sync.Mutex
+	keys []evictKey
+	head int
+}
+
+func (q *evictQueue) push(k evictKey, live func(k evictKey) bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.keys = append(q.keys, k)
+	if q.head > len(q.keys)/2 {
+		q.keys = append(q.keys[:0], q.keys[q.head:]...)
+		q.head = 0
+	}
+	if len(q.keys) >= 1024 && len(q.keys) == cap(q.keys) {
+		// drop the stale keys before the queue grows
+		keys := q.keys[:0]
+		for _, k := range q.keys[q.head:] {
+			if live(k) {
+				keys = append(keys, k)
+			}
+		}
+		q.keys = keys
+		q.head = 0
+	}
+}
+
+func (q *evictQueue) pop() (evictKey, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.head >= len(q.keys) {
+		return evictKey{}, false
+	}
+	k := q.keys[q.head]
+	q.head++
+	return k, true
+}
+
+func (q *evictQueue) clear() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.keys = nil
+	q.head = 0
+}
+
+// enqueue queues the object stored as e for eviction.
+func (g *gvrStore) enqueue(cluster, ns, name string, e *entry) {
+	if g.queue == nil {
+		return
+	}
+	g.queue.push(evictKey{
+		cluster:   clusterName(cluster),
+		namespace: namespaceName(ns),
+		name:      name,
+		seq:       e.seq,
+	}, func(k evictKey) bool {
+		c := g.clusters.Get(k.cluster)
+		if c == nil {
+			return false
+		}
+		e := c.shard(k.namespace, k.name).get(k.namespace, k.name)
+		return e != nil && e.seq == k.seq
+	})
+}
+
+// metadataOnly returns the metadata of obj without managedFields, the kind of obj is filled by gvr if it's not set.
+func metadataOnly(gvr store.GroupVersionResource, obj interface{}) interface{} {
+	oo, ok := obj.(v1.Object)
+	if !ok {
+		return obj
+	}
+	p := &v1.PartialObjectMetadata{
+		ObjectMeta: v1.ObjectMeta{
+			Name:              oo.GetName(),
+			GenerateName:      oo.GetGenerateName(),
+			Namespace:         oo.GetNamespace(),
+			UID:               oo.GetUID(),
+			ResourceVersion:   oo.GetResourceVersion(),
+			Generation:        oo.GetGeneration(),
+			CreationTimestamp: oo.GetCreationTimestamp(),
+			DeletionTimestamp: oo.GetDeletionTimestamp(),
+			Labels:            oo.GetLabels(),
+			Annotations:       oo.GetAnnotations(),
+			OwnerReferences:   oo.GetOwnerReferences(),
+			Finalizers:        oo.GetFinalizers(),
+		},
+	}
+	if ro, ok := obj.(runtime.Object); ok {
+		p.APIVersion, p.Kind = ro.GetObjectKind().GroupVersionKind().ToAPIVersionAndKind()
+	}
+	if p.Kind == "" {
+		p.APIVersion = gvr.Version
+		if gvr.Group != "" {
+			p.APIVersion = gvr.Group + "/" + gvr.Version
+		}
+		p.Kind = strings.TrimSuffix(common.GetGVRKind(gvr.Group, gvr.Version, gvr.Resource), "List")
+	}
+	return p
+}
+
+// toMetadataOnly replaces the object of e by its metadata.
+func toMetadataOnly(gvr store.GroupVersionResource, e *entry) {
+	e.Obj = metadataOnly(gvr, e.Obj)
+	bs, _ := json.Marshal(e.Obj)
+	e.size = int64(len(bs))
+	anno := make(map[string]string, len(e.Annotations)+1)
+	for k, v := range e.Annotations {
+		anno[k] = v
+	}
+	anno[constants.MetadataOnlyAnno] = "true"
+	e.Annotations = anno
+}
+
+func (m *memoryStore) Status() store.Status {
+	objects, bytes := m.usage.load()
+	s := store.Status{
+		Objects:    objects,
+		Bytes:      bytes,
+		MaxObjects: m.limits.global.MaxObjects,
+		MaxBytes:   m.limits.global.MaxBytes,
+		Resources:  []store.ResourceStatus{},
+	}
+	if m.limits.global.Enabled() {
+		s.Policy = m.limits.global.Policy
+	}
+	m.resources.ForEach(func(gvr store.GroupVersionResource, g *gvrStore) {
+		objects, bytes := g.usage.load()
+		s.Resources = append(s.Resources, store.ResourceStatus{
+			Group:      gvr.Group,
+			Version:    gvr.Version,
+			Resource:   gvr.Resource,
+			Objects:    objects,
+			Bytes:      bytes,
+			Evicted:    atomic.LoadInt64(&g.evicted),
+			Mode:       modeNames[g.getMode()],
+			MaxObjects: g.limit.MaxObjects,
+			MaxBytes:   g.limit.MaxBytes,
+			Policy:     g.limit.Policy,
+		})
+	})
+	sort.Slice(s.Resources, func(i, j int) bool {
+		ri, rj := s.Resources[i], s.Resources[j]
+		if ri.Group != rj.Group {
+			return ri.Group < rj.Group
+		}
+		if ri.Version != rj.Version {
+			return ri.Version < rj.Version
+		}
+		return ri.Resource < rj.Resource
+	})
+	return s
+}
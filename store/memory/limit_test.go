@@ -0,0 +1,198 @@
+package memory
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/common/constants"
+	"github.com/DaoCloud/ckube/store"
+)
+
+func limitedStore(global common.CacheLimit, pods common.CacheLimit) *memoryStore {
+	return NewMemoryStore(testIndexConf, WithLimits(global, map[store.GroupVersionResource]common.CacheLimit{
+		podsGVR: pods,
+	})).(*memoryStore)
+}
+
+func resourceStatus(m store.Store, gvr store.GroupVersionResource) store.ResourceStatus {
+	for _, r := range m.Status().Resources {
+		if r.Group == gvr.Group && r.Version == gvr.Version && r.Resource == gvr.Resource {
+			return r
+		}
+	}
+	return store.ResourceStatus{}
+}
+
+func TestMemoryStore_LimitRefuse(t *testing.T) {
+	m := limitedStore(common.CacheLimit{MaxObjects: 2}, common.CacheLimit{})
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-"+strconv.Itoa(i))))
+	}
+	// the resources cached before are not refused
+	assert.Equal(t, int64(3), resourceStatus(m, podsGVR).Objects)
+	assert.Equal(t, store.ModeFull, resourceStatus(m, podsGVR).Mode)
+
+	assert.NoError(t, m.OnResourceAdded(depsGVR, "test", testPod("dep-1")))
+	assert.Equal(t, store.ModeRefused, resourceStatus(m, depsGVR).Mode)
+	assert.False(t, m.IsStoreGVR(depsGVR))
+	assert.Nil(t, m.Get(depsGVR, "test", "test", "dep-1"))
+	assert.NoError(t, m.Clean(depsGVR, "test"))
+
+	gvr := store.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+	assert.Error(t, m.AddResource(gvr, map[string]string{}, nil))
+	assert.False(t, m.IsStoreGVR(gvr))
+
+	// the limit of a resource refuses the resource itself
+	m = limitedStore(common.CacheLimit{}, common.CacheLimit{MaxObjects: 1})
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-1")))
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-2")))
+	assert.False(t, m.IsStoreGVR(podsGVR))
+	assert.Equal(t, int64(0), m.Status().Objects)
+}
+
+func TestMemoryStore_LimitRefuseClean(t *testing.T) {
+	m := limitedStore(common.CacheLimit{MaxObjects: 2}, common.CacheLimit{})
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-1")))
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, m.OnResourceAdded(depsGVR, "test", testPod("dep-"+strconv.Itoa(i))))
+	}
+	// the watcher cleans the objects when it reconnects, the global limit is still exceeded by deployments
+	assert.NoError(t, m.Clean(podsGVR, "test"))
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-1")))
+	assert.Equal(t, store.ModeFull, resourceStatus(m, podsGVR).Mode)
+	assert.NotNil(t, m.Get(podsGVR, "test", "test", "pod-1"))
+}
+
+func TestMemoryStore_DropRace(t *testing.T) {
+	for i, c := range []struct {
+		name string
+		drop func(m *memoryStore)
+	}{
+		{
+			name: "drop",
+			drop: func(m *memoryStore) {
+				m.drop(podsGVR, m.resources.Get(podsGVR), modePassthrough)
+			},
+		},
+		{
+			name: "remove resource",
+			drop: func(m *memoryStore) {
+				assert.NoError(t, m.RemoveResource(podsGVR))
+			},
+		},
+	} {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			m := limitedStore(common.CacheLimit{}, common.CacheLimit{})
+			assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-1")))
+			// a writer gets the store of pods before the objects are dropped, and stores the object after
+			g, err := m.cachedResource(podsGVR)
+			assert.NoError(t, err)
+			ns, name, o, size := m.buildResourceWithIndex(podsGVR, "test", testPod("pod-2"))
+			c.drop(m)
+			m.setObject(podsGVR, g, "test", ns, name, o, size)
+
+			assert.Equal(t, int64(0), m.Status().Objects)
+			if c := g.clusters.Get("test"); c != nil {
+				assert.Nil(t, c.shard("test", "pod-2").get("test", "pod-2"))
+			}
+		})
+	}
+}
+
+func TestMemoryStore_LimitMetadataOnly(t *testing.T) {
+	common.InitConfig(&common.Config{Proxies: []common.Proxy{
+		{Version: podsGVR.Version, Resource: podsGVR.Resource, ListKind: "PodList"},
+	}})
+	m := limitedStore(common.CacheLimit{}, common.CacheLimit{MaxObjects: 1, Policy: common.LimitPolicyMetadataOnly})
+	pod := func(name string) interface{} {
+		p := testPod(name)
+		p.Spec.NodeName = "node-1"
+		p.ManagedFields = []v1.ManagedFieldsEntry{{Manager: "test"}}
+		return p
+	}
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", pod("pod-1")))
+	full := resourceStatus(m, podsGVR).Bytes
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", pod("pod-2")))
+	s := resourceStatus(m, podsGVR)
+	assert.Equal(t, store.ModeMetadataOnly, s.Mode)
+	// the objects cached before are replaced by their metadata
+	assert.Less(t, s.Bytes, 2*full)
+	assert.Equal(t, s.Bytes, m.Status().Bytes)
+	_, ok := m.Get(podsGVR, "test", "test", "pod-1").(*v1.PartialObjectMetadata)
+	assert.True(t, ok)
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", pod("pod-3")))
+
+	o := m.Get(podsGVR, "test", "test", "pod-3")
+	p, ok := o.(*v1.PartialObjectMetadata)
+	if assert.True(t, ok) {
+		assert.Equal(t, "pod-3", p.Name)
+		assert.Equal(t, "Pod", p.Kind)
+		assert.Empty(t, p.ManagedFields)
+		assert.Equal(t, "true", p.Annotations[constants.MetadataOnlyAnno])
+	}
+	// the index is built from the whole object
+	res := m.Query(podsGVR, store.Query{Namespace: "test"})
+	assert.NoError(t, res.Error)
+	assert.Equal(t, int64(3), res.Total)
+	assert.True(t, m.IsStoreGVR(podsGVR))
+}
+
+func TestMemoryStore_LimitEvictOldest(t *testing.T) {
+	m := limitedStore(common.CacheLimit{}, common.CacheLimit{MaxObjects: 2, Policy: common.LimitPolicyEvictOldest})
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-1")))
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-2")))
+	// pod-1 is updated after pod-2
+	assert.NoError(t, m.OnResourceModified(podsGVR, "test", testPod("pod-1")))
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-3")))
+	assert.NotNil(t, m.Get(podsGVR, "test", "test", "pod-1"))
+	assert.Nil(t, m.Get(podsGVR, "test", "test", "pod-2"))
+	assert.NotNil(t, m.Get(podsGVR, "test", "test", "pod-3"))
+	s := resourceStatus(m, podsGVR)
+	assert.Equal(t, int64(2), s.Objects)
+	assert.Equal(t, int64(1), s.Evicted)
+
+	// the global limit evicts the largest resource
+	m = limitedStore(common.CacheLimit{MaxObjects: 3, Policy: common.LimitPolicyEvictOldest}, common.CacheLimit{})
+	assert.NoError(t, m.OnResourceAdded(depsGVR, "test", testPod("dep-1")))
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-"+strconv.Itoa(i))))
+	}
+	assert.Equal(t, int64(3), m.Status().Objects)
+	assert.NotNil(t, m.Get(depsGVR, "test", "test", "dep-1"))
+	assert.Nil(t, m.Get(podsGVR, "test", "test", "pod-0"))
+}
+
+func TestMemoryStore_LimitPassthrough(t *testing.T) {
+	m := limitedStore(common.CacheLimit{MaxBytes: 1, Policy: common.LimitPolicyPassthrough}, common.CacheLimit{})
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-1")))
+	assert.False(t, m.IsStoreGVR(podsGVR))
+	assert.Equal(t, store.ModePassthrough, resourceStatus(m, podsGVR).Mode)
+	s := m.Status()
+	assert.Equal(t, int64(0), s.Bytes)
+	assert.Equal(t, int64(1), s.MaxBytes)
+	assert.Equal(t, common.LimitPolicyPassthrough, s.Policy)
+	// the events are ignored
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-2")))
+	assert.Nil(t, m.Get(podsGVR, "test", "test", "pod-2"))
+	assert.Error(t, m.Query(podsGVR, store.Query{}).Error)
+}
+
+func TestMemoryStore_Usage(t *testing.T) {
+	m := NewMemoryStore(testIndexConf)
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-1")))
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-2")))
+	s := resourceStatus(m, podsGVR)
+	assert.Equal(t, int64(2), s.Objects)
+	assert.Greater(t, s.Bytes, int64(0))
+	assert.Equal(t, store.ModeFull, s.Mode)
+	assert.NoError(t, m.OnResourceDeleted(podsGVR, "test", testPod("pod-1")))
+	assert.Equal(t, int64(1), m.Status().Objects)
+	assert.Equal(t, s.Bytes/2, m.Status().Bytes)
+	assert.NoError(t, m.Clean(podsGVR, "test"))
+	assert.Equal(t, store.Status{Resources: m.Status().Resources}, m.Status())
+}
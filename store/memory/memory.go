@@ -9,312 +9,740 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
+	"time"
 
-	"github.com/samber/lo"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/util/jsonpath"
 
+	"github.com/DaoCloud/ckube/common"
 	"github.com/DaoCloud/ckube/common/constants"
 	"github.com/DaoCloud/ckube/log"
 	"github.com/DaoCloud/ckube/store"
+	"github.com/DaoCloud/ckube/store/relation"
 	"github.com/DaoCloud/ckube/utils"
 	"github.com/DaoCloud/ckube/utils/prommonitor"
 )
 
-type syncResourceStore[K comparable, V any] struct {
-	lock      sync.RWMutex
-	resources map[K]*V
+type clusterName string
+
+type namespaceName string
+
+type memoryStore struct {
+	// confLock serializes adding resources at runtime.
+	confLock sync.Mutex
+	// resources gvr - clusterName - shard - namespaceName - name, the maps of gvrs and clusters
+	// are copy-on-write so that they are looked up without locks.
+	resources cowMap[store.GroupVersionResource, gvrStore]
+	// versions resourceVersion observed by watchers
+	versions versionTracker
+	// queryCache caches the query results for a short time
+	queryCache queryCache
+	// snapshots pins the results of paginated queries for the following pages
+	snapshots snapshots
+	limits    limits
+	// usage of all objects
+	usage usage
+	// seq is increased when an object is stored
+	seq uint64
+	store.Store
 }
 
-func (s *syncResourceStore[K, V]) Set(key K, value V) {
-	s.lock.Lock()
-	if s.resources == nil {
-		s.resources = make(map[K]*V)
+// Option configures the optional features of memory store.
+type Option func(m *memoryStore)
+
+// WithSearchable enables full text index for the searchable index fields of each gvr.
+func WithSearchable(searchable map[store.GroupVersionResource][]string) Option {
+	return func(m *memoryStore) {
+		for gvr, fields := range searchable {
+			if g := m.resources.Get(gvr); g != nil && len(fields) > 0 {
+				g.text = newTextIndex(fields)
+			}
+		}
 	}
-	s.resources[key] = &value
-	s.lock.Unlock()
 }
 
-func (s *syncResourceStore[K, V]) Init(key K) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	if s.resources == nil {
-		s.resources = make(map[K]*V)
+func NewMemoryStore(indexConf map[store.GroupVersionResource]map[string]string, opts ...Option) store.Store {
+	s := memoryStore{
+		queryCache: queryCache{ttl: defaultQueryCacheTTL},
+		snapshots:  snapshots{ttl: defaultSnapshotTTL},
 	}
-	if _, ok := s.resources[key]; ok {
-		return
+	for k, v := range indexConf {
+		s.resources.Set(k, &gvrStore{index: v})
 	}
-	s.resources[key] = new(V)
-}
-
-func (s *syncResourceStore[K, V]) Clean() {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.resources = make(map[K]*V)
-}
-
-func (s *syncResourceStore[K, V]) Get(key K) *V {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	return s.resources[key]
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return &s
 }
 
-func (s *syncResourceStore[K, V]) Exists(key K) bool {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	_, ok := s.resources[key]
-	return ok
+func (m *memoryStore) index(gvr store.GroupVersionResource) map[string]string {
+	if g := m.resources.Get(gvr); g != nil {
+		return g.index
+	}
+	return nil
 }
 
-func (s *syncResourceStore[K, V]) Delete(key K) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	delete(s.resources, key)
+func (m *memoryStore) textIndex(gvr store.GroupVersionResource) *textIndex {
+	if g := m.resources.Get(gvr); g != nil {
+		return g.text
+	}
+	return nil
 }
 
-func (s *syncResourceStore[K, V]) Values() []*V {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	return lo.Values(s.resources)
+func (m *memoryStore) AddResource(gvr store.GroupVersionResource, index map[string]string, searchable []string) error {
+	m.confLock.Lock()
+	defer m.confLock.Unlock()
+	if m.resources.Get(gvr) != nil {
+		return nil
+	}
+	g := &gvrStore{index: index}
+	if len(searchable) > 0 {
+		g.text = newTextIndex(searchable)
+	}
+	m.initLimit(gvr, g)
+	mode := modeFull
+	if atomic.LoadInt32(&m.limits.metadataOnly) == 1 {
+		mode = modeMetadataOnly
+	}
+	if m.limits.global.Policy == common.LimitPolicyRefuse && m.limits.global.Exceeded(m.usage.load()) {
+		mode = modeRefused
+	}
+	g.mode = mode
+	if mode != modeFull {
+		prommonitor.CacheMode.WithLabelValues(gvr.Group, gvr.Version, gvr.Resource, modeNames[mode]).Set(1)
+	}
+	m.resources.Set(gvr, g)
+	if mode == modeRefused {
+		return fmt.Errorf("cache limit exceeded, resource %v is refused", gvr)
+	}
+	return nil
 }
 
-func (s *syncResourceStore[K, V]) ForEach(iter func(k K, v *V)) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	for k, v := range s.resources {
-		iter(k, v)
+func (m *memoryStore) RemoveResource(gvr store.GroupVersionResource) error {
+	m.confLock.Lock()
+	defer m.confLock.Unlock()
+	g := m.resources.Get(gvr)
+	if g == nil {
+		return fmt.Errorf("resource %v is not cached", gvr)
 	}
+	m.resources.Delete(gvr)
+	g.lock.Lock()
+	// the writers which got g before it's deleted stop storing objects, the metrics of the mode are deleted below
+	atomic.StoreInt32(&g.mode, modePassthrough)
+	objects, bytes := g.usage.load()
+	m.usage.add(-objects, -bytes)
+	g.lock.Unlock()
+	m.queryCache.invalidate(gvr)
+	prommonitor.CacheObjects.DeleteLabelValues(gvr.Group, gvr.Version, gvr.Resource)
+	prommonitor.CacheBytes.DeleteLabelValues(gvr.Group, gvr.Version, gvr.Resource)
+	for _, name := range modeNames {
+		prommonitor.CacheMode.DeleteLabelValues(gvr.Group, gvr.Version, gvr.Resource, name)
+	}
+	return nil
 }
 
-func (s *syncResourceStore[K, V]) Len() int {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	return len(s.resources)
+func (m *memoryStore) IsStoreGVR(gvr store.GroupVersionResource) bool {
+	g := m.resources.Get(gvr)
+	return g != nil && g.cached()
 }
 
-type clusterName string
-
-type namespaceName string
-
-type memoryStore struct {
-	indexConf map[store.GroupVersionResource]map[string]string
-	// resourceMap gvr - clusterName - namespaceName - name
-	resourceMap syncResourceStore[
-		store.GroupVersionResource,
-		syncResourceStore[
-			clusterName,
-			syncResourceStore[
-				namespaceName,
-				syncResourceStore[string, store.Object],
-			],
-		],
-	]
-	store.Store
+func (m *memoryStore) Clean(gvr store.GroupVersionResource, cluster string) error {
+	g := m.resources.Get(gvr)
+	if g == nil {
+		return fmt.Errorf("cluster %s not exists", cluster)
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	c := g.clusters.Get(clusterName(cluster))
+	if c == nil {
+		if !g.cached() {
+			// the objects are dropped by limits
+			return nil
+		}
+		return fmt.Errorf("cluster %s not exists", cluster)
+	}
+	// the tombstones are cleaned with the objects
+	g.clusters.Set(clusterName(cluster), newClusterStore())
+	objects, bytes := c.usage.load()
+	m.addUsage(gvr, g, c, -objects, -bytes)
+	if g.text != nil {
+		g.text.clean(cluster)
+	}
+	m.queryCache.invalidate(gvr)
+	return nil
 }
 
-func NewMemoryStore(indexConf map[store.GroupVersionResource]map[string]string) store.Store {
-	s := memoryStore{
-		indexConf: indexConf,
+// resourceVersion returns the resourceVersion of obj as a number.
+// resourceVersion is opaque in kubernetes, but it is the etcd revision in practice,
+// ok is false if obj has no comparable resourceVersion.
+func resourceVersion(obj interface{}) (uint64, bool) {
+	oo, ok := obj.(v1.Object)
+	if !ok {
+		return 0, false
 	}
-	for k := range indexConf {
-		s.resourceMap.Init(k)
+	rv, err := strconv.ParseUint(oo.GetResourceVersion(), 10, 64)
+	if err != nil {
+		return 0, false
 	}
-	return &s
+	return rv, true
 }
 
-func (m *memoryStore) initResourceNamespace(gvr store.GroupVersionResource, cluster, namespace string) {
-	m.resourceMap.Get(gvr).Init(clusterName(cluster))
-	m.resourceMap.Get(gvr).Get(clusterName(cluster)).Init(namespaceName(namespace))
+// setObject stores o unless the stored object or the tombstone of it has a newer resourceVersion,
+// so that a late event can not regress the object updated by write-through.
+func (m *memoryStore) setObject(gvr store.GroupVersionResource, g *gvrStore, cluster, ns, name string, o store.Object, size int64) {
+	if m.refuse(gvr, g) {
+		return
+	}
+	if m.storeObject(gvr, g, cluster, ns, name, o, size) {
+		m.enforce(gvr, g)
+	}
 }
 
-func (m *memoryStore) IsStoreGVR(gvr store.GroupVersionResource) bool {
-	return m.resourceMap.Exists(gvr)
+// storeObject stores o if g is still cached, it reports whether o is stored.
+func (m *memoryStore) storeObject(gvr store.GroupVersionResource, g *gvrStore, cluster, ns, name string, o store.Object, size int64) bool {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	if !g.cached() {
+		// dropped by limits after the event is received
+		return false
+	}
+	e := &entry{Object: o, size: size, seq: atomic.AddUint64(&m.seq, 1)}
+	if g.getMode() == modeMetadataOnly {
+		toMetadataOnly(gvr, e)
+	}
+	c := g.cluster(cluster)
+	set, old, freed := c.shard(namespaceName(ns), name).set(namespaceName(ns), name, e)
+	if freed > 0 {
+		m.addUsage(gvr, g, c, 0, -freed)
+	}
+	if !set {
+		log.Debugf("memory store: ignore stale resource %v %s/%s/%s", gvr, cluster, ns, name)
+		return false
+	}
+	if g.text != nil {
+		g.text.set(objectKey(cluster, ns, name), o.Index)
+	}
+	m.queryCache.invalidate(gvr)
+	if old == nil {
+		m.addUsage(gvr, g, c, 1, e.size)
+		prommonitor.Resources.WithLabelValues(cluster, gvr.Group, gvr.Version, gvr.Resource, ns).
+			Set(float64(c.count(namespaceName(ns), 1)))
+	} else {
+		m.addUsage(gvr, g, c, 0, e.size-old.size)
+	}
+	g.enqueue(cluster, ns, name, e)
+	return true
 }
 
-func (m *memoryStore) Clean(gvr store.GroupVersionResource, cluster string) error {
-	if !m.resourceMap.Get(gvr).Exists(clusterName(cluster)) {
-		return fmt.Errorf("cluster %s not exists", cluster)
+// cachedResource returns the store of gvr, the store is nil if the objects of gvr are not cached.
+func (m *memoryStore) cachedResource(gvr store.GroupVersionResource) (*gvrStore, error) {
+	g := m.resources.Get(gvr)
+	if g == nil {
+		return nil, fmt.Errorf("resource %v is not cached", gvr)
 	}
-	for _, c := range m.resourceMap.Get(gvr).Get(clusterName(cluster)).Values() {
-		c.Clean()
+	if !g.cached() {
+		// dropped by limits, the events are ignored
+		return nil, nil
 	}
-	return nil
+	return g, nil
 }
 
 func (m *memoryStore) OnResourceAdded(gvr store.GroupVersionResource, cluster string, obj interface{}) error {
-	ns, name, o := m.buildResourceWithIndex(gvr, cluster, obj)
-	m.initResourceNamespace(gvr, cluster, ns)
-	m.resourceMap.Get(gvr).Get(clusterName(cluster)).Get(namespaceName(ns)).Set(name, o)
-	prommonitor.Resources.WithLabelValues(cluster, gvr.Group, gvr.Version, gvr.Resource, ns).
-		Set(float64(m.resourceMap.Get(gvr).Get(clusterName(cluster)).Get(namespaceName(ns)).Len()))
+	g, err := m.cachedResource(gvr)
+	if g == nil {
+		return err
+	}
+	ns, name, o, size := m.buildResourceWithIndex(gvr, cluster, obj)
+	m.setObject(gvr, g, cluster, ns, name, o, size)
 	return nil
 }
 
 func (m *memoryStore) OnResourceModified(gvr store.GroupVersionResource, cluster string, obj interface{}) error {
-	ns, name, o := m.buildResourceWithIndex(gvr, cluster, obj)
-	m.initResourceNamespace(gvr, cluster, ns)
-	m.resourceMap.Get(gvr).Get(clusterName(cluster)).Get(namespaceName(ns)).Set(name, o)
-	prommonitor.Resources.WithLabelValues(cluster, gvr.Group, gvr.Version, gvr.Resource, ns).
-		Set(float64(m.resourceMap.Get(gvr).Get(clusterName(cluster)).Get(namespaceName(ns)).Len()))
+	g, err := m.cachedResource(gvr)
+	if g == nil {
+		return err
+	}
+	ns, name, o, size := m.buildResourceWithIndex(gvr, cluster, obj)
+	m.setObject(gvr, g, cluster, ns, name, o, size)
 	return nil
 }
 
 func (m *memoryStore) OnResourceDeleted(gvr store.GroupVersionResource, cluster string, obj interface{}) error {
-	ns, name, _ := m.buildResourceWithIndex(gvr, cluster, obj)
-	m.initResourceNamespace(gvr, cluster, ns)
-	m.resourceMap.Get(gvr).Get(clusterName(cluster)).Get(namespaceName(ns)).Delete(name)
+	g, err := m.cachedResource(gvr)
+	if g == nil {
+		return err
+	}
+	ns, name, _, _ := m.buildResourceWithIndex(gvr, cluster, obj)
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	if !g.cached() {
+		return nil
+	}
+	c := g.cluster(cluster)
+	rv, rvOk := resourceVersion(obj)
+	old, tombstones := c.shard(namespaceName(ns), name).delete(namespaceName(ns), name, rv, rvOk, atomic.LoadUint64(&c.watermark))
+	if tombstones != 0 {
+		m.addUsage(gvr, g, c, 0, tombstones)
+	}
+	if old == nil {
+		return nil
+	}
+	if g.text != nil {
+		g.text.delete(objectKey(cluster, ns, name))
+	}
+	m.queryCache.invalidate(gvr)
+	m.addUsage(gvr, g, c, -1, -old.size)
 	prommonitor.Resources.WithLabelValues(cluster, gvr.Group, gvr.Version, gvr.Resource, ns).
-		Set(float64(m.resourceMap.Get(gvr).Get(clusterName(cluster)).Get(namespaceName(ns)).Len()))
+		Set(float64(c.count(namespaceName(ns), -1)))
 	return nil
 }
 
+const defaultSort = "cluster, namespace, name"
+
 type innerSort struct {
-	key     string
+	key string
+	// path is the parsed ad-hoc jsonpath of key if the key is not a configured index.
+	path    *jsonpath.JSONPath
 	typ     string
 	reverse bool
+	// nullsFirst places empty values before others regardless of reverse, default is last.
+	nullsFirst bool
+}
+
+// splitSorts splits sort expressions by `,` out of jsonpath braces.
+func splitSorts(s string) []string {
+	res := []string{}
+	depth := 0
+	start := 0
+	for i, c := range s {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				res = append(res, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(res, s[start:])
+}
+
+// parseSort parses a single sort expression such as `name`, `replicas!int desc` or `{.status.startTime} desc`.
+func (m *memoryStore) parseSort(gvr store.GroupVersionResource, s string, checkKeyMap map[string]string) (innerSort, error) {
+	st := innerSort{
+		reverse: false,
+		typ:     constants.KeyTypeStr,
+	}
+	key := s
+	modifiers := ""
+	if strings.HasPrefix(s, "{") {
+		end := strings.LastIndex(s, "}")
+		if end < 0 {
+			return st, fmt.Errorf("error sort format `%s`", s)
+		}
+		key = s[:end+1]
+		modifiers = s[end+1:]
+	} else if i := strings.IndexAny(s, " "+constants.KeyTypeSep); i >= 0 {
+		key = s[:i]
+		modifiers = s[i:]
+	}
+	if strings.HasPrefix(modifiers, constants.KeyTypeSep) {
+		typ := strings.TrimPrefix(modifiers, constants.KeyTypeSep)
+		modifiers = ""
+		if i := strings.Index(typ, " "); i >= 0 {
+			modifiers = typ[i:]
+			typ = typ[:i]
+		}
+		switch typ {
+		case constants.KeyTypeInt:
+			st.typ = constants.KeyTypeInt
+		case constants.KeyTypeStr:
+			st.typ = constants.KeyTypeStr
+		case constants.KeyTypeTime:
+			st.typ = constants.KeyTypeTime
+		default:
+			return st, fmt.Errorf("unsupported typ: %s", typ)
+		}
+	}
+	parts := strings.Fields(modifiers)
+	if len(parts) > 0 && (parts[0] == constants.SortDesc || parts[0] == constants.SortASC) {
+		st.reverse = parts[0] == constants.SortDesc
+		parts = parts[1:]
+	}
+	if len(parts) > 0 {
+		if len(parts) != 2 || parts[0] != constants.SortNulls {
+			return st, fmt.Errorf("error sort format `%s`", strings.Join(parts, " "))
+		}
+		switch parts[1] {
+		case constants.SortNullsFirst:
+			st.nullsFirst = true
+		case constants.SortNullsLast:
+			st.nullsFirst = false
+		default:
+			return st, fmt.Errorf("error sort format `%s`", strings.Join(parts, " "))
+		}
+	}
+	st.key = key
+	if key == constants.SortScore {
+		st.typ = constants.KeyTypeInt
+		return st, nil
+	}
+	if strings.HasPrefix(key, "{") {
+		// prefer the declared index with the same expression
+		for k, v := range m.index(gvr) {
+			if v == key {
+				st.key = k
+				return st, nil
+			}
+		}
+		jp := jsonpath.New("sort")
+		jp.AllowMissingKeys(true)
+		if err := jp.Parse(key); err != nil {
+			return st, fmt.Errorf("error sort jsonpath `%s`: %v", key, err)
+		}
+		st.path = jp
+		return st, nil
+	}
+	if _, ok := checkKeyMap[key]; !ok {
+		return st, fmt.Errorf("unexpected sort key: %s", key)
+	}
+	return st, nil
+}
+
+// sortValues gets values of sort keys, ad-hoc jsonpath values are evaluated lazily and cached during a query.
+type sortValues struct {
+	objs    map[string]map[string]interface{}
+	values  map[string]map[string]string
+	matches map[string]*textMatch
+}
+
+func (c *sortValues) value(st innerSort, o store.Object) string {
+	if st.path == nil {
+		if st.key == constants.SortScore {
+			if m := c.matches[objectKey(o.Index["cluster"], o.Index["namespace"], o.Index["name"])]; m != nil {
+				return strconv.Itoa(m.score)
+			}
+			return "0"
+		}
+		return o.Index[st.key]
+	}
+	k := objectKey(o.Index["cluster"], o.Index["namespace"], o.Index["name"])
+	if v, ok := c.values[st.key][k]; ok {
+		return v
+	}
+	obj, ok := c.objs[k]
+	if !ok {
+		obj = utils.Obj2JSONMap(o.Obj)
+		c.objs[k] = obj
+	}
+	w := bytes.NewBuffer([]byte{})
+	if err := st.path.Execute(w, obj); err != nil {
+		log.Debugf("exec sort jsonpath %s error: %v", st.key, err)
+	}
+	if _, ok := c.values[st.key]; !ok {
+		c.values[st.key] = map[string]string{}
+	}
+	c.values[st.key][k] = w.String()
+	return w.String()
+}
+
+// tiebreakKeys, with uid of the object, are used to sort objects with equal sort keys.
+var tiebreakKeys = []string{"cluster", "namespace", "name"}
+
+func objUID(o store.Object) string {
+	if oo, ok := o.Obj.(v1.Object); ok {
+		return string(oo.GetUID())
+	}
+	return ""
+}
+
+// compare compares values of the sort key, it returns a negative number if vi is in front of vj.
+func (st innerSort) compare(vi, vj string) (int, error) {
+	switch {
+	case vi == "" && vj == "":
+		return 0, nil
+	case vi == "" || vj == "":
+		if (vi == "") == st.nullsFirst {
+			return -1, nil
+		}
+		return 1, nil
+	}
+	r := 0
+	switch st.typ {
+	case constants.KeyTypeInt:
+		keyErr := fmt.Errorf("value of `%s` can not convert to number", st.key)
+		fi, err := strconv.ParseFloat(vi, 64)
+		if err != nil {
+			return 0, keyErr
+		}
+		fj, err := strconv.ParseFloat(vj, 64)
+		if err != nil {
+			return 0, keyErr
+		}
+		switch {
+		case fi < fj:
+			r = -1
+		case fi > fj:
+			r = 1
+		}
+	case constants.KeyTypeTime:
+		keyErr := fmt.Errorf("value of `%s` can not convert to time", st.key)
+		ti, err := time.Parse(time.RFC3339, vi)
+		if err != nil {
+			return 0, keyErr
+		}
+		tj, err := time.Parse(time.RFC3339, vj)
+		if err != nil {
+			return 0, keyErr
+		}
+		switch {
+		case ti.Before(tj):
+			r = -1
+		case ti.After(tj):
+			r = 1
+		}
+	default:
+		r = strings.Compare(vi, vj)
+	}
+	if st.reverse {
+		r = -r
+	}
+	return r, nil
 }
 
-func sortObjs(objs []store.Object, s string) ([]store.Object, error) {
+func (m *memoryStore) sortObjs(gvr store.GroupVersionResource, objs []store.Object, s string,
+	matches map[string]*textMatch) ([]store.Object, error) {
 	if s == "" {
-		s = "cluster, namespace, name"
+		s = defaultSort
 	}
 	if len(objs) == 0 {
 		return objs, nil
 	}
 	checkKeyMap := objs[0].Index
-	ss := strings.Split(s, ",")
+	ss := splitSorts(s)
 	sorts := make([]innerSort, 0, len(ss))
 	for _, s = range ss {
 		s = strings.TrimSpace(s)
 		if s == "" {
 			continue
 		}
-		st := innerSort{
-			reverse: false,
-			typ:     constants.KeyTypeStr,
-		}
-		if strings.Contains(s, " ") {
-			parts := strings.Split(s, " ")
-			if len(parts) > 2 {
-				return objs, nil
-			}
-			if len(parts) == 2 {
-				switch parts[1] {
-				case constants.SortDesc:
-					st.reverse = true
-				case constants.SortASC:
-					st.reverse = false
-				default:
-					return objs, fmt.Errorf("error sort format `%s`", parts[1])
-				}
-			}
-			// override s
-			s = parts[0]
-		}
-		if strings.Contains(s, constants.KeyTypeSep) {
-			parts := strings.Split(s, constants.KeyTypeSep)
-			if len(parts) != 2 {
-				return objs, fmt.Errorf("error type format")
-			}
-			switch parts[1] {
-			case constants.KeyTypeInt:
-				st.typ = constants.KeyTypeInt
-			case constants.KeyTypeStr:
-				st.typ = constants.KeyTypeStr
-			default:
-				return objs, fmt.Errorf("unsupported typ: %s", parts[1])
-			}
-			s = parts[0]
+		st, err := m.parseSort(gvr, s, checkKeyMap)
+		if err != nil {
+			return objs, err
 		}
-		st.key = s
-		if _, ok := checkKeyMap[s]; !ok {
-			return objs, fmt.Errorf("unexpected sort key: %s", s)
+		if st.key == constants.SortScore && matches == nil {
+			return objs, fmt.Errorf("sort by %s requires full text search", constants.SortScore)
 		}
 		sorts = append(sorts, st)
 	}
+	values := sortValues{
+		objs:    map[string]map[string]interface{}{},
+		values:  map[string]map[string]string{},
+		matches: matches,
+	}
 	var sortErr error = nil
-	sort.Slice(objs, func(i, j int) bool {
+	less := func(i, j int) bool {
 		for _, s := range sorts {
-			r := false
-			equals := false
-			vis := objs[i].Index[s.key]
-			vjs := objs[j].Index[s.key]
-			if s.typ == constants.KeyTypeInt {
-				keyErr := fmt.Errorf("value of `%s` can not convert to number", s.key)
-				vi, err := strconv.ParseFloat(vis, 64)
-				if err != nil {
-					sortErr = keyErr
-					break
-				}
-				vj, err := strconv.ParseFloat(vjs, 64)
-				if err != nil {
-					sortErr = keyErr
-					break
-				}
-				r = vi < vj
-				equals = vi == vj
-			} else {
-				r = vis < vjs
-				equals = vis == vjs
+			r, err := s.compare(values.value(s, objs[i]), values.value(s, objs[j]))
+			if err != nil {
+				sortErr = err
+				return false
 			}
-			if equals {
-				continue
+			if r != 0 {
+				return r < 0
 			}
-			if s.reverse {
-				r = !r
+		}
+		// tiebreaker to make the order deterministic
+		for _, k := range tiebreakKeys {
+			if vi, vj := objs[i].Index[k], objs[j].Index[k]; vi != vj {
+				return vi < vj
 			}
-			return r
 		}
-		return true
-	})
+		return objUID(objs[i]) < objUID(objs[j])
+	}
+	// the objects of the store are in the order of the default sort
+	if !sort.SliceIsSorted(objs, less) {
+		sort.SliceStable(objs, less)
+	}
 	return objs, sortErr
 }
 
+func (m *memoryStore) getObject(gvr store.GroupVersionResource, cluster string, namespace, name string) *store.Object {
+	g := m.resources.Get(gvr)
+	if g == nil {
+		return nil
+	}
+	c := g.clusters.Get(clusterName(cluster))
+	if c == nil {
+		return nil
+	}
+	if e := c.shard(namespaceName(namespace), name).get(namespaceName(namespace), name); e != nil {
+		return &e.Object
+	}
+	return nil
+}
+
 func (m *memoryStore) Get(gvr store.GroupVersionResource, cluster string, namespace, name string) interface{} {
-	if m.resourceMap.Exists(gvr) {
-		if !m.resourceMap.Get(gvr).Exists(clusterName(cluster)) {
-			return nil
+	if o := m.getObject(gvr, cluster, namespace, name); o != nil {
+		return readObject(o, nil)
+	}
+	return nil
+}
+
+// relationOwner matches any owner in the ownerReferences chain in relation search.
+const relationOwner = "owner"
+
+// relationIndex returns the index used to match a related object in relation search,
+// which contains the kind and labels (labels.<key>) of the object besides the configured index.
+func relationIndex(kind string, o *store.Object) map[string]string {
+	index := make(map[string]string, len(o.Index)+1)
+	for k, v := range o.Index {
+		index[k] = v
+	}
+	index["kind"] = kind
+	if oo, ok := o.Obj.(v1.Object); ok {
+		for k, v := range oo.GetLabels() {
+			index["labels."+k] = v
 		}
-		if !m.resourceMap.Get(gvr).Get(clusterName(cluster)).Exists(namespaceName(namespace)) {
-			return nil
+	}
+	return index
+}
+
+type relationTarget struct {
+	gvr store.GroupVersionResource
+	// objs are objects of gvr matched the relation selector, grouped by cluster.
+	objs map[string][]*relation.Object
+}
+
+// filterRelations filters objs by relation search, each relation must have at least one related
+// object matches the selector of the relation.
+func (m *memoryStore) filterRelations(gvr store.GroupVersionResource, objs []store.Object,
+	rels map[string]labels.Selector) ([]store.Object, error) {
+	engine := relation.NewEngine(m)
+	targets := map[string]relationTarget{}
+	for rel, sel := range rels {
+		if rel == relationOwner {
+			continue
+		}
+		p, ok := common.FindProxy(rel)
+		if !ok {
+			return nil, fmt.Errorf("unexpected relation: %s", rel)
+		}
+		t := relationTarget{
+			gvr: store.GroupVersionResource{
+				Group:    p.Group,
+				Version:  p.Version,
+				Resource: p.Resource,
+			},
+			objs: map[string][]*relation.Object{},
 		}
-		if o := m.resourceMap.Get(gvr).Get(clusterName(cluster)).Get(namespaceName(namespace)).Get(name); o != nil {
-			return o.Obj
+		if !m.IsStoreGVR(t.gvr) {
+			return nil, fmt.Errorf("relation %s is not cached", rel)
 		}
+		var err error
+		m.resources.Get(t.gvr).forEachObject("", func(cluster string, obj *store.Object) {
+			if err != nil || !sel.Matches(labels.Set(relationIndex(p.Kind(), obj))) {
+				return
+			}
+			var ro *relation.Object
+			if ro, err = engine.NewObject(cluster, t.gvr, obj.Obj); err == nil {
+				t.objs[cluster] = append(t.objs[cluster], ro)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		targets[rel] = t
 	}
-	return nil
+	res := make([]store.Object, 0, len(objs))
+	for _, o := range objs {
+		cluster := o.Index["cluster"]
+		src, err := engine.NewObject(cluster, gvr, o.Obj)
+		if err != nil {
+			return nil, err
+		}
+		matched := true
+		for rel, sel := range rels {
+			if !m.matchRelation(engine, cluster, src, rel, sel, targets[rel]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			res = append(res, o)
+		}
+	}
+	return res, nil
 }
 
-func (m *memoryStore) Query(gvr store.GroupVersionResource, query store.Query) store.QueryResult {
-	res := store.QueryResult{}
-	resources := make([]store.Object, 0)
-	m.resourceMap.Get(gvr).ForEach(func(cname clusterName, c *syncResourceStore[
-		namespaceName,
-		syncResourceStore[string, store.Object],
-	]) {
-		c.ForEach(func(ns namespaceName, nssObj *syncResourceStore[string, store.Object]) {
-			if query.Namespace == "" || query.Namespace == string(ns) {
-				nssObj.ForEach(func(name string, obj *store.Object) {
-					if ok, err := query.Match(obj.Index); ok {
-						resources = append(resources, *obj)
-					} else if err != nil {
-						res.Error = err
-					}
-				})
+func (m *memoryStore) matchRelation(engine *relation.Engine, cluster string, src *relation.Object,
+	rel string, sel labels.Selector, target relationTarget) bool {
+	if rel == relationOwner {
+		for _, owner := range engine.Owners(src) {
+			oo, ok := owner.Obj.(v1.Object)
+			if !ok {
+				continue
 			}
-		})
-	})
-	l := int64(len(resources))
-	if l == 0 {
-		return res
+			so := m.getObject(owner.GVR, cluster, oo.GetNamespace(), oo.GetName())
+			if so != nil && sel.Matches(labels.Set(relationIndex(owner.Kind, so))) {
+				return true
+			}
+		}
+		return false
 	}
-	resources, err := sortObjs(resources, query.Sort)
-	if err != nil {
-		res.Error = err
-		return res
+	for _, t := range target.objs[cluster] {
+		if engine.IsRelated(src, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryPage is the sorted objects matched by a query, the items of a page are built lazily when iterated.
+type queryPage struct {
+	err     error
+	objs    []store.Object
+	matches map[string]*textMatch
+	total   int64
+	sort    string
+	// snapshot is the id of the snapshot which pins the objects for the following pages
+	snapshot string
+}
+
+// objectIterator yields the items of a query page.
+type objectIterator struct {
+	objs    []store.Object
+	matches map[string]*textMatch
+}
+
+func (it *objectIterator) Next() (interface{}, bool) {
+	if len(it.objs) == 0 {
+		return nil, false
+	}
+	r := it.objs[0]
+	it.objs = it.objs[1:]
+	if it.matches != nil {
+		return readObject(&r, highlights(it.matches[objectKey(r.Index["cluster"], r.Index["namespace"], r.Index["name"])])), true
 	}
-	res.Total = l
+	return readObject(&r, nil), true
+}
+
+func (it *objectIterator) Len() int {
+	return len(it.objs)
+}
+
+// result returns the page of query.
+func (p *queryPage) result(query store.Query) store.QueryResult {
+	l := int64(len(p.objs))
 	var start, end int64
 	if query.PageSize == 0 {
 		// all resources
@@ -330,12 +758,134 @@ func (m *memoryStore) Query(gvr store.GroupVersionResource, query store.Query) s
 			end = l
 		}
 	}
-	for _, r := range resources[start:end] {
-		res.Items = append(res.Items, r.Obj)
+	return store.QueryResult{
+		Error:    p.err,
+		Iter:     &objectIterator{objs: p.objs[start:end], matches: p.matches},
+		Total:    p.total,
+		Sort:     p.sort,
+		Snapshot: p.snapshot,
+	}
+}
+
+func (m *memoryStore) query(gvr store.GroupVersionResource, query store.Query) *queryPage {
+	res := &queryPage{}
+	if query.Sort == "" {
+		query.Sort = defaultSort
+	}
+	rels, err := query.RelationSelectors()
+	if err != nil {
+		res.err = err
+		return res
+	}
+	sel := labels.Everything()
+	if query.LabelSelector != "" {
+		if sel, err = labels.Parse(query.LabelSelector); err != nil {
+			res.err = err
+			return res
+		}
+	}
+	var matches map[string]*textMatch
+	if terms := query.FullTextTerms(); len(terms) > 0 {
+		ti := m.textIndex(gvr)
+		if ti == nil {
+			res.err = fmt.Errorf("full text search is not enabled for %v", gvr)
+			return res
+		}
+		matches = ti.search(terms)
+	}
+	resources := make([]store.Object, 0)
+	g, err := m.cachedResource(gvr)
+	if g == nil {
+		res.err = err
+		if err == nil {
+			res.err = fmt.Errorf("resource %v is not cached", gvr)
+		}
+		return res
+	}
+	g.forEachObject(query.Namespace, func(cluster string, obj *store.Object) {
+		if matches != nil && matches[objectKey(cluster, obj.Index["namespace"], obj.Index["name"])] == nil {
+			return
+		}
+		if !sel.Empty() && !sel.Matches(labels.Set(objectLabels(obj))) {
+			return
+		}
+		if ok, err := query.Match(obj.Index); ok {
+			resources = append(resources, *obj)
+		} else if err != nil {
+			res.err = err
+		}
+	})
+	if len(rels) > 0 {
+		var err error
+		resources, err = m.filterRelations(gvr, resources, rels)
+		if err != nil {
+			res.err = err
+			return res
+		}
+	}
+	l := int64(len(resources))
+	if l == 0 {
+		if res.err == nil {
+			// empty pages report the applied sort too
+			res.sort = query.Sort
+		}
+		return res
+	}
+	resources, err = m.sortObjs(gvr, resources, query.Sort, matches)
+	if err != nil {
+		res.err = err
+		return res
 	}
+	res.total = l
+	res.sort = query.Sort
+	res.objs = resources
+	res.matches = matches
 	return res
 }
 
+// objectLabels returns the labels of the stored object.
+func objectLabels(o *store.Object) map[string]string {
+	if oo, ok := o.Obj.(v1.Object); ok {
+		return oo.GetLabels()
+	}
+	return nil
+}
+
+// readObject returns a copy of the stored object with the annotations of it and extra injected,
+// so that the readers neither change the store nor race with the writers.
+func readObject(o *store.Object, extra map[string]string) interface{} {
+	ro, ok := o.Obj.(runtime.Object)
+	if !ok {
+		return o.Obj
+	}
+	c := ro.DeepCopyObject()
+	oo, ok := c.(v1.Object)
+	if !ok {
+		return c
+	}
+	anno := make(map[string]string, len(oo.GetAnnotations())+len(o.Annotations)+len(extra))
+	for k, v := range oo.GetAnnotations() {
+		anno[k] = v
+	}
+	for k, v := range o.Annotations {
+		anno[k] = v
+	}
+	for k, v := range extra {
+		anno[k] = v
+	}
+	oo.SetAnnotations(anno)
+	return c
+}
+
+// highlights returns the annotations of the fields matched full text search.
+func highlights(match *textMatch) map[string]string {
+	if match == nil {
+		return nil
+	}
+	bs, _ := json.Marshal(match.fields)
+	return map[string]string{constants.HighlightAnno: string(bs)}
+}
+
 var funMap = map[string]interface{}{
 	"default": func(def string, pre interface{}) string {
 		if pre == nil {
@@ -351,16 +901,24 @@ var funMap = map[string]interface{}{
 	},
 }
 
-func (m *memoryStore) buildResourceWithIndex(gvr store.GroupVersionResource, cluster string, obj interface{}) (string, string, store.Object) {
+// buildResourceWithIndex builds the index of obj, the size of obj is estimated by the size of its json.
+func (m *memoryStore) buildResourceWithIndex(gvr store.GroupVersionResource, cluster string,
+	obj interface{}) (string, string, store.Object, int64) {
+	if ro, ok := obj.(runtime.Object); ok {
+		// the caller may change obj after stored
+		obj = ro.DeepCopyObject()
+	}
 	s := store.Object{
 		Index: map[string]string{},
 		Obj:   obj,
 	}
-	mobj := utils.Obj2JSONMap(obj)
+	bs, _ := json.Marshal(obj)
+	mobj := map[string]interface{}{}
+	_ = json.Unmarshal(bs, &mobj)
 	jp := jsonpath.New("parser")
 	jp.AllowMissingKeys(true)
 	gotmpl := template.New("parser").Funcs(funMap)
-	for k, v := range m.indexConf[gvr] {
+	for k, v := range m.index(gvr) {
 		w := bytes.NewBuffer([]byte{})
 		var exec interface {
 			Execute(wr io.Writer, data interface{}) error
@@ -405,25 +963,16 @@ func (m *memoryStore) buildResourceWithIndex(gvr store.GroupVersionResource, clu
 		} else {
 			s.Index["is_deleted"] = "false"
 		}
-		if len(oo.GetAnnotations()) == 0 {
-			oo.SetAnnotations(map[string]string{
-				constants.DSMClusterAnno: cluster,
-			})
-		} else {
-			anno := oo.GetAnnotations()
-			anno[constants.DSMClusterAnno] = cluster
-			oo.SetAnnotations(anno)
-		}
-		anno := oo.GetAnnotations()
 		index, _ := json.Marshal(s.Index)
-		anno[constants.IndexAnno] = string(index) // todo constants
-		oo.SetAnnotations(anno)
-		s.Obj = oo
+		s.Annotations = map[string]string{
+			constants.DSMClusterAnno: cluster,
+			constants.IndexAnno:      string(index),
+		}
 		namespace = oo.GetNamespace()
 		name = oo.GetName()
 		s.Index["namespace"] = namespace
 		s.Index["name"] = name
 	}
 	log.Debugf("memory store: gvr: %v, resources %s/%s, index: %v", gvr, namespace, name, s.Index)
-	return namespace, name, s
+	return namespace, name, s, int64(len(bs))
 }
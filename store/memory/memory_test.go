@@ -1,16 +1,20 @@
 package memory
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 
+	"github.com/DaoCloud/ckube/common"
 	"github.com/DaoCloud/ckube/common/constants"
 	"github.com/DaoCloud/ckube/page"
 	"github.com/DaoCloud/ckube/store"
@@ -70,6 +74,103 @@ func TestConcurrentReadWrite(t *testing.T) {
 	wg.Wait()
 }
 
+func TestMemoryStore_CopyOnRead(t *testing.T) {
+	m := NewMemoryStore(testIndexConf)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test",
+			Namespace: "test",
+			Labels:    map[string]string{"app": "test"},
+		},
+	}
+	_ = m.OnResourceAdded(podsGVR, "c1", pod)
+	assert.Empty(t, pod.Annotations, "the added object should not be changed")
+	// changes of the caller after stored
+	pod.Labels["app"] = "changed"
+
+	get := func() *corev1.Pod {
+		return m.Get(podsGVR, "c1", "test", "test").(*corev1.Pod)
+	}
+	got := get()
+	assert.Equal(t, "test", got.Labels["app"])
+	assert.Equal(t, "c1", got.Annotations[constants.DSMClusterAnno])
+	assert.NotEmpty(t, got.Annotations[constants.IndexAnno])
+	got.Labels["app"] = "changed"
+	got.Annotations[constants.DSMClusterAnno] = "changed"
+	assert.Equal(t, "test", get().Labels["app"])
+	assert.Equal(t, "c1", get().Annotations[constants.DSMClusterAnno])
+
+	q := store.Query{Namespace: "test"}
+	item := m.Query(podsGVR, q).Items[0].(*corev1.Pod)
+	item.Labels["app"] = "changed"
+	item.Spec.NodeName = "changed"
+	res := m.QueryIter(podsGVR, q)
+	iterated, _ := res.Iter.Next()
+	assert.Equal(t, "test", iterated.(*corev1.Pod).Labels["app"])
+	assert.Empty(t, iterated.(*corev1.Pod).Spec.NodeName)
+	assert.Equal(t, "test", get().Labels["app"])
+}
+
+// TestConcurrentWatchQuery should be run with the race detector.
+func TestConcurrentWatchQuery(t *testing.T) {
+	m := NewMemoryStore(testIndexConf, WithSearchable(map[store.GroupVersionResource][]string{podsGVR: {"name"}}))
+	round := 500
+	wg := sync.WaitGroup{}
+	// watcher
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "test"}}
+		for i := 0; i < round; i++ {
+			// the decoder of watcher may reuse the object
+			pod.Name = fmt.Sprintf("test-%d", i%10)
+			pod.ResourceVersion = fmt.Sprint(i + 1)
+			pod.Labels = map[string]string{"round": fmt.Sprint(i)}
+			switch i % 3 {
+			case 0:
+				_ = m.OnResourceAdded(podsGVR, "test", pod)
+			case 1:
+				_ = m.OnResourceModified(podsGVR, "test", pod)
+			case 2:
+				_ = m.OnResourceDeleted(podsGVR, "test", pod)
+			}
+			_ = m.OnResourceVersion(podsGVR, "test", pod.ResourceVersion)
+		}
+	}()
+	// handlers changing the results
+	mutate := func(obj interface{}) {
+		if pod, ok := obj.(*corev1.Pod); ok {
+			pod.Labels["handler"] = "changed"
+			pod.Annotations[constants.IndexAnno] = "changed"
+		}
+	}
+	for _, search := range []string{"", "name=test-1", "__ckube_fts__:test"} {
+		wg.Add(1)
+		go func(search string) {
+			defer wg.Done()
+			for i := 0; i < round; i++ {
+				q := store.Query{Namespace: "test", Paginate: page.Paginate{Search: search}}
+				for _, item := range m.Query(podsGVR, q).Items {
+					mutate(item)
+				}
+				it := m.QueryIter(podsGVR, q).Iterator()
+				for item, ok := it.Next(); ok; item, ok = it.Next() {
+					mutate(item)
+				}
+				if obj := m.Get(podsGVR, "test", "test", fmt.Sprintf("test-%d", i%10)); obj != nil {
+					mutate(obj)
+				}
+			}
+		}(search)
+	}
+	wg.Wait()
+	for _, item := range m.Query(podsGVR, store.Query{}).Items {
+		pod := item.(*corev1.Pod)
+		assert.NotContains(t, pod.Labels, "handler")
+		assert.NotEqual(t, "changed", pod.Annotations[constants.IndexAnno])
+	}
+}
+
 func BenchmarkWrite(b *testing.B) {
 	m := NewMemoryStore(map[store.GroupVersionResource]map[string]string{
 		podsGVR: {
@@ -166,6 +267,7 @@ func TestMemoryStore_Query(t *testing.T) {
 					},
 				}),
 				Total: 2,
+				Sort:  "cluster, namespace, name",
 			},
 		},
 		{
@@ -205,6 +307,7 @@ func TestMemoryStore_Query(t *testing.T) {
 					},
 				}),
 				Total: 2,
+				Sort:  "cluster, namespace, name",
 			},
 		},
 		{
@@ -259,6 +362,7 @@ func TestMemoryStore_Query(t *testing.T) {
 					},
 				}),
 				Total: 2,
+				Sort:  "cluster, namespace, name",
 			},
 		},
 		{
@@ -303,6 +407,7 @@ func TestMemoryStore_Query(t *testing.T) {
 					},
 				}),
 				Total: 1,
+				Sort:  "cluster, namespace, name",
 			},
 		},
 		{
@@ -390,6 +495,7 @@ func TestMemoryStore_Query(t *testing.T) {
 					},
 				}),
 				Total: 2,
+				Sort:  "cluster, namespace, name",
 			},
 		},
 		{
@@ -423,6 +529,8 @@ func TestMemoryStore_Query(t *testing.T) {
 			res: store.QueryResult{
 				Error: nil,
 				Total: 0,
+				// empty pages report the applied sort
+				Sort: "cluster, namespace, name",
 			},
 		},
 		{
@@ -508,6 +616,7 @@ func TestMemoryStore_Query(t *testing.T) {
 					},
 				}),
 				Total: 3,
+				Sort:  "uid!str",
 			},
 		},
 		{
@@ -572,6 +681,7 @@ func TestMemoryStore_Query(t *testing.T) {
 					},
 				}),
 				Total: 3,
+				Sort:  "uid desc",
 			},
 		},
 		{
@@ -663,6 +773,7 @@ func TestMemoryStore_Query(t *testing.T) {
 					},
 				}),
 				Total: 3,
+				Sort:  "namespace,uid desc",
 			},
 		},
 		{
@@ -727,6 +838,7 @@ func TestMemoryStore_Query(t *testing.T) {
 					},
 				}),
 				Total: 3,
+				Sort:  "uid!int",
 			},
 		},
 		{
@@ -818,12 +930,13 @@ func TestMemoryStore_Query(t *testing.T) {
 					},
 				}),
 				Total: 4,
+				Sort:  "namespace,uid!int",
 			},
 		},
 	}
 	for i, c := range cases {
 		t.Run(fmt.Sprintf("%d-%s", i, c.name), func(t *testing.T) {
-			s := NewMemoryStore(testIndexConf)
+			s := NewMemoryStore(testIndexConf, WithSnapshotTTL(0))
 			for _, r := range c.resources {
 				_ = s.OnResourceAdded(c.gvr, "", r)
 			}
@@ -905,15 +1018,490 @@ func TestMemoryStore_buildResourceWithIndex(t *testing.T) {
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
 			gvr := store.GroupVersionResource{}
-			m := memoryStore{
-				indexConf: map[store.GroupVersionResource]map[string]string{
-					gvr: c.index,
-				},
-			}
-			_, _, o := m.buildResourceWithIndex(gvr, "test", c.obj)
+			m := NewMemoryStore(map[store.GroupVersionResource]map[string]string{
+				gvr: c.index,
+			}).(*memoryStore)
+			_, _, o, _ := m.buildResourceWithIndex(gvr, "test", c.obj)
 			delete(o.Index, "is_deleted")
 			delete(o.Index, "cluster")
 			assert.Equal(t, c.expectedIndex, o.Index)
 		})
 	}
 }
+
+func TestMemoryStore_QueryRelation(t *testing.T) {
+	nodesGVR := store.GroupVersionResource{Version: "v1", Resource: "nodes"}
+	servicesGVR := store.GroupVersionResource{Version: "v1", Resource: "services"}
+	rsGVR := store.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+	deploymentsGVR := store.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	common.InitConfig(&common.Config{Proxies: []common.Proxy{
+		{Version: podsGVR.Version, Resource: podsGVR.Resource, ListKind: "PodList"},
+		{Version: "v1", Resource: "nodes", ListKind: "NodeList"},
+		{Version: "v1", Resource: "services", ListKind: "ServiceList"},
+		{Group: "apps", Version: "v1", Resource: "replicasets", ListKind: "ReplicaSetList"},
+		{Group: "apps", Version: "v1", Resource: "deployments", ListKind: "DeploymentList"},
+	}})
+	index := map[string]string{
+		"namespace": "{.metadata.namespace}",
+		"name":      "{.metadata.name}",
+	}
+	m := NewMemoryStore(map[store.GroupVersionResource]map[string]string{
+		podsGVR: {
+			"namespace": "{.metadata.namespace}",
+			"name":      "{.metadata.name}",
+			"status":    "{.status.reason}",
+		},
+		nodesGVR:       index,
+		servicesGVR:    index,
+		rsGVR:          index,
+		deploymentsGVR: index,
+	})
+	_ = m.OnResourceAdded(deploymentsGVR, "c1", &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test", UID: "dep-web"},
+	})
+	_ = m.OnResourceAdded(rsGVR, "c1", &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-1",
+			Namespace:       "test",
+			UID:             "rs-web-1",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "web", UID: "dep-web"}},
+		},
+	})
+	_ = m.OnResourceAdded(nodesGVR, "c1", &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-a", Labels: map[string]string{"zone": "a"}},
+	})
+	_ = m.OnResourceAdded(nodesGVR, "c1", &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-b", Labels: map[string]string{"zone": "b"}},
+	})
+	_ = m.OnResourceAdded(podsGVR, "c1", &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "web-1-x",
+			Namespace:       "test",
+			Labels:          map[string]string{"app": "web"},
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-1", UID: "rs-web-1"}},
+		},
+		Spec:   corev1.PodSpec{NodeName: "node-a"},
+		Status: corev1.PodStatus{Reason: "CrashLoopBackOff"},
+	})
+	_ = m.OnResourceAdded(podsGVR, "c1", &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "api-x",
+			Namespace: "test",
+			Labels:    map[string]string{"app": "api"},
+		},
+		Spec: corev1.PodSpec{NodeName: "node-b"},
+	})
+	_ = m.OnResourceAdded(servicesGVR, "c1", &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "web"}},
+	})
+	_ = m.OnResourceAdded(servicesGVR, "c1", &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "test"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "api"}},
+	})
+	cases := []struct {
+		name   string
+		gvr    store.GroupVersionResource
+		search string
+		expect []string
+		err    error
+	}{
+		{
+			name:   "owner",
+			gvr:    podsGVR,
+			search: "__ckube_rel__:owner.kind=Deployment,owner.name=web",
+			expect: []string{"web-1-x"},
+		},
+		{
+			name:   "node labels",
+			gvr:    podsGVR,
+			search: "__ckube_rel__:node.labels.zone=b",
+			expect: []string{"api-x"},
+		},
+		{
+			name:   "services selecting pods",
+			gvr:    servicesGVR,
+			search: "__ckube_rel__:pods.status=CrashLoopBackOff",
+			expect: []string{"web"},
+		},
+		{
+			name:   "with other search",
+			gvr:    podsGVR,
+			search: "name=web; __ckube_rel__:node.labels.zone=b",
+			expect: []string{},
+		},
+		{
+			name:   "unknown relation",
+			gvr:    podsGVR,
+			search: "__ckube_rel__:secrets.name=x",
+			err:    fmt.Errorf("unexpected relation: secrets"),
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d-%s", i, c.name), func(t *testing.T) {
+			res := m.Query(c.gvr, store.Query{Paginate: page.Paginate{Search: c.search}})
+			assert.Equal(t, c.err, res.Error)
+			if c.err == nil {
+				names := []string{}
+				for _, item := range res.Items {
+					names = append(names, item.(metav1.Object).GetName())
+				}
+				assert.Equal(t, c.expect, names)
+			}
+		})
+	}
+}
+
+func TestMemoryStore_SortJSONPath(t *testing.T) {
+	m := NewMemoryStore(testIndexConf)
+	for i, start := range []int{2, 3, 1} {
+		_ = m.OnResourceAdded(podsGVR, "", &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("test%d", i),
+				Namespace: "test",
+				UID:       "test",
+			},
+			Status: corev1.PodStatus{
+				StartTime: &metav1.Time{Time: time.Unix(int64(start)*100, 0)},
+			},
+		})
+	}
+	names := func(res store.QueryResult) []string {
+		ns := []string{}
+		for _, item := range res.Items {
+			ns = append(ns, item.(metav1.Object).GetName())
+		}
+		return ns
+	}
+	res := m.Query(podsGVR, store.Query{Paginate: page.Paginate{Sort: "{.status.startTime} desc"}})
+	assert.NoError(t, res.Error)
+	assert.Equal(t, []string{"test1", "test0", "test2"}, names(res))
+	res = m.Query(podsGVR, store.Query{Paginate: page.Paginate{Sort: "namespace, {.status.startTime}"}})
+	assert.NoError(t, res.Error)
+	assert.Equal(t, []string{"test2", "test0", "test1"}, names(res))
+	res = m.Query(podsGVR, store.Query{Paginate: page.Paginate{Sort: "{.status.startTime"}})
+	assert.Equal(t, fmt.Errorf("error sort format `{.status.startTime`"), res.Error)
+
+	ms := m.(*memoryStore)
+	st, err := ms.parseSort(podsGVR, "{.metadata.name}!str desc", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, innerSort{key: "name", typ: constants.KeyTypeStr, reverse: true}, st)
+	st, err = ms.parseSort(depsGVR, "{.spec.replicas}!int", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "replicas", st.key)
+	st, err = ms.parseSort(depsGVR, "{.status.readyReplicas}!int asc", nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, st.path)
+	assert.Equal(t, constants.KeyTypeInt, st.typ)
+}
+
+func TestMemoryStore_SortStable(t *testing.T) {
+	m := NewMemoryStore(testIndexConf)
+	replicas := []*int32{nil, new(int32), nil, new(int32), new(int32)}
+	*replicas[1] = 3
+	*replicas[3] = 1
+	*replicas[4] = 3
+	for i, r := range replicas {
+		_ = m.OnResourceAdded(depsGVR, "", &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("test%d", i),
+				Namespace: "test",
+				UID:       "test",
+			},
+			Spec: appsv1.DeploymentSpec{
+				Replicas: r,
+			},
+		})
+	}
+	names := func(res store.QueryResult) []string {
+		ns := []string{}
+		for _, item := range res.Items {
+			ns = append(ns, item.(metav1.Object).GetName())
+		}
+		return ns
+	}
+	cases := []struct {
+		sort   string
+		expect []string
+		err    error
+	}{
+		{
+			sort:   "uid",
+			expect: []string{"test0", "test1", "test2", "test3", "test4"},
+		},
+		{
+			sort:   "replicas!int",
+			expect: []string{"test3", "test1", "test4", "test0", "test2"},
+		},
+		{
+			sort:   "replicas!int desc",
+			expect: []string{"test1", "test4", "test3", "test0", "test2"},
+		},
+		{
+			sort:   "replicas!int desc nulls first",
+			expect: []string{"test0", "test2", "test1", "test4", "test3"},
+		},
+		{
+			sort:   "replicas nulls last, name desc",
+			expect: []string{"test3", "test4", "test1", "test2", "test0"},
+		},
+		{
+			sort: "replicas nulls middle",
+			err:  fmt.Errorf("error sort format `nulls middle`"),
+		},
+		{
+			sort: "name!time",
+			err:  fmt.Errorf("value of `name` can not convert to time"),
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d-%s", i, c.sort), func(t *testing.T) {
+			// map iteration is random, query several times to make sure the order is deterministic
+			for round := 0; round < 5; round++ {
+				res := m.Query(depsGVR, store.Query{Paginate: page.Paginate{Sort: c.sort}})
+				assert.Equal(t, c.err, res.Error)
+				if c.err == nil {
+					assert.Equal(t, c.expect, names(res))
+				}
+			}
+		})
+	}
+}
+
+func TestInnerSort_compare(t *testing.T) {
+	st := innerSort{key: "created_at", typ: constants.KeyTypeTime}
+	r, err := st.compare("2022-01-02T00:00:00Z", "2022-01-01T08:00:00+08:00")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, r)
+	r, err = st.compare("", "2022-01-01T00:00:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, r)
+	st.nullsFirst = true
+	st.reverse = true
+	r, err = st.compare("", "2022-01-01T00:00:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, -1, r)
+}
+
+func TestMemoryStore_QueryFullText(t *testing.T) {
+	m := NewMemoryStore(map[store.GroupVersionResource]map[string]string{
+		podsGVR: {
+			"namespace": "{.metadata.namespace}",
+			"name":      "{.metadata.name}",
+			"images":    "{.spec.containers[*].image}",
+		},
+		depsGVR: {
+			"name": "{.metadata.name}",
+		},
+	}, WithSearchable(map[store.GroupVersionResource][]string{
+		podsGVR: {"name", "images"},
+	}))
+	for name, image := range map[string]string{
+		"nginx-1": "nginx:1.21",
+		"web-1":   "nginx:1.21",
+		"redis-1": "redis:6",
+	} {
+		_ = m.OnResourceAdded(podsGVR, "c1", &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "test",
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Image: image}},
+			},
+		})
+	}
+	names := func(res store.QueryResult) []string {
+		ns := []string{}
+		for _, item := range res.Items {
+			ns = append(ns, item.(metav1.Object).GetName())
+		}
+		return ns
+	}
+	res := m.Query(podsGVR, store.Query{Paginate: page.Paginate{Search: "__ckube_fts__:nginx", Sort: "_score desc"}})
+	assert.NoError(t, res.Error)
+	assert.Equal(t, []string{"nginx-1", "web-1"}, names(res))
+	assert.Equal(t, `{"images":["nginx"],"name":["nginx"]}`,
+		res.Items[0].(metav1.Object).GetAnnotations()[constants.HighlightAnno])
+	// stored objects are not modified
+	assert.Empty(t, m.Get(podsGVR, "c1", "test", "nginx-1").(metav1.Object).GetAnnotations()[constants.HighlightAnno])
+
+	res = m.Query(podsGVR, store.Query{Paginate: page.Paginate{Search: "__ckube_fts__:nginx 1; name=web"}})
+	assert.NoError(t, res.Error)
+	assert.Equal(t, []string{"web-1"}, names(res))
+
+	_ = m.OnResourceDeleted(podsGVR, "c1", &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-1",
+			Namespace: "test",
+		},
+	})
+	res = m.Query(podsGVR, store.Query{Paginate: page.Paginate{Search: "__ckube_fts__:ngin"}})
+	assert.NoError(t, res.Error)
+	assert.Equal(t, []string{"nginx-1"}, names(res))
+
+	res = m.Query(podsGVR, store.Query{Paginate: page.Paginate{Sort: "_score"}})
+	assert.Equal(t, fmt.Errorf("sort by _score requires full text search"), res.Error)
+	res = m.Query(depsGVR, store.Query{Paginate: page.Paginate{Search: "__ckube_fts__:nginx"}})
+	assert.Equal(t, fmt.Errorf("full text search is not enabled for {apps corev1 deployments}"), res.Error)
+}
+
+func TestMemoryStore_ResourceVersion(t *testing.T) {
+	m := NewMemoryStore(map[store.GroupVersionResource]map[string]string{
+		podsGVR: {
+			"namespace": "{.metadata.namespace}",
+			"name":      "{.metadata.name}",
+		},
+	})
+	pod := func(rv string, deleted bool) *corev1.Pod {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "test",
+				Namespace:       "test",
+				ResourceVersion: rv,
+			},
+		}
+		if deleted {
+			now := metav1.Now()
+			p.DeletionTimestamp = &now
+		}
+		return p
+	}
+	rvOf := func() string {
+		o := m.Get(podsGVR, "c1", "test", "test")
+		if o == nil {
+			return ""
+		}
+		return o.(metav1.Object).GetResourceVersion()
+	}
+	_ = m.OnResourceAdded(podsGVR, "c1", pod("10", false))
+	_ = m.OnResourceModified(podsGVR, "c1", pod("12", false))
+	// stale event is ignored
+	_ = m.OnResourceModified(podsGVR, "c1", pod("11", false))
+	assert.Equal(t, "12", rvOf())
+	// not comparable resourceVersion always overwrites
+	_ = m.OnResourceModified(podsGVR, "c1", pod("", false))
+	assert.Equal(t, "", rvOf())
+	_ = m.OnResourceModified(podsGVR, "c1", pod("12", false))
+
+	// stale deletion of an object created again is ignored
+	_ = m.OnResourceDeleted(podsGVR, "c1", pod("11", true))
+	assert.Equal(t, "12", rvOf())
+	_ = m.OnResourceDeleted(podsGVR, "c1", pod("13", true))
+	assert.Equal(t, "", rvOf())
+	// stale event after deletion does not bring the object back
+	_ = m.OnResourceModified(podsGVR, "c1", pod("13", true))
+	assert.Nil(t, m.Get(podsGVR, "c1", "test", "test"))
+	_ = m.OnResourceAdded(podsGVR, "c1", pod("14", false))
+	assert.Equal(t, "14", rvOf())
+
+	_ = m.OnResourceDeleted(podsGVR, "c1", pod("15", false))
+	assert.NoError(t, m.Clean(podsGVR, "c1"))
+	// tombstones are cleaned with the cluster
+	_ = m.OnResourceAdded(podsGVR, "c1", pod("10", false))
+	assert.Equal(t, "10", rvOf())
+}
+
+func TestMemoryStore_Tombstones(t *testing.T) {
+	m := NewMemoryStore(map[store.GroupVersionResource]map[string]string{
+		podsGVR: {
+			"namespace": "{.metadata.namespace}",
+			"name":      "{.metadata.name}",
+		},
+	}).(*memoryStore)
+	deleted := func(name string, rv int) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test", ResourceVersion: strconv.Itoa(rv)}}
+	}
+	tombstones := func() (n int, size int64, min uint64) {
+		c := m.resources.Get(podsGVR).cluster("c1")
+		for i := range c.shards {
+			for k, ts := range c.shards[i].tombstones {
+				n++
+				size += tombstoneSize(k)
+				if min == 0 || ts < min {
+					min = ts
+				}
+			}
+		}
+		return
+	}
+	// the deletions of unknown objects are recorded and counted in the usage
+	_ = m.OnResourceAdded(podsGVR, "c1", deleted("exists", 1))
+	for i := 1; i <= 2000; i++ {
+		_ = m.OnResourceDeleted(podsGVR, "c1", deleted("pod-"+strconv.Itoa(i), i))
+	}
+	n, size, _ := tombstones()
+	assert.Equal(t, 2000, n)
+	_, bytes := m.resources.Get(podsGVR).cluster("c1").usage.load()
+	assert.Equal(t, int64(1), m.Status().Objects)
+	objectBytes := bytes - size
+	assert.Greater(t, objectBytes, int64(0))
+
+	// the tombstones observed by the watcher are swept
+	assert.NoError(t, m.OnResourceVersion(podsGVR, "c1", "2000"))
+	_ = m.OnResourceDeleted(podsGVR, "c1", deleted("old", 1500))
+	// each shard has more than minSweep tombstones
+	for i := 2001; i <= 8000; i++ {
+		_ = m.OnResourceDeleted(podsGVR, "c1", deleted("pod-"+strconv.Itoa(i), i))
+	}
+	n, size, min := tombstones()
+	assert.LessOrEqual(t, n, 6000)
+	assert.Greater(t, min, uint64(2000))
+	_, remaining := m.resources.Get(podsGVR).cluster("c1").usage.load()
+	assert.Equal(t, objectBytes+size, remaining)
+}
+
+func TestMemoryStore_WaitResourceVersion(t *testing.T) {
+	m := NewMemoryStore(map[store.GroupVersionResource]map[string]string{
+		podsGVR: {},
+	})
+	assert.NoError(t, m.OnResourceVersion(podsGVR, "c1", "10"))
+	assert.Error(t, m.OnResourceVersion(podsGVR, "c1", "abc"))
+	assert.NoError(t, m.WaitResourceVersion(context.Background(), podsGVR, "c1", "10"))
+	assert.Error(t, m.WaitResourceVersion(context.Background(), podsGVR, "c1", "abc"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// other clusters do not count
+	assert.NoError(t, m.OnResourceVersion(podsGVR, "c2", "20"))
+	assert.Equal(t, context.DeadlineExceeded, m.WaitResourceVersion(ctx, podsGVR, "c1", "12"))
+
+	done := make(chan error)
+	go func() {
+		done <- m.WaitResourceVersion(context.Background(), podsGVR, "c1", "12")
+	}()
+	assert.NoError(t, m.OnResourceVersion(podsGVR, "c1", "11"))
+	select {
+	case <-done:
+		t.Fatal("wait returned before the resourceVersion observed")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.NoError(t, m.OnResourceVersion(podsGVR, "c1", "13"))
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("wait timeout")
+	}
+	// versions never go back
+	assert.NoError(t, m.OnResourceVersion(podsGVR, "c1", "5"))
+	assert.NoError(t, m.WaitResourceVersion(context.Background(), podsGVR, "c1", "13"))
+}
+
+func TestMemoryStore_AddResource(t *testing.T) {
+	m := NewMemoryStore(map[store.GroupVersionResource]map[string]string{})
+	assert.False(t, m.IsStoreGVR(depsGVR))
+	assert.NoError(t, m.AddResource(depsGVR, map[string]string{
+		"namespace": "{.metadata.namespace}",
+		"name":      "{.metadata.name}",
+	}, []string{"name"}))
+	assert.True(t, m.IsStoreGVR(depsGVR))
+	_ = m.OnResourceAdded(depsGVR, "c1", &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test"},
+	})
+	// adding again keeps the resources
+	assert.NoError(t, m.AddResource(depsGVR, map[string]string{}, nil))
+	res := m.Query(depsGVR, store.Query{Paginate: page.Paginate{Search: "__ckube_fts__:web"}})
+	assert.NoError(t, res.Error)
+	assert.Len(t, res.Items, 1)
+}
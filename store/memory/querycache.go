@@ -0,0 +1,139 @@
+package memory
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DaoCloud/ckube/store"
+)
+
+const (
+	// defaultQueryCacheTTL is the max age of the cached query results, they are invalid once the gvr is changed.
+	defaultQueryCacheTTL = time.Second
+	maxQueryCacheEntries = 1024
+)
+
+type queryCacheKey struct {
+	gvr        store.GroupVersionResource
+	query      store.Query
+	generation uint64
+}
+
+type queryCacheEntry struct {
+	page   *queryPage
+	expire time.Time
+}
+
+// queryCache caches the query results for a short time, so that the same queries of many clients
+// in a short time are only executed once. The key includes the generation of gvr, which is changed
+// on every mutation, so that a cached result is never older than the store.
+type queryCache struct {
+	ttl         time.Duration
+	lock        sync.Mutex
+	entries     map[queryCacheKey]queryCacheEntry
+	generations cowMap[store.GroupVersionResource, uint64]
+}
+
+// WithQueryCache sets the ttl of query results cache, 0 disables the cache.
+func WithQueryCache(ttl time.Duration) Option {
+	return func(m *memoryStore) {
+		m.queryCache.ttl = ttl
+	}
+}
+
+func (c *queryCache) generation(gvr store.GroupVersionResource) uint64 {
+	if g := c.generations.Get(gvr); g != nil {
+		return atomic.LoadUint64(g)
+	}
+	return 0
+}
+
+// invalidate invalidates the cached results of gvr, it must be called after the mutation is visible.
+func (c *queryCache) invalidate(gvr store.GroupVersionResource) {
+	atomic.AddUint64(c.generations.GetOrInit(gvr, func() *uint64 { return new(uint64) }), 1)
+}
+
+func (c *queryCache) get(key queryCacheKey) (*queryPage, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expire) {
+		return nil, false
+	}
+	return e.page, true
+}
+
+func (c *queryCache) set(key queryCacheKey, page *queryPage) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if c.entries == nil {
+		c.entries = map[queryCacheKey]queryCacheEntry{}
+	}
+	if len(c.entries) >= maxQueryCacheEntries {
+		for k, e := range c.entries {
+			if now.After(e.expire) || k.generation != c.generation(k.gvr) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxQueryCacheEntries {
+			c.entries = map[queryCacheKey]queryCacheEntry{}
+		}
+	}
+	c.entries[key] = queryCacheEntry{page: page, expire: now.Add(c.ttl)}
+}
+
+// cachedQuery returns the page of query from the cache if it's not expired and gvr is not changed since cached.
+func (m *memoryStore) cachedQuery(gvr store.GroupVersionResource, query store.Query) *queryPage {
+	if m.queryCache.ttl <= 0 {
+		return m.pinnedQuery(gvr, query)
+	}
+	if rels, err := query.RelationSelectors(); err != nil || len(rels) > 0 {
+		// the results depend on other resources
+		return m.pinnedQuery(gvr, query)
+	}
+	key := queryCacheKey{gvr: gvr, query: query, generation: m.queryCache.generation(gvr)}
+	if p, ok := m.queryCache.get(key); ok {
+		if p.snapshot != "" {
+			m.snapshots.pin(gvr, query, p)
+		}
+		return p
+	}
+	p := m.pinnedQuery(gvr, query)
+	if p.err == nil {
+		m.queryCache.set(key, p)
+	}
+	return p
+}
+
+// pinnedQuery queries the store, the result is pinned in a snapshot if it has more than one page.
+func (m *memoryStore) pinnedQuery(gvr store.GroupVersionResource, query store.Query) *queryPage {
+	p := m.query(gvr, query)
+	if m.snapshots.ttl > 0 && p.err == nil && query.PageSize > 0 && p.total > query.PageSize {
+		m.snapshots.pin(gvr, query, p)
+	}
+	return p
+}
+
+func (m *memoryStore) Query(gvr store.GroupVersionResource, query store.Query) store.QueryResult {
+	res := m.QueryIter(gvr, query)
+	res.Items = store.Collect(res.Iterator())
+	res.Iter = nil
+	return res
+}
+
+func (m *memoryStore) QueryIter(gvr store.GroupVersionResource, query store.Query) store.QueryResult {
+	if m.snapshots.ttl > 0 && query.Snapshot != "" {
+		p, ok := m.snapshots.get(query.Snapshot, gvr, query)
+		if !ok && query.Page > 1 {
+			// the following pages can not be consistent with the previous ones
+			return store.QueryResult{Error: store.ErrSnapshotExpired}
+		}
+		if p != nil {
+			return p.result(query)
+		}
+		// the snapshot is of another query, e.g. the search is changed
+	}
+	return m.cachedQuery(gvr, query).result(query)
+}
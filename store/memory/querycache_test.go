@@ -0,0 +1,115 @@
+package memory
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/DaoCloud/ckube/page"
+	"github.com/DaoCloud/ckube/store"
+)
+
+func testPod(name string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "test",
+		},
+	}
+}
+
+func TestMemoryStore_QueryCache(t *testing.T) {
+	cases := []struct {
+		name   string
+		opts   []Option
+		mutate func(m store.Store)
+		expect int64
+	}{
+		{
+			name:   "cached",
+			mutate: func(m store.Store) {},
+			expect: 1,
+		},
+		{
+			name: "invalidated by added",
+			mutate: func(m store.Store) {
+				_ = m.OnResourceAdded(podsGVR, "test", testPod("pod-2"))
+			},
+			expect: 2,
+		},
+		{
+			name: "invalidated by deleted",
+			mutate: func(m store.Store) {
+				_ = m.OnResourceDeleted(podsGVR, "test", testPod("pod-1"))
+			},
+			expect: 0,
+		},
+		{
+			name: "invalidated by clean",
+			mutate: func(m store.Store) {
+				_ = m.Clean(podsGVR, "test")
+			},
+			expect: 0,
+		},
+		{
+			name: "not invalidated by other resources",
+			mutate: func(m store.Store) {
+				_ = m.OnResourceAdded(depsGVR, "test", testPod("dep-1"))
+			},
+			expect: 1,
+		},
+		{
+			name: "expired",
+			opts: []Option{WithQueryCache(10 * time.Millisecond)},
+			mutate: func(m store.Store) {
+				mm := m.(*memoryStore)
+				// change the store without invalidating
+				mm.resources.Get(podsGVR).cluster("test").shard("test", "pod-1").delete("test", "pod-1", 0, false, 0)
+				time.Sleep(20 * time.Millisecond)
+			},
+			expect: 0,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			m := NewMemoryStore(testIndexConf, c.opts...)
+			_ = m.OnResourceAdded(podsGVR, "test", testPod("pod-1"))
+			q := store.Query{Namespace: "test", Paginate: page.Paginate{Page: 1, PageSize: 10}}
+			assert.Equal(t, int64(1), m.Query(podsGVR, q).Total)
+			c.mutate(m)
+			assert.Equal(t, c.expect, m.Query(podsGVR, q).Total)
+		})
+	}
+}
+
+func TestQueryCache_Bounded(t *testing.T) {
+	c := queryCache{ttl: time.Minute}
+	for i := 0; i < maxQueryCacheEntries*2; i++ {
+		c.set(queryCacheKey{gvr: podsGVR, query: store.Query{Namespace: fmt.Sprint(i)}}, &queryPage{})
+	}
+	assert.LessOrEqual(t, len(c.entries), maxQueryCacheEntries)
+	_, ok := c.get(queryCacheKey{gvr: podsGVR, query: store.Query{Namespace: fmt.Sprint(maxQueryCacheEntries*2 - 1)}})
+	assert.True(t, ok)
+}
+
+func TestMemoryStore_QueryIter(t *testing.T) {
+	m := NewMemoryStore(testIndexConf, WithQueryCache(0))
+	for i := 0; i < 5; i++ {
+		_ = m.OnResourceAdded(podsGVR, "test", testPod(fmt.Sprintf("pod-%d", i)))
+	}
+	q := store.Query{Namespace: "test", Paginate: page.Paginate{Page: 2, PageSize: 2}}
+	res := m.QueryIter(podsGVR, q)
+	assert.NoError(t, res.Error)
+	assert.Nil(t, res.Items)
+	assert.Equal(t, int64(5), res.Total)
+	assert.Equal(t, 2, res.Iter.Len())
+	items := store.Collect(res.Iter)
+	assert.Equal(t, 0, res.Iter.Len())
+	assert.Equal(t, m.Query(podsGVR, q).Items, items)
+	assert.Equal(t, "pod-2", items[0].(*corev1.Pod).Name)
+	assert.Equal(t, "pod-3", items[1].(*corev1.Pod).Name)
+}
@@ -0,0 +1,434 @@
+package memory
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/common/constants"
+	"github.com/DaoCloud/ckube/store"
+)
+
+// shardCount is the number of shards of the objects of a gvr in a cluster.
+const shardCount = 64
+
+// cowMap is a copy-on-write map, reads are lock free and every write copies the map,
+// it's for the maps which are rarely written, such as resources and clusters.
+type cowMap[K comparable, V any] struct {
+	lock sync.Mutex
+	m    atomic.Pointer[map[K]*V]
+}
+
+func (c *cowMap[K, V]) Get(key K) *V {
+	if m := c.m.Load(); m != nil {
+		return (*m)[key]
+	}
+	return nil
+}
+
+// GetOrInit returns the value of key, the value is created by init if key not exists.
+func (c *cowMap[K, V]) GetOrInit(key K, init func() *V) *V {
+	if v := c.Get(key); v != nil {
+		return v
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if v := c.Get(key); v != nil {
+		return v
+	}
+	v := init()
+	c.storeLocked(key, v)
+	return v
+}
+
+func (c *cowMap[K, V]) Set(key K, value *V) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.storeLocked(key, value)
+}
+
+func (c *cowMap[K, V]) storeLocked(key K, value *V) {
+	m := map[K]*V{}
+	if old := c.m.Load(); old != nil {
+		for k, v := range *old {
+			m[k] = v
+		}
+	}
+	m[key] = value
+	c.m.Store(&m)
+}
+
+func (c *cowMap[K, V]) Delete(key K) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old := c.m.Load()
+	if old == nil {
+		return
+	}
+	m := make(map[K]*V, len(*old))
+	for k, v := range *old {
+		if k != key {
+			m[k] = v
+		}
+	}
+	c.m.Store(&m)
+}
+
+// Clear deletes all keys.
+func (c *cowMap[K, V]) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.m.Store(nil)
+}
+
+func (c *cowMap[K, V]) ForEach(iter func(k K, v *V)) {
+	if m := c.m.Load(); m != nil {
+		for k, v := range *m {
+			iter(k, v)
+		}
+	}
+}
+
+type objectName struct {
+	namespace namespaceName
+	name      string
+}
+
+// entry is a stored object with its accounting.
+type entry struct {
+	store.Object
+	// size is the estimated size of the object.
+	size int64
+	// seq is the order the object is stored, the smallest is the least recently updated.
+	seq uint64
+}
+
+// tombstoneOverhead is the estimated size of a tombstone besides its namespace and name.
+const tombstoneOverhead = 48
+
+// minSweep is the number of tombstones of a shard to start sweeping.
+const minSweep = 64
+
+func tombstoneSize(key objectName) int64 {
+	return int64(len(key.namespace)+len(key.name)) + tombstoneOverhead
+}
+
+// objectShard holds a part of the objects of a gvr in a cluster.
+type objectShard struct {
+	lock    sync.RWMutex
+	objects map[namespaceName]map[string]*entry
+	// tombstones resourceVersion of deleted objects, stale events of them will be ignored.
+	tombstones map[objectName]uint64
+	// sweepAt is the number of tombstones to sweep them again.
+	sweepAt int
+}
+
+// set stores e unless the stored object or the tombstone of it has a newer resourceVersion,
+// old is the replaced object which is nil if the object did not exist, freed is the size of the deleted tombstone.
+func (s *objectShard) set(ns namespaceName, name string, e *entry) (set bool, old *entry, freed int64) {
+	rv, rvOk := resourceVersion(e.Obj)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := objectName{namespace: ns, name: name}
+	old = s.objects[ns][name]
+	if rvOk {
+		if old == nil {
+			if ts, ok := s.tombstones[key]; ok && rv <= ts {
+				return false, nil, 0
+			}
+		} else if oldRv, ok := resourceVersion(old.Obj); ok && rv < oldRv {
+			return false, nil, 0
+		}
+	}
+	if s.objects == nil {
+		s.objects = map[namespaceName]map[string]*entry{}
+	}
+	if s.objects[ns] == nil {
+		s.objects[ns] = map[string]*entry{}
+	}
+	s.objects[ns][name] = e
+	if _, ok := s.tombstones[key]; ok {
+		delete(s.tombstones, key)
+		freed = tombstoneSize(key)
+	}
+	return true, old, freed
+}
+
+// delete deletes the object unless the stored one has a newer resourceVersion, which means
+// the object was created again after the deletion, rv is recorded in tombstones if rvOk.
+// The tombstones not newer than watermark, the resourceVersion observed by the watcher, are swept
+// when there are too many of them. It returns the deleted object and the size change of the tombstones.
+func (s *objectShard) delete(ns namespaceName, name string, rv uint64, rvOk bool, watermark uint64) (*entry, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old := s.objects[ns][name]
+	if old != nil && rvOk {
+		if oldRv, ok := resourceVersion(old.Obj); ok && rv < oldRv {
+			return nil, 0
+		}
+	}
+	if old != nil {
+		s.deleteLocked(ns, name)
+	}
+	var delta int64
+	if rvOk && rv > watermark {
+		key := objectName{namespace: ns, name: name}
+		if ts, ok := s.tombstones[key]; !ok || rv > ts {
+			if s.tombstones == nil {
+				s.tombstones = map[objectName]uint64{}
+			}
+			if !ok {
+				delta += tombstoneSize(key)
+			}
+			s.tombstones[key] = rv
+		}
+		if len(s.tombstones) > s.sweepAt && len(s.tombstones) > minSweep {
+			delta -= s.sweepLocked(watermark)
+		}
+	}
+	return old, delta
+}
+
+// sweepLocked deletes the tombstones not newer than watermark, the watcher has sent the events
+// before watermark in order, so they can not be hit by stale events any more.
+// It returns the size of the deleted tombstones.
+func (s *objectShard) sweepLocked(watermark uint64) int64 {
+	var freed int64
+	for key, ts := range s.tombstones {
+		if ts <= watermark {
+			delete(s.tombstones, key)
+			freed += tombstoneSize(key)
+		}
+	}
+	// sweep again after the live tombstones are doubled
+	s.sweepAt = 2 * len(s.tombstones)
+	return freed
+}
+
+// evict deletes the object if it's not updated since seq, without tombstone.
+func (s *objectShard) evict(ns namespaceName, name string, seq uint64) *entry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old := s.objects[ns][name]
+	if old == nil || old.seq != seq {
+		return nil
+	}
+	s.deleteLocked(ns, name)
+	return old
+}
+
+// toMetadataOnly replaces the objects by their metadata, the entries are copied since they are read
+// without the lock. It returns the size freed.
+func (s *objectShard) toMetadataOnly(gvr store.GroupVersionResource) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var freed int64
+	for _, nsObjs := range s.objects {
+		for name, e := range nsObjs {
+			if e.Annotations[constants.MetadataOnlyAnno] == "true" {
+				continue
+			}
+			ne := *e
+			toMetadataOnly(gvr, &ne)
+			nsObjs[name] = &ne
+			freed += e.size - ne.size
+		}
+	}
+	return freed
+}
+
+func (s *objectShard) deleteLocked(ns namespaceName, name string) {
+	delete(s.objects[ns], name)
+	if len(s.objects[ns]) == 0 {
+		delete(s.objects, ns)
+	}
+}
+
+func (s *objectShard) get(ns namespaceName, name string) *entry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.objects[ns][name]
+}
+
+// namedEntry is an entry with its namespace and name, which orders the objects of shards.
+type namedEntry struct {
+	objectName
+	*entry
+}
+
+// byName orders named entries by namespace and name.
+type byName []namedEntry
+
+func (b byName) Len() int      { return len(b) }
+func (b byName) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byName) Less(i, j int) bool {
+	if b[i].namespace != b[j].namespace {
+		return b[i].namespace < b[j].namespace
+	}
+	return b[i].name < b[j].name
+}
+
+// appendObjects appends the objects in namespace, or all objects if namespace is empty, to objs.
+func (s *objectShard) appendObjects(objs byName, namespace string) byName {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if namespace != "" {
+		ns := namespaceName(namespace)
+		for name, o := range s.objects[ns] {
+			objs = append(objs, namedEntry{objectName: objectName{namespace: ns, name: name}, entry: o})
+		}
+		return objs
+	}
+	for ns, nsObjs := range s.objects {
+		for name, o := range nsObjs {
+			objs = append(objs, namedEntry{objectName: objectName{namespace: ns, name: name}, entry: o})
+		}
+	}
+	return objs
+}
+
+// usage is the number and the size of objects.
+type usage struct {
+	objects int64
+	bytes   int64
+}
+
+func (u *usage) add(objects, bytes int64) {
+	atomic.AddInt64(&u.objects, objects)
+	atomic.AddInt64(&u.bytes, bytes)
+}
+
+func (u *usage) load() (objects, bytes int64) {
+	return atomic.LoadInt64(&u.objects), atomic.LoadInt64(&u.bytes)
+}
+
+// clusterStore holds the objects of a gvr in a cluster, which are distributed to shards
+// by namespace and name, so that the writers of different objects rarely contend.
+type clusterStore struct {
+	shards [shardCount]objectShard
+	// counts the number of objects in each namespace, namespaceName - *int64
+	counts sync.Map
+	// usage includes the size of tombstones
+	usage usage
+	// watermark is the resourceVersion observed by the watcher.
+	watermark uint64
+}
+
+// observe records the resourceVersion observed by the watcher.
+func (c *clusterStore) observe(rv uint64) {
+	for {
+		old := atomic.LoadUint64(&c.watermark)
+		if rv <= old || atomic.CompareAndSwapUint64(&c.watermark, old, rv) {
+			return
+		}
+	}
+}
+
+func newClusterStore() *clusterStore {
+	return &clusterStore{}
+}
+
+func (c *clusterStore) shard(ns namespaceName, name string) *objectShard {
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(ns); i++ {
+		h = (h ^ uint32(ns[i])) * 16777619
+	}
+	h = (h ^ '/') * 16777619
+	for i := 0; i < len(name); i++ {
+		h = (h ^ uint32(name[i])) * 16777619
+	}
+	return &c.shards[h%shardCount]
+}
+
+// count adds delta to the number of objects in ns and returns the result.
+func (c *clusterStore) count(ns namespaceName, delta int64) int64 {
+	v, ok := c.counts.Load(ns)
+	if !ok {
+		v, _ = c.counts.LoadOrStore(ns, new(int64))
+	}
+	return atomic.AddInt64(v.(*int64), delta)
+}
+
+// size returns the number of objects in namespace, or all objects if namespace is empty.
+func (c *clusterStore) size(namespace string) int64 {
+	if namespace == "" {
+		n, _ := c.usage.load()
+		return n
+	}
+	// a query must not create the counter of a namespace
+	if v, ok := c.counts.Load(namespaceName(namespace)); ok {
+		return atomic.LoadInt64(v.(*int64))
+	}
+	return 0
+}
+
+// appendObjects appends the objects in namespace, or all objects if namespace is empty, to objs
+// in the order of namespace and name, so that the sort of queries by the default keys does nothing.
+// Each shard is read under its own lock, so that a query never blocks the writers of the whole cluster,
+// the objects are immutable and can be read after the lock is released.
+func (c *clusterStore) appendObjects(objs []*entry, namespace string) []*entry {
+	// the counters are updated after the shards, so the size is only the capacity
+	var named byName
+	if n := c.size(namespace); n > 0 {
+		named = make(byName, 0, n)
+	}
+	for i := range c.shards {
+		named = c.shards[i].appendObjects(named, namespace)
+	}
+	sort.Sort(named)
+	for _, o := range named {
+		objs = append(objs, o.entry)
+	}
+	return objs
+}
+
+// gvrStore holds the objects and the configuration of a gvr, index, text and limit are not changed
+// after the gvr is shared.
+type gvrStore struct {
+	index map[string]string
+	// text full text index of the searchable fields, it's nil if no field is searchable
+	text     *textIndex
+	clusters cowMap[clusterName, clusterStore]
+	usage    usage
+	limit    common.CacheLimit
+	// mode is how the objects are cached, see cacheMode
+	mode int32
+	// evicted is the number of objects evicted by limits
+	evicted int64
+	// queue is the order to evict objects, it's nil if the objects are never evicted.
+	queue *evictQueue
+	// admitted is set once the first object is stored, g is not refused by the global limit after that.
+	admitted int32
+	// lock is held by the writers of objects for reading, and by drop, Clean and RemoveResource for writing,
+	// so that no object is stored after the objects are dropped.
+	lock sync.RWMutex
+}
+
+func (g *gvrStore) cluster(cluster string) *clusterStore {
+	return g.clusters.GetOrInit(clusterName(cluster), newClusterStore)
+}
+
+// forEachObject calls iter with the objects of all clusters in namespace, or all namespaces if it's empty,
+// in the order of cluster, namespace and name.
+func (g *gvrStore) forEachObject(namespace string, iter func(cluster string, o *store.Object)) {
+	var cnames []clusterName
+	g.clusters.ForEach(func(cname clusterName, c *clusterStore) {
+		cnames = append(cnames, cname)
+	})
+	sort.Slice(cnames, func(i, j int) bool {
+		return cnames[i] < cnames[j]
+	})
+	var objs []*entry
+	for _, cname := range cnames {
+		c := g.clusters.Get(cname)
+		if c == nil {
+			continue
+		}
+		objs = c.appendObjects(objs[:0], namespace)
+		for _, o := range objs {
+			iter(string(cname), &o.Object)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package memory
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DaoCloud/ckube/page"
+	"github.com/DaoCloud/ckube/store"
+)
+
+func TestMemoryStore_Shards(t *testing.T) {
+	m := NewMemoryStore(testIndexConf).(*memoryStore)
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, m.OnResourceAdded(podsGVR, "test", testPod("pod-"+strconv.Itoa(i))))
+	}
+	c := m.resources.Get(podsGVR).clusters.Get("test")
+	used := 0
+	for i := range c.shards {
+		if len(c.shards[i].objects) > 0 {
+			used++
+		}
+	}
+	assert.Greater(t, used, 1)
+	assert.Equal(t, int64(200), c.count("test", 0))
+
+	// modified objects are not counted again
+	assert.NoError(t, m.OnResourceModified(podsGVR, "test", testPod("pod-1")))
+	assert.NoError(t, m.OnResourceDeleted(podsGVR, "test", testPod("pod-2")))
+	assert.NoError(t, m.OnResourceDeleted(podsGVR, "test", testPod("pod-2")))
+	assert.Equal(t, int64(199), c.count("test", 0))
+	res := m.Query(podsGVR, store.Query{Namespace: "test"})
+	assert.NoError(t, res.Error)
+	assert.Equal(t, int64(199), res.Total)
+	// the objects of shards are in the order of namespace and name
+	objs := c.appendObjects(nil, "")
+	for i := 1; i < len(objs); i++ {
+		assert.Less(t, objs[i-1].Index["name"], objs[i].Index["name"])
+	}
+
+	assert.NoError(t, m.Clean(podsGVR, "test"))
+	res = m.Query(podsGVR, store.Query{Paginate: page.Paginate{Page: 1, PageSize: 10}})
+	assert.Equal(t, int64(0), res.Total)
+	assert.Error(t, m.Clean(podsGVR, "not-exists"))
+	assert.Error(t, m.OnResourceAdded(store.GroupVersionResource{Resource: "not-exists"}, "test", testPod("pod-1")))
+}
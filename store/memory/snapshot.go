@@ -0,0 +1,112 @@
+package memory
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/DaoCloud/ckube/store"
+)
+
+const (
+	// defaultSnapshotTTL is the time a snapshot is kept since it's read last time.
+	defaultSnapshotTTL = 5 * time.Minute
+	maxSnapshots       = 256
+)
+
+type snapshot struct {
+	gvr    store.GroupVersionResource
+	query  store.Query
+	page   *queryPage
+	expire time.Time
+}
+
+// snapshots pins the sorted objects of the paginated queries, so that the following pages of a query
+// are read from the same view of store even if the store is changed between the pages.
+// The objects are immutable, so a snapshot only holds the references of them.
+type snapshots struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]*snapshot
+}
+
+// WithSnapshotTTL sets the time a snapshot of paginated query is kept since it's read last time, 0 disables snapshots.
+func WithSnapshotTTL(ttl time.Duration) Option {
+	return func(m *memoryStore) {
+		m.snapshots.ttl = ttl
+	}
+}
+
+// snapshotQuery returns query without the fields which differ between the pages.
+func snapshotQuery(query store.Query) store.Query {
+	query.Page = 0
+	query.PageSize = 0
+	query.Total = 0
+	query.Snapshot = ""
+	return query
+}
+
+func newSnapshotID() string {
+	bs := make([]byte, 8)
+	_, _ = rand.Read(bs)
+	return hex.EncodeToString(bs)
+}
+
+// get returns the page pinned by the snapshot id for query, and extends the expiration of it.
+// ok is false if the snapshot is expired, and the page is nil if the snapshot is not of the query.
+func (s *snapshots) get(id string, gvr store.GroupVersionResource, query store.Query) (*queryPage, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	e, ok := s.entries[id]
+	if !ok || now.After(e.expire) {
+		delete(s.entries, id)
+		return nil, false
+	}
+	if e.gvr != gvr || e.query != snapshotQuery(query) {
+		return nil, true
+	}
+	e.expire = now.Add(s.ttl)
+	return e.page, true
+}
+
+// pin pins page of query, the id of the snapshot is set to the page if it's not pinned before,
+// so it must be called before the page is shared. The page may be pinned again if it's served
+// from the query cache, the snapshot is refreshed then.
+func (s *snapshots) pin(gvr store.GroupVersionResource, query store.Query, page *queryPage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	if page.snapshot != "" {
+		if e, ok := s.entries[page.snapshot]; ok {
+			e.expire = now.Add(s.ttl)
+			return
+		}
+	}
+	if s.entries == nil {
+		s.entries = map[string]*snapshot{}
+	}
+	if len(s.entries) >= maxSnapshots {
+		var oldest string
+		for id, e := range s.entries {
+			if now.After(e.expire) {
+				delete(s.entries, id)
+			} else if oldest == "" || e.expire.Before(s.entries[oldest].expire) {
+				oldest = id
+			}
+		}
+		if len(s.entries) >= maxSnapshots {
+			delete(s.entries, oldest)
+		}
+	}
+	if page.snapshot == "" {
+		page.snapshot = newSnapshotID()
+	}
+	s.entries[page.snapshot] = &snapshot{
+		gvr:    gvr,
+		query:  snapshotQuery(query),
+		page:   page,
+		expire: now.Add(s.ttl),
+	}
+}
@@ -0,0 +1,166 @@
+package memory
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/DaoCloud/ckube/page"
+	"github.com/DaoCloud/ckube/store"
+)
+
+func podNames(items []interface{}) []string {
+	names := []string{}
+	for _, item := range items {
+		names = append(names, item.(*corev1.Pod).Name)
+	}
+	return names
+}
+
+func TestMemoryStore_Snapshot(t *testing.T) {
+	cases := []struct {
+		name         string
+		ttl          time.Duration
+		query        func(snapshot string) store.Query
+		expectNames  []string
+		expectTotal  int64
+		expectError  error
+		expectPinned bool
+	}{
+		{
+			name: "next page from snapshot",
+			query: func(snapshot string) store.Query {
+				return store.Query{Namespace: "test", Paginate: page.Paginate{Page: 2, PageSize: 2, Snapshot: snapshot}}
+			},
+			expectNames:  []string{"pod-2", "pod-3"},
+			expectTotal:  5,
+			expectPinned: true,
+		},
+		{
+			name: "next page without snapshot",
+			query: func(snapshot string) store.Query {
+				return store.Query{Namespace: "test", Paginate: page.Paginate{Page: 2, PageSize: 2}}
+			},
+			expectNames:  []string{"pod-4", "pod-5"},
+			expectTotal:  5,
+			expectPinned: true,
+		},
+		{
+			name: "snapshot of another query",
+			query: func(snapshot string) store.Query {
+				return store.Query{Namespace: "test", Paginate: page.Paginate{Page: 2, PageSize: 1, Search: "name=pod", Snapshot: snapshot}}
+			},
+			expectNames:  []string{"pod-3"},
+			expectTotal:  5,
+			expectPinned: true,
+		},
+		{
+			name: "expired",
+			ttl:  10 * time.Millisecond,
+			query: func(snapshot string) store.Query {
+				time.Sleep(20 * time.Millisecond)
+				return store.Query{Namespace: "test", Paginate: page.Paginate{Page: 2, PageSize: 2, Snapshot: snapshot}}
+			},
+			expectError: store.ErrSnapshotExpired,
+		},
+		{
+			name: "first page with expired snapshot",
+			ttl:  10 * time.Millisecond,
+			query: func(snapshot string) store.Query {
+				time.Sleep(20 * time.Millisecond)
+				return store.Query{Namespace: "test", Paginate: page.Paginate{Page: 1, PageSize: 2, Snapshot: snapshot}}
+			},
+			expectNames:  []string{"pod-0", "pod-3"},
+			expectTotal:  5,
+			expectPinned: true,
+		},
+		{
+			name: "one page",
+			query: func(snapshot string) store.Query {
+				return store.Query{Namespace: "test", Paginate: page.Paginate{Page: 1, PageSize: 10}}
+			},
+			expectNames: []string{"pod-0", "pod-3", "pod-4", "pod-5", "pod-6"},
+			expectTotal: 5,
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			var opts []Option
+			if c.ttl > 0 {
+				opts = append(opts, WithSnapshotTTL(c.ttl))
+			}
+			m := NewMemoryStore(testIndexConf, opts...)
+			for i := 0; i < 5; i++ {
+				_ = m.OnResourceAdded(podsGVR, "test", testPod(fmt.Sprintf("pod-%d", i)))
+			}
+			first := m.Query(podsGVR, store.Query{Namespace: "test", Paginate: page.Paginate{Page: 1, PageSize: 2}})
+			assert.Equal(t, []string{"pod-0", "pod-1"}, podNames(first.Items))
+			assert.NotEmpty(t, first.Snapshot)
+			// changes between the pages
+			_ = m.OnResourceDeleted(podsGVR, "test", testPod("pod-1"))
+			_ = m.OnResourceDeleted(podsGVR, "test", testPod("pod-2"))
+			_ = m.OnResourceAdded(podsGVR, "test", testPod("pod-5"))
+			_ = m.OnResourceAdded(podsGVR, "test", testPod("pod-6"))
+
+			res := m.Query(podsGVR, c.query(first.Snapshot))
+			assert.Equal(t, c.expectError, res.Error)
+			if c.expectError != nil {
+				return
+			}
+			assert.Equal(t, c.expectNames, podNames(res.Items))
+			assert.Equal(t, c.expectTotal, res.Total)
+			assert.Equal(t, c.expectPinned, res.Snapshot != "")
+		})
+	}
+}
+
+func TestSnapshots_Bounded(t *testing.T) {
+	s := snapshots{ttl: time.Minute}
+	pages := []*queryPage{}
+	for i := 0; i < maxSnapshots*2; i++ {
+		p := &queryPage{}
+		s.pin(podsGVR, store.Query{Namespace: fmt.Sprint(i)}, p)
+		pages = append(pages, p)
+	}
+	assert.Len(t, s.entries, maxSnapshots)
+	last := pages[len(pages)-1]
+	p, ok := s.get(last.snapshot, podsGVR, store.Query{Namespace: fmt.Sprint(maxSnapshots*2 - 1), Paginate: page.Paginate{Page: 3}})
+	assert.True(t, ok)
+	assert.Equal(t, last, p)
+	_, ok = s.get(pages[0].snapshot, podsGVR, store.Query{Namespace: "0"})
+	assert.False(t, ok)
+}
+
+func TestMemoryStore_SnapshotLabelSelector(t *testing.T) {
+	m := NewMemoryStore(testIndexConf)
+	labeled := func(i int) *corev1.Pod {
+		p := testPod(fmt.Sprintf("pod-%d", i))
+		p.Labels = map[string]string{"app": []string{"a", "b"}[i%2]}
+		return p
+	}
+	for i := 0; i < 5; i++ {
+		_ = m.OnResourceAdded(podsGVR, "test", labeled(i))
+	}
+	query := store.Query{Namespace: "test", LabelSelector: "app=a", Paginate: page.Paginate{Page: 1, PageSize: 2}}
+	first := m.QueryIter(podsGVR, query)
+	assert.NoError(t, first.Error)
+	assert.Equal(t, []string{"pod-0", "pod-2"}, podNames(store.Collect(first.Iterator())))
+	assert.Equal(t, int64(3), first.Total)
+	assert.NotEmpty(t, first.Snapshot)
+	// changes between the pages
+	_ = m.OnResourceDeleted(podsGVR, "test", labeled(4))
+	_ = m.OnResourceAdded(podsGVR, "test", labeled(6))
+
+	query.Page = 2
+	query.Snapshot = first.Snapshot
+	res := m.QueryIter(podsGVR, query)
+	assert.NoError(t, res.Error)
+	assert.Equal(t, []string{"pod-4"}, podNames(store.Collect(res.Iterator())))
+	assert.Equal(t, int64(3), res.Total)
+
+	res = m.QueryIter(podsGVR, store.Query{Namespace: "test", LabelSelector: "app in (a"})
+	assert.Error(t, res.Error)
+}
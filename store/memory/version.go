@@ -0,0 +1,94 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/DaoCloud/ckube/store"
+)
+
+type versionKey struct {
+	gvr     store.GroupVersionResource
+	cluster string
+}
+
+// versionTracker tracks the max resourceVersion observed by watchers of each gvr and cluster.
+type versionTracker struct {
+	lock     sync.Mutex
+	versions map[versionKey]uint64
+	// changed is closed when any version is updated, it is created only if someone is waiting.
+	changed chan struct{}
+}
+
+func (t *versionTracker) observe(key versionKey, rv uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.versions == nil {
+		t.versions = map[versionKey]uint64{}
+	}
+	if rv <= t.versions[key] {
+		return
+	}
+	t.versions[key] = rv
+	if t.changed != nil {
+		close(t.changed)
+		t.changed = nil
+	}
+}
+
+func (t *versionTracker) wait(ctx context.Context, key versionKey, rv uint64) error {
+	for {
+		t.lock.Lock()
+		if t.versions[key] >= rv {
+			t.lock.Unlock()
+			return nil
+		}
+		if t.changed == nil {
+			t.changed = make(chan struct{})
+		}
+		changed := t.changed
+		t.lock.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func parseResourceVersion(resourceVersion string) (uint64, error) {
+	rv, err := strconv.ParseUint(resourceVersion, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid resourceVersion %q", resourceVersion)
+	}
+	return rv, nil
+}
+
+func (m *memoryStore) OnResourceVersion(gvr store.GroupVersionResource, cluster string, resourceVersion string) error {
+	rv, err := parseResourceVersion(resourceVersion)
+	if err != nil {
+		return err
+	}
+	m.observe(gvr, cluster, rv)
+	return nil
+}
+
+// observe records rv observed in cluster, which is also the watermark of the tombstones of the cluster.
+func (m *memoryStore) observe(gvr store.GroupVersionResource, cluster string, rv uint64) {
+	m.versions.observe(versionKey{gvr: gvr, cluster: cluster}, rv)
+	if g := m.resources.Get(gvr); g != nil {
+		if c := g.clusters.Get(clusterName(cluster)); c != nil {
+			c.observe(rv)
+		}
+	}
+}
+
+func (m *memoryStore) WaitResourceVersion(ctx context.Context, gvr store.GroupVersionResource, cluster string, resourceVersion string) error {
+	rv, err := parseResourceVersion(resourceVersion)
+	if err != nil {
+		return err
+	}
+	return m.versions.wait(ctx, versionKey{gvr: gvr, cluster: cluster}, rv)
+}
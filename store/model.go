@@ -1,5 +1,10 @@
 package store
 
+import "fmt"
+
+// ErrSnapshotExpired is returned if the snapshot of a query is expired or not found.
+var ErrSnapshotExpired = fmt.Errorf("snapshot is expired, please query from the first page")
+
 type GroupVersionResource struct {
 	Group    string
 	Version  string
@@ -9,10 +14,104 @@ type GroupVersionResource struct {
 type QueryResult struct {
 	Error error         `json:"error,omitempty"`
 	Items []interface{} `json:"items"`
-	Total int64         `json:"total"`
+	// Iter yields the items one by one instead of Items if it's not nil, it can be iterated only once.
+	Iter  Iterator `json:"-"`
+	Total int64    `json:"total"`
+	// Sort is the sort actually applied to Items.
+	Sort string `json:"sort,omitempty"`
+	// Snapshot is the id of the snapshot the following pages of the query can be read from.
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// Iterator returns the iterator of the items of r.
+func (r QueryResult) Iterator() Iterator {
+	if r.Iter != nil {
+		return r.Iter
+	}
+	return NewSliceIterator(r.Items)
+}
+
+const (
+	// ModeFull caches the whole objects.
+	ModeFull = "full"
+	// ModeMetadataOnly caches only the metadata of the objects stored since the limit is exceeded.
+	ModeMetadataOnly = "metadata_only"
+	// ModePassthrough stops caching the resource since the limit is exceeded.
+	ModePassthrough = "passthrough"
+	// ModeRefused refuses caching the resource since it starts after the limit is exceeded.
+	ModeRefused = "refused"
+)
+
+// Status is the usage of the store, the sizes are estimated by the size of json of the objects.
+type Status struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	// MaxObjects, MaxBytes and Policy are the global limit.
+	MaxObjects int64            `json:"max_objects,omitempty"`
+	MaxBytes   int64            `json:"max_bytes,omitempty"`
+	Policy     string           `json:"policy,omitempty"`
+	Resources  []ResourceStatus `json:"resources"`
+}
+
+// ResourceStatus is the usage of a cached resource.
+type ResourceStatus struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	Objects  int64  `json:"objects"`
+	Bytes    int64  `json:"bytes"`
+	// Evicted is the number of the objects evicted by the limit.
+	Evicted int64 `json:"evicted"`
+	// Mode is how the objects are cached: full, metadata_only, passthrough or refused.
+	Mode       string `json:"mode"`
+	MaxObjects int64  `json:"max_objects,omitempty"`
+	MaxBytes   int64  `json:"max_bytes,omitempty"`
+	Policy     string `json:"policy,omitempty"`
 }
 
 type Object struct {
 	Index map[string]string
-	Obj   interface{}
+	// Annotations are injected to the copies of Obj returned to the readers.
+	Annotations map[string]string
+	// Obj is an immutable snapshot, it must not be changed after stored.
+	Obj interface{}
+}
+
+// Iterator yields the items of a query one by one, so that they are not materialized at once.
+type Iterator interface {
+	// Next returns the next item, false if there are no more items.
+	Next() (interface{}, bool)
+	// Len returns the number of the remaining items.
+	Len() int
+}
+
+type sliceIterator struct {
+	items []interface{}
+}
+
+// NewSliceIterator returns the iterator of items.
+func NewSliceIterator(items []interface{}) Iterator {
+	return &sliceIterator{items: items}
+}
+
+func (s *sliceIterator) Next() (interface{}, bool) {
+	if len(s.items) == 0 {
+		return nil, false
+	}
+	item := s.items[0]
+	s.items = s.items[1:]
+	return item, true
+}
+
+func (s *sliceIterator) Len() int {
+	return len(s.items)
+}
+
+// Collect returns the remaining items of it.
+func Collect(it Iterator) []interface{} {
+	var items []interface{}
+	for item, ok := it.Next(); ok; item, ok = it.Next() {
+		items = append(items, item)
+	}
+	return items
 }
@@ -0,0 +1,426 @@
+package relation
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/page"
+	"github.com/DaoCloud/ckube/store"
+	"github.com/DaoCloud/ckube/utils"
+)
+
+// maxOwnerDepth limits how many levels of ownerReferences will be followed.
+const maxOwnerDepth = 8
+
+// ref is a reference from an object to other objects of kind,
+// matched by uid, name or label selector.
+type ref struct {
+	kind      string
+	namespace string
+	name      string
+	uid       string
+	selector  labels.Selector
+}
+
+// object is an object of a cached resource, its metadata is read without conversion and
+// the content, references and owners are built when needed. It's not safe for concurrent use.
+type object struct {
+	v1.Object
+	gvr     store.GroupVersionResource
+	kind    string
+	cluster string
+	raw     interface{}
+	// content is the json map of raw
+	content map[string]interface{}
+	refs    []ref
+	// owners is the chain of cached owners, nil if not resolved yet
+	owners []*object
+}
+
+func newObject(cluster string, gvr store.GroupVersionResource, kind string, obj interface{}) *object {
+	o := &object{
+		gvr:     gvr,
+		kind:    kind,
+		cluster: cluster,
+		raw:     obj,
+	}
+	if meta, ok := obj.(v1.Object); ok {
+		o.Object = meta
+	} else {
+		u := &unstructured.Unstructured{Object: utils.Obj2JSONMap(obj)}
+		o.Object = u
+		o.content = u.Object
+	}
+	return o
+}
+
+// fields returns the json map of the object.
+func (o *object) fields() map[string]interface{} {
+	if o.content == nil {
+		o.content = utils.Obj2JSONMap(o.raw)
+	}
+	return o.content
+}
+
+func (o *object) key() string {
+	return o.cluster + "/" + o.kind + "/" + o.GetNamespace() + "/" + o.GetName()
+}
+
+func (r ref) matches(o *object) bool {
+	if r.kind != o.kind {
+		return false
+	}
+	if r.namespace != "" && o.GetNamespace() != "" && r.namespace != o.GetNamespace() {
+		return false
+	}
+	if r.selector != nil {
+		return r.selector.Matches(labels.Set(o.GetLabels()))
+	}
+	if r.uid != "" && o.GetUID() != "" {
+		return r.uid == string(o.GetUID())
+	}
+	return r.name == o.GetName()
+}
+
+func labelSelector(obj map[string]interface{}, fields ...string) labels.Selector {
+	m, ok, _ := unstructured.NestedMap(obj, fields...)
+	if !ok {
+		return nil
+	}
+	s := v1.LabelSelector{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(m, &s); err != nil {
+		return nil
+	}
+	if len(s.MatchLabels) == 0 && len(s.MatchExpressions) == 0 {
+		return nil
+	}
+	sel, err := v1.LabelSelectorAsSelector(&s)
+	if err != nil {
+		return nil
+	}
+	return sel
+}
+
+func setSelector(obj map[string]interface{}, fields ...string) labels.Selector {
+	m, _, _ := unstructured.NestedStringMap(obj, fields...)
+	if len(m) == 0 {
+		return nil
+	}
+	return labels.SelectorFromSet(m)
+}
+
+func backendService(backend map[string]interface{}) string {
+	// networking.k8s.io/v1
+	if name, _, _ := unstructured.NestedString(backend, "service", "name"); name != "" {
+		return name
+	}
+	// extensions/v1beta1, networking.k8s.io/v1beta1
+	name, _, _ := unstructured.NestedString(backend, "serviceName")
+	return name
+}
+
+// linkKinds are the kinds of objects which can be referred by the spec of objects of a kind.
+var linkKinds = map[string][]string{
+	"Service":               {"Pod"},
+	"ReplicationController": {"Pod"},
+	"Deployment":            {"Pod", "ReplicaSet"},
+	"ReplicaSet":            {"Pod"},
+	"StatefulSet":           {"Pod"},
+	"DaemonSet":             {"Pod"},
+	"Job":                   {"Pod"},
+	"PersistentVolumeClaim": {"PersistentVolume"},
+	"PersistentVolume":      {"PersistentVolumeClaim"},
+	"Pod":                   {"Node", "PersistentVolumeClaim", "ConfigMap", "Secret"},
+	"Ingress":               {"Service"},
+}
+
+// mayLink reports whether o may refer to objects of kind, without building the references.
+func (o *object) mayLink(kind string) bool {
+	for _, or := range o.GetOwnerReferences() {
+		if or.Kind == kind {
+			return true
+		}
+	}
+	for _, k := range linkKinds[o.kind] {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// links returns all references from o to other objects.
+func (o *object) links() []ref {
+	if o.refs != nil {
+		return o.refs
+	}
+	ns := o.GetNamespace()
+	refs := []ref{}
+	for _, or := range o.GetOwnerReferences() {
+		refs = append(refs, ref{
+			kind:      or.Kind,
+			namespace: ns,
+			name:      or.Name,
+			uid:       string(or.UID),
+		})
+	}
+	o.refs = append(refs, specLinks(o.kind, ns, o.fields())...)
+	return o.refs
+}
+
+// specLinks returns the references from the spec of an object of kind.
+func specLinks(kind, ns string, obj map[string]interface{}) []ref {
+	if _, ok := linkKinds[kind]; !ok {
+		return nil
+	}
+	refs := []ref{}
+	switch kind {
+	case "Service", "ReplicationController":
+		if s := setSelector(obj, "spec", "selector"); s != nil {
+			refs = append(refs, ref{kind: "Pod", namespace: ns, selector: s})
+		}
+	case "Deployment", "ReplicaSet", "StatefulSet", "DaemonSet", "Job":
+		if s := labelSelector(obj, "spec", "selector"); s != nil {
+			refs = append(refs, ref{kind: "Pod", namespace: ns, selector: s})
+			if kind == "Deployment" {
+				refs = append(refs, ref{kind: "ReplicaSet", namespace: ns, selector: s})
+			}
+		}
+	case "PersistentVolumeClaim":
+		if name, _, _ := unstructured.NestedString(obj, "spec", "volumeName"); name != "" {
+			refs = append(refs, ref{kind: "PersistentVolume", name: name})
+		}
+	case "PersistentVolume":
+		name, _, _ := unstructured.NestedString(obj, "spec", "claimRef", "name")
+		claimNs, _, _ := unstructured.NestedString(obj, "spec", "claimRef", "namespace")
+		if name != "" {
+			refs = append(refs, ref{kind: "PersistentVolumeClaim", namespace: claimNs, name: name})
+		}
+	case "Pod":
+		if name, _, _ := unstructured.NestedString(obj, "spec", "nodeName"); name != "" {
+			refs = append(refs, ref{kind: "Node", name: name})
+		}
+		volumes, _, _ := unstructured.NestedSlice(obj, "spec", "volumes")
+		for _, v := range volumes {
+			vm, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if name, _, _ := unstructured.NestedString(vm, "persistentVolumeClaim", "claimName"); name != "" {
+				refs = append(refs, ref{kind: "PersistentVolumeClaim", namespace: ns, name: name})
+			}
+			if name, _, _ := unstructured.NestedString(vm, "configMap", "name"); name != "" {
+				refs = append(refs, ref{kind: "ConfigMap", namespace: ns, name: name})
+			}
+			if name, _, _ := unstructured.NestedString(vm, "secret", "secretName"); name != "" {
+				refs = append(refs, ref{kind: "Secret", namespace: ns, name: name})
+			}
+		}
+	case "Ingress":
+		backends := []map[string]interface{}{}
+		for _, f := range []string{"defaultBackend", "backend"} {
+			if b, ok, _ := unstructured.NestedMap(obj, "spec", f); ok {
+				backends = append(backends, b)
+			}
+		}
+		rules, _, _ := unstructured.NestedSlice(obj, "spec", "rules")
+		for _, rule := range rules {
+			rm, ok := rule.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			paths, _, _ := unstructured.NestedSlice(rm, "http", "paths")
+			for _, p := range paths {
+				pm, ok := p.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if b, ok, _ := unstructured.NestedMap(pm, "backend"); ok {
+					backends = append(backends, b)
+				}
+			}
+		}
+		for _, b := range backends {
+			if name := backendService(b); name != "" {
+				refs = append(refs, ref{kind: "Service", namespace: ns, name: name})
+			}
+		}
+	}
+	return refs
+}
+
+// linked reports whether any reference of from matches to.
+func linked(from, to *object) bool {
+	if !from.mayLink(to.kind) {
+		return false
+	}
+	for _, r := range from.links() {
+		if r.matches(to) {
+			return true
+		}
+	}
+	return false
+}
+
+// Engine resolves relations between objects cached in a store.
+type Engine struct {
+	store store.Store
+}
+
+func NewEngine(s store.Store) *Engine {
+	return &Engine{store: s}
+}
+
+func kindOf(gvr store.GroupVersionResource) (string, error) {
+	kind := strings.TrimSuffix(common.GetGVRKind(gvr.Group, gvr.Version, gvr.Resource), "List")
+	if kind == "" {
+		return "", fmt.Errorf("unknown kind of resource %v", gvr)
+	}
+	return kind, nil
+}
+
+// ownersOf returns the chain of owners of o cached in the store, nearest first.
+func (e *Engine) ownersOf(o *object) []*object {
+	if o.owners != nil {
+		return o.owners
+	}
+	res := []*object{}
+	visited := map[string]bool{o.key(): true}
+	current := []*object{o}
+	for depth := 0; depth < maxOwnerDepth && len(current) > 0; depth++ {
+		next := []*object{}
+		for _, c := range current {
+			for _, or := range c.GetOwnerReferences() {
+				p, ok := common.FindProxy(or.Kind)
+				if !ok {
+					continue
+				}
+				gvr := store.GroupVersionResource{
+					Group:    p.Group,
+					Version:  p.Version,
+					Resource: p.Resource,
+				}
+				if !e.store.IsStoreGVR(gvr) {
+					continue
+				}
+				raw := e.store.Get(gvr, o.cluster, c.GetNamespace(), or.Name)
+				if raw == nil {
+					// cluster scoped owner
+					raw = e.store.Get(gvr, o.cluster, "", or.Name)
+				}
+				if raw == nil {
+					continue
+				}
+				owner := newObject(o.cluster, gvr, p.Kind(), raw)
+				if or.UID != "" && owner.GetUID() != "" && or.UID != owner.GetUID() {
+					continue
+				}
+				if visited[owner.key()] {
+					continue
+				}
+				visited[owner.key()] = true
+				res = append(res, owner)
+				next = append(next, owner)
+			}
+		}
+		current = next
+	}
+	o.owners = res
+	return res
+}
+
+func contains(objs []*object, o *object) bool {
+	for _, obj := range objs {
+		if obj.key() == o.key() {
+			return true
+		}
+	}
+	return false
+}
+
+// related reports whether o is related to src, the owners of o are resolved only if it has owners.
+func (e *Engine) related(src, o *object) bool {
+	if o.cluster != src.cluster || o.key() == src.key() {
+		return false
+	}
+	return linked(src, o) || linked(o, src) || contains(e.ownersOf(src), o) ||
+		(len(o.GetOwnerReferences()) > 0 && contains(e.ownersOf(o), src))
+}
+
+// Owner is an object in the ownerReferences chain of another object.
+type Owner struct {
+	GVR  store.GroupVersionResource
+	Kind string
+	Obj  interface{}
+}
+
+// Object is an object of a cached resource prepared for resolving relations, the references and owners
+// of it are resolved once, so it should be reused to match many objects. It's not safe for concurrent use.
+type Object struct {
+	o *object
+}
+
+// NewObject prepares obj of gvr in cluster for resolving relations.
+func (e *Engine) NewObject(cluster string, gvr store.GroupVersionResource, obj interface{}) (*Object, error) {
+	kind, err := kindOf(gvr)
+	if err != nil {
+		return nil, err
+	}
+	return &Object{o: newObject(cluster, gvr, kind, obj)}, nil
+}
+
+// Owners returns the cached owners of o through the ownerReferences chain, nearest first.
+func (e *Engine) Owners(o *Object) []Owner {
+	res := []Owner{}
+	for _, owner := range e.ownersOf(o.o) {
+		res = append(res, Owner{
+			GVR:  owner.gvr,
+			Kind: owner.kind,
+			Obj:  owner.raw,
+		})
+	}
+	return res
+}
+
+// IsRelated reports whether target is related to o.
+func (e *Engine) IsRelated(o, target *Object) bool {
+	return e.related(o.o, target.o)
+}
+
+// Related returns the objects of target in cluster which are related to obj of gvr, including
+// owners and dependents through the ownerReferences chain and objects selected by or referred by obj.
+func (e *Engine) Related(cluster string, gvr store.GroupVersionResource, obj interface{}, target store.GroupVersionResource) ([]interface{}, error) {
+	kind, err := kindOf(gvr)
+	if err != nil {
+		return nil, err
+	}
+	targetKind, err := kindOf(target)
+	if err != nil {
+		return nil, err
+	}
+	if !e.store.IsStoreGVR(target) {
+		return nil, fmt.Errorf("resource %v is not cached", target)
+	}
+	src := newObject(cluster, gvr, kind, obj)
+	p := page.Paginate{}
+	if err := p.Clusters([]string{cluster}); err != nil {
+		return nil, err
+	}
+	res := e.store.Query(target, store.Query{Paginate: p})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	items := make([]interface{}, 0)
+	for _, item := range res.Items {
+		if e.related(src, newObject(cluster, target, targetKind, item)) {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
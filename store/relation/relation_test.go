@@ -0,0 +1,274 @@
+package relation
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/store"
+)
+
+var (
+	podsGVR     = store.GroupVersionResource{Version: "v1", Resource: "pods"}
+	servicesGVR = store.GroupVersionResource{Version: "v1", Resource: "services"}
+	nodesGVR    = store.GroupVersionResource{Version: "v1", Resource: "nodes"}
+	pvcsGVR     = store.GroupVersionResource{Version: "v1", Resource: "persistentvolumeclaims"}
+	pvsGVR      = store.GroupVersionResource{Version: "v1", Resource: "persistentvolumes"}
+	rsGVR       = store.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+	depsGVR     = store.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+)
+
+type fakeStore struct {
+	store.Store
+	objs map[store.GroupVersionResource][]interface{}
+}
+
+func (f fakeStore) IsStoreGVR(gvr store.GroupVersionResource) bool {
+	_, ok := f.objs[gvr]
+	return ok
+}
+
+func (f fakeStore) Get(gvr store.GroupVersionResource, cluster string, namespace, name string) interface{} {
+	for _, o := range f.objs[gvr] {
+		if oo := o.(metav1.Object); oo.GetNamespace() == namespace && oo.GetName() == name {
+			return o
+		}
+	}
+	return nil
+}
+
+func (f fakeStore) Query(gvr store.GroupVersionResource, query store.Query) store.QueryResult {
+	return store.QueryResult{
+		Items: f.objs[gvr],
+		Total: int64(len(f.objs[gvr])),
+	}
+}
+
+// countingStore counts the Gets to resolve owners.
+type countingStore struct {
+	fakeStore
+	gets *int
+}
+
+func (c countingStore) Get(gvr store.GroupVersionResource, cluster string, namespace, name string) interface{} {
+	*c.gets++
+	return c.fakeStore.Get(gvr, cluster, namespace, name)
+}
+
+func names(items []interface{}) []string {
+	res := []string{}
+	for _, i := range items {
+		res = append(res, i.(metav1.Object).GetName())
+	}
+	return res
+}
+
+func TestEngine_Related(t *testing.T) {
+	common.InitConfig(&common.Config{Proxies: []common.Proxy{
+		{Version: "v1", Resource: "pods", ListKind: "PodList"},
+		{Version: "v1", Resource: "services", ListKind: "ServiceList"},
+		{Version: "v1", Resource: "nodes", ListKind: "NodeList"},
+		{Version: "v1", Resource: "persistentvolumeclaims", ListKind: "PersistentVolumeClaimList"},
+		{Version: "v1", Resource: "persistentvolumes", ListKind: "PersistentVolumeList"},
+		{Group: "apps", Version: "v1", Resource: "replicasets", ListKind: "ReplicaSetList"},
+		{Group: "apps", Version: "v1", Resource: "deployments", ListKind: "DeploymentList"},
+	}})
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test", UID: "dep-uid"},
+	}
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-123",
+			Namespace: "test",
+			UID:       "rs-uid",
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "Deployment", Name: "web", UID: "dep-uid"},
+			},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web-123-abc",
+			Namespace: "test",
+			UID:       "pod-uid",
+			Labels:    map[string]string{"app": "web"},
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: "web-123", UID: "rs-uid"},
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node1",
+			Volumes: []corev1.Volume{
+				{
+					Name: "data",
+					VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"},
+					},
+				},
+			},
+		},
+	}
+	otherPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "other",
+			Namespace: "test",
+			Labels:    map[string]string{"app": "other"},
+		},
+	}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "web"}},
+	}
+	otherNsSvc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "other"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "web"}},
+	}
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "test"},
+		Spec:       corev1.PersistentVolumeClaimSpec{VolumeName: "pv1"},
+	}
+	pv := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv1"}}
+	s := fakeStore{objs: map[store.GroupVersionResource][]interface{}{
+		podsGVR:     {pod, otherPod},
+		servicesGVR: {svc, otherNsSvc},
+		nodesGVR:    {node},
+		pvcsGVR:     {pvc},
+		pvsGVR:      {pv},
+		rsGVR:       {rs},
+		depsGVR:     {dep},
+	}}
+	cases := []struct {
+		name   string
+		gvr    store.GroupVersionResource
+		obj    interface{}
+		target store.GroupVersionResource
+		expect []string
+		err    error
+	}{
+		{
+			name:   "service selects pods",
+			gvr:    servicesGVR,
+			obj:    svc,
+			target: podsGVR,
+			expect: []string{"web-123-abc"},
+		},
+		{
+			name:   "pod selected by services",
+			gvr:    podsGVR,
+			obj:    pod,
+			target: servicesGVR,
+			expect: []string{"web"},
+		},
+		{
+			name:   "pod owner chain",
+			gvr:    podsGVR,
+			obj:    pod,
+			target: depsGVR,
+			expect: []string{"web"},
+		},
+		{
+			name:   "deployment dependents chain",
+			gvr:    depsGVR,
+			obj:    dep,
+			target: podsGVR,
+			expect: []string{"web-123-abc"},
+		},
+		{
+			name:   "pod node",
+			gvr:    podsGVR,
+			obj:    pod,
+			target: nodesGVR,
+			expect: []string{"node1"},
+		},
+		{
+			name:   "pod claims",
+			gvr:    podsGVR,
+			obj:    pod,
+			target: pvcsGVR,
+			expect: []string{"data"},
+		},
+		{
+			name:   "pv to pvc",
+			gvr:    pvsGVR,
+			obj:    pv,
+			target: pvcsGVR,
+			expect: []string{"data"},
+		},
+		{
+			name:   "unknown target",
+			gvr:    podsGVR,
+			obj:    pod,
+			target: store.GroupVersionResource{Version: "v1", Resource: "secrets"},
+			err:    fmt.Errorf("unknown kind of resource { v1 secrets}"),
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			items, err := NewEngine(s).Related("default", c.gvr, c.obj, c.target)
+			assert.Equal(t, c.err, err)
+			if c.err == nil {
+				assert.Equal(t, c.expect, names(items))
+			}
+		})
+	}
+}
+
+func TestLinked_Lazy(t *testing.T) {
+	pod := newObject("c1", podsGVR, "Pod", &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "test"},
+		Spec:       corev1.PodSpec{NodeName: "node1"},
+	})
+	node := newObject("c1", nodesGVR, "Node", &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	assert.True(t, linked(pod, node))
+	assert.False(t, linked(node, pod))
+	// nodes do not refer to other objects, the content is not built
+	assert.Nil(t, node.content)
+	assert.NotNil(t, pod.content)
+
+	otherNode := newObject("c2", nodesGVR, "Node", &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}})
+	assert.False(t, NewEngine(fakeStore{}).related(pod, otherNode))
+}
+
+func TestEngine_ObjectReuse(t *testing.T) {
+	common.InitConfig(&common.Config{Proxies: []common.Proxy{
+		{Version: "v1", Resource: "pods", ListKind: "PodList"},
+		{Version: "v1", Resource: "services", ListKind: "ServiceList"},
+		{Group: "apps", Version: "v1", Resource: "replicasets", ListKind: "ReplicaSetList"},
+	}})
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "web-123", Namespace: "test", UID: "rs-uid"}}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:            "web-123-abc",
+		Namespace:       "test",
+		Labels:          map[string]string{"app": "web"},
+		OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-123", UID: "rs-uid"}},
+	}}
+	gets := 0
+	e := NewEngine(countingStore{fakeStore: fakeStore{objs: map[store.GroupVersionResource][]interface{}{
+		podsGVR: {pod},
+		rsGVR:   {rs},
+	}}, gets: &gets})
+	src, err := e.NewObject("c1", podsGVR, pod)
+	assert.NoError(t, err)
+	related := 0
+	for i := 0; i < 10; i++ {
+		svc, err := e.NewObject("c1", servicesGVR, &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("svc-%d", i), Namespace: "test"},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": fmt.Sprintf("app-%d", i%2)}},
+		})
+		assert.NoError(t, err)
+		if e.IsRelated(src, svc) {
+			related++
+		}
+	}
+	assert.Equal(t, 0, related)
+	// the owners of the source are resolved once
+	assert.Equal(t, 1, gets)
+	assert.Len(t, e.Owners(src), 1)
+	assert.Equal(t, 1, gets)
+}
@@ -29,6 +29,39 @@ var (
 		Name: "ckube_resources_total",
 		Help: "resources count",
 	}, []string{"cluster", "group", "version", "resource", "namespace"})
+	CacheObjects = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ckube_cache_objects",
+		Help: "Cached objects count of resources",
+	}, []string{"group", "version", "resource"})
+	CacheBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ckube_cache_bytes",
+		Help: "Estimated size of cached objects of resources",
+	}, []string{"group", "version", "resource"})
+	CacheEvicted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ckube_cache_evicted_objects_total",
+		Help: "Objects evicted by cache limits",
+	}, []string{"group", "version", "resource"})
+	CacheMode = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ckube_cache_mode",
+		Help: "Mode of resources degraded by cache limits, 1 for the current mode: metadata_only, passthrough or refused",
+	}, []string{"group", "version", "resource", "mode"})
+	FlowControlRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ckube_flowcontrol_requests_total",
+		Help: "Requests count of flow schemas by admission result",
+	}, []string{"flow_schema", "priority_level", "result"})
+	FlowControlExecuting = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ckube_flowcontrol_current_executing_requests",
+		Help: "Executing requests of flow schemas",
+	}, []string{"flow_schema", "priority_level"})
+	FlowControlInQueue = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ckube_flowcontrol_current_inqueue_requests",
+		Help: "Queued requests of flow schemas",
+	}, []string{"flow_schema", "priority_level"})
+	FlowControlWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ckube_flowcontrol_request_wait_duration_seconds",
+		Help:    "Waiting time of requests in queue of flow schemas",
+		Buckets: []float64{0.005, 0.02, 0.05, 0.1, 0.2, 0.5, 1, 2, 5, 10},
+	}, []string{"flow_schema", "priority_level"})
 )
 
 func PromHandler(r *api.ReqContext) interface{} {
@@ -0,0 +1,248 @@
+package watcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/discovery"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/log"
+	"github.com/DaoCloud/ckube/store"
+)
+
+// expandInterval is the interval to expand patterns again to follow the installed or removed resources.
+const expandInterval = 30 * time.Second
+
+const crdPath = "/apis/apiextensions.k8s.io/v1/customresourcedefinitions"
+
+// crdList is the part of apiextensions.k8s.io/v1 CustomResourceDefinitionList used to expand patterns.
+type crdList struct {
+	Items []struct {
+		Spec struct {
+			Group string `json:"group"`
+			Names struct {
+				Plural   string `json:"plural"`
+				Kind     string `json:"kind"`
+				ListKind string `json:"listKind"`
+			} `json:"names"`
+			Scope    string `json:"scope"`
+			Versions []struct {
+				Name    string `json:"name"`
+				Served  bool   `json:"served"`
+				Storage bool   `json:"storage"`
+			} `json:"versions"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// expandedProxy builds the proxy of a resource expanded from pattern p.
+func expandedProxy(p common.Proxy, group, version, resource, kind string, namespaced bool, verbs []string) common.Proxy {
+	index := p.Index
+	if len(index) == 0 {
+		index = common.DefaultIndex
+	}
+	return common.Proxy{
+		Group:      group,
+		Version:    version,
+		Resource:   resource,
+		ListKind:   kind + "List",
+		Index:      index,
+		Searchable: p.Searchable,
+		Namespaced: &namespaced,
+		Verbs:      verbs,
+	}
+}
+
+// expandGroup expands pattern p with resource `*` to the resources in the group which can be listed and watched,
+// the preferred version of the group is used if the version is not set.
+func expandGroup(dc discovery.DiscoveryInterface, p common.Proxy) ([]common.Proxy, error) {
+	version := p.Version
+	if version == "" {
+		groups, err := dc.ServerGroups()
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups.Groups {
+			if g.Name == p.Group {
+				version = g.PreferredVersion.Version
+			}
+		}
+		if version == "" {
+			return nil, fmt.Errorf("group %s is not served", p.Group)
+		}
+	}
+	list, err := dc.ServerResourcesForGroupVersion(schema.GroupVersion{Group: p.Group, Version: version}.String())
+	if err != nil {
+		return nil, err
+	}
+	res := []common.Proxy{}
+	for _, r := range list.APIResources {
+		if strings.Contains(r.Name, "/") {
+			// sub resources
+			continue
+		}
+		if !sets.NewString(r.Verbs...).HasAll("list", "watch") {
+			continue
+		}
+		res = append(res, expandedProxy(p, p.Group, version, r.Name, r.Kind, r.Namespaced, r.Verbs))
+	}
+	return res, nil
+}
+
+// expandCRDs expands pattern p with crd selector to the served version of the selected CRDs in list,
+// the storage version is preferred if the version of p is not set.
+func expandCRDs(list crdList, p common.Proxy) []common.Proxy {
+	res := []common.Proxy{}
+	for _, crd := range list.Items {
+		spec := crd.Spec
+		if p.Group != "" && p.Group != spec.Group {
+			continue
+		}
+		version := ""
+		for _, v := range spec.Versions {
+			if !v.Served {
+				continue
+			}
+			if p.Version != "" {
+				if v.Name == p.Version {
+					version = v.Name
+				}
+			} else if v.Storage || version == "" {
+				version = v.Name
+			}
+		}
+		if version == "" {
+			continue
+		}
+		pp := expandedProxy(p, spec.Group, version, spec.Names.Plural, spec.Names.Kind,
+			spec.Scope == "Namespaced", []string{"get", "list", "watch"})
+		if spec.Names.ListKind != "" {
+			pp.ListKind = spec.Names.ListKind
+		}
+		res = append(res, pp)
+	}
+	return res
+}
+
+// expand expands the patterns to the resources served in the cluster.
+func expand(dc discovery.DiscoveryInterface, patterns []common.Proxy) ([]common.Proxy, error) {
+	res := []common.Proxy{}
+	for _, p := range patterns {
+		if p.CRDSelector != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			bs, err := dc.RESTClient().Get().AbsPath(crdPath).Param("labelSelector", p.CRDSelector).DoRaw(ctx)
+			cancel()
+			if err != nil {
+				return nil, fmt.Errorf("list crds of %s error: %v", p.CRDSelector, err)
+			}
+			list := crdList{}
+			if err := json.Unmarshal(bs, &list); err != nil {
+				return nil, fmt.Errorf("list crds of %s error: %v", p.CRDSelector, err)
+			}
+			res = append(res, expandCRDs(list, p)...)
+			continue
+		}
+		ps, err := expandGroup(dc, p)
+		if err != nil {
+			return nil, fmt.Errorf("expand resources of group %s error: %v", p.Group, err)
+		}
+		res = append(res, ps...)
+	}
+	return res, nil
+}
+
+// expandPatterns expands the patterns in cluster periodically, starts watching the installed resources
+// and stops watching the removed ones.
+func (w *watcher) expandPatterns(cluster string, patterns []common.Proxy) {
+	config := w.clusterConfigs[cluster]
+	dc, err := discovery.NewDiscoveryClientForConfig(&config)
+	if err != nil {
+		log.Errorf("cluster(%s): create discovery client error: %v", cluster, err)
+		return
+	}
+	static := map[store.GroupVersionResource]bool{}
+	for _, r := range w.resources {
+		static[r] = true
+	}
+	expanded := map[store.GroupVersionResource]bool{}
+	for {
+		proxies, err := expand(dc, patterns)
+		if err != nil {
+			log.Warnf("cluster(%s): %v", cluster, err)
+		} else {
+			current := map[store.GroupVersionResource]bool{}
+			for _, p := range proxies {
+				gvr := store.GroupVersionResource{
+					Group:    p.Group,
+					Version:  p.Version,
+					Resource: p.Resource,
+				}
+				if static[gvr] || current[gvr] {
+					continue
+				}
+				current[gvr] = true
+				if expanded[gvr] {
+					continue
+				}
+				w.exposeExpanded(cluster, gvr, p)
+			}
+			for gvr := range expanded {
+				if !current[gvr] {
+					log.Infof("cluster(%s): resource %v is removed, stop caching", cluster, gvr)
+					w.removeExpanded(cluster, gvr)
+				}
+			}
+			expanded = current
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(expandInterval):
+		}
+	}
+}
+
+// exposeExpanded starts caching resource gvr expanded from patterns in cluster, the proxy of it is added
+// when the first cluster serves it.
+func (w *watcher) exposeExpanded(cluster string, gvr store.GroupVersionResource, p common.Proxy) {
+	w.lock.Lock()
+	clusters := w.expanded[gvr]
+	if clusters == nil {
+		clusters = sets.NewString()
+		w.expanded[gvr] = clusters
+	}
+	clusters.Insert(cluster)
+	p.Clusters = clusters.List()
+	if common.AddProxy(p) {
+		log.Infof("cluster(%s): cache resource %v expanded from patterns", cluster, gvr)
+	} else {
+		common.SetProxyClusters(gvr.Group, gvr.Version, gvr.Resource, p.Clusters)
+	}
+	_ = w.store.AddResource(gvr, p.Index, p.Searchable)
+	w.lock.Unlock()
+	w.startWatch(gvr, cluster)
+}
+
+// removeExpanded stops caching resource gvr expanded from patterns in cluster, the resource is
+// removed from the config and the store when no cluster serves it.
+func (w *watcher) removeExpanded(cluster string, gvr store.GroupVersionResource) {
+	w.stopWatch(gvr, cluster)
+	_ = w.store.Clean(gvr, cluster)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	clusters := w.expanded[gvr]
+	clusters.Delete(cluster)
+	if clusters.Len() > 0 {
+		common.SetProxyClusters(gvr.Group, gvr.Version, gvr.Resource, clusters.List())
+		return
+	}
+	delete(w.expanded, gvr)
+	common.RemoveProxy(gvr.Group, gvr.Version, gvr.Resource)
+	_ = w.store.RemoveResource(gvr)
+}
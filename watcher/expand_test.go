@@ -0,0 +1,160 @@
+package watcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/store"
+	"github.com/DaoCloud/ckube/store/memory"
+)
+
+func TestExpandGroup(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	c.Resources = []*v1.APIResourceList{
+		{
+			GroupVersion: "networking.istio.io/v1beta1",
+			APIResources: []v1.APIResource{
+				{Name: "gateways", Kind: "Gateway", Namespaced: true, Verbs: v1.Verbs{"get", "list", "watch"}},
+				{Name: "gateways/status", Kind: "Gateway", Namespaced: true, Verbs: v1.Verbs{"get", "list", "watch"}},
+				{Name: "virtualservices", Kind: "VirtualService", Namespaced: true, Verbs: v1.Verbs{"get", "list", "watch"}},
+				{Name: "reviews", Kind: "Review", Namespaced: true, Verbs: v1.Verbs{"create"}},
+			},
+		},
+		{
+			GroupVersion: "networking.istio.io/v1alpha3",
+			APIResources: []v1.APIResource{
+				{Name: "envoyfilters", Kind: "EnvoyFilter", Namespaced: true, Verbs: v1.Verbs{"get", "list", "watch"}},
+			},
+		},
+	}
+	yes := true
+	index := map[string]string{"name": "{.metadata.name}"}
+	cases := []struct {
+		name    string
+		pattern common.Proxy
+		expect  []common.Proxy
+		err     error
+	}{
+		{
+			name:    "preferred version with default index",
+			pattern: common.Proxy{Group: "networking.istio.io", Resource: "*"},
+			expect: []common.Proxy{
+				{Group: "networking.istio.io", Version: "v1beta1", Resource: "gateways", ListKind: "GatewayList",
+					Index: common.DefaultIndex, Namespaced: &yes, Verbs: []string{"get", "list", "watch"}},
+				{Group: "networking.istio.io", Version: "v1beta1", Resource: "virtualservices", ListKind: "VirtualServiceList",
+					Index: common.DefaultIndex, Namespaced: &yes, Verbs: []string{"get", "list", "watch"}},
+			},
+		},
+		{
+			name:    "specified version and index",
+			pattern: common.Proxy{Group: "networking.istio.io", Version: "v1alpha3", Resource: "*", Index: index},
+			expect: []common.Proxy{
+				{Group: "networking.istio.io", Version: "v1alpha3", Resource: "envoyfilters", ListKind: "EnvoyFilterList",
+					Index: index, Namespaced: &yes, Verbs: []string{"get", "list", "watch"}},
+			},
+		},
+		{
+			name:    "group not served",
+			pattern: common.Proxy{Group: "example.com", Resource: "*"},
+			err:     fmt.Errorf("group example.com is not served"),
+		},
+	}
+	for i, cc := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, cc.name), func(t *testing.T) {
+			res, err := expandGroup(c.Discovery(), cc.pattern)
+			assert.Equal(t, cc.err, err)
+			assert.Equal(t, cc.expect, res)
+		})
+	}
+}
+
+func TestExpandCRDs(t *testing.T) {
+	list := crdList{}
+	_ = json.Unmarshal([]byte(`{"items": [
+  {"spec": {"group": "example.com", "scope": "Namespaced",
+    "names": {"plural": "foos", "kind": "Foo", "listKind": "FooList"},
+    "versions": [{"name": "v1alpha1", "served": true}, {"name": "v1", "served": true, "storage": true}, {"name": "v2", "served": false}]}},
+  {"spec": {"group": "other.io", "scope": "Cluster",
+    "names": {"plural": "bars", "kind": "Bar"},
+    "versions": [{"name": "v1beta1", "served": true, "storage": true}]}}
+]}`), &list)
+	yes, no := true, false
+	verbs := []string{"get", "list", "watch"}
+	cases := []struct {
+		name    string
+		pattern common.Proxy
+		expect  []common.Proxy
+	}{
+		{
+			name:    "all selected",
+			pattern: common.Proxy{CRDSelector: "ckube.io/cache=true"},
+			expect: []common.Proxy{
+				{Group: "example.com", Version: "v1", Resource: "foos", ListKind: "FooList",
+					Index: common.DefaultIndex, Namespaced: &yes, Verbs: verbs},
+				{Group: "other.io", Version: "v1beta1", Resource: "bars", ListKind: "BarList",
+					Index: common.DefaultIndex, Namespaced: &no, Verbs: verbs},
+			},
+		},
+		{
+			name:    "group and version",
+			pattern: common.Proxy{Group: "example.com", Version: "v1alpha1", CRDSelector: "ckube.io/cache=true"},
+			expect: []common.Proxy{
+				{Group: "example.com", Version: "v1alpha1", Resource: "foos", ListKind: "FooList",
+					Index: common.DefaultIndex, Namespaced: &yes, Verbs: verbs},
+			},
+		},
+		{
+			name:    "version not served",
+			pattern: common.Proxy{Group: "example.com", Version: "v2", CRDSelector: "ckube.io/cache=true"},
+			expect:  []common.Proxy{},
+		},
+	}
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%d---%s", i, c.name), func(t *testing.T) {
+			assert.Equal(t, c.expect, expandCRDs(list, c.pattern))
+		})
+	}
+}
+
+func TestWatcher_RemoveExpanded(t *testing.T) {
+	common.InitConfig(&common.Config{})
+	gvr := store.GroupVersionResource{Group: "example.io", Version: "v1", Resource: "foos"}
+	p := expandedProxy(common.Proxy{Group: "example.io", Resource: common.ResourceAll}, gvr.Group, gvr.Version, gvr.Resource,
+		"Foo", true, []string{"get", "list", "watch"})
+	m := memory.NewMemoryStore(map[store.GroupVersionResource]map[string]string{})
+	w := NewWatcher(nil, nil, m).(*watcher)
+	for _, c := range []string{"c1", "c2"} {
+		// watching without api servers
+		w.watching[watchKey{gvr: gvr, cluster: c}] = make(chan struct{})
+		w.exposeExpanded(c, gvr, p)
+	}
+	got, ok := common.GetProxy(gvr.Group, gvr.Version, gvr.Resource)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"c1", "c2"}, got.Clusters)
+	foo := &unstructured.Unstructured{}
+	foo.SetAPIVersion("example.io/v1")
+	foo.SetKind("Foo")
+	foo.SetNamespace("test")
+	foo.SetName("foo")
+	assert.NoError(t, m.OnResourceAdded(gvr, "c2", foo))
+
+	// the resource is still cached in the other cluster
+	w.removeExpanded("c1", gvr)
+	got, _ = common.GetProxy(gvr.Group, gvr.Version, gvr.Resource)
+	assert.False(t, got.ServedBy("c1"))
+	assert.True(t, got.ServedBy("c2"))
+	assert.True(t, m.IsStoreGVR(gvr))
+
+	w.removeExpanded("c2", gvr)
+	_, ok = common.GetProxy(gvr.Group, gvr.Version, gvr.Resource)
+	assert.False(t, ok)
+	assert.False(t, m.IsStoreGVR(gvr))
+	assert.Equal(t, int64(0), m.Status().Objects)
+}
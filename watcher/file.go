@@ -0,0 +1,331 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/log"
+	"github.com/DaoCloud/ckube/store"
+)
+
+// manifestsDebounce is the time to wait for more changes of the manifests before reloading them.
+const manifestsDebounce = 500 * time.Millisecond
+
+// clusterScopedKinds are the cluster scoped kinds registered in the client-go scheme,
+// the other kinds of the scheme are namespaced.
+var clusterScopedKinds = map[schema.GroupKind]bool{
+	{Kind: "Namespace"}:        true,
+	{Kind: "Node"}:             true,
+	{Kind: "PersistentVolume"}: true,
+	{Kind: "ComponentStatus"}:  true,
+	{Group: "rbac.authorization.k8s.io", Kind: "ClusterRole"}:                       true,
+	{Group: "rbac.authorization.k8s.io", Kind: "ClusterRoleBinding"}:                true,
+	{Group: "storage.k8s.io", Kind: "StorageClass"}:                                 true,
+	{Group: "storage.k8s.io", Kind: "CSIDriver"}:                                    true,
+	{Group: "storage.k8s.io", Kind: "CSINode"}:                                      true,
+	{Group: "storage.k8s.io", Kind: "VolumeAttachment"}:                             true,
+	{Group: "scheduling.k8s.io", Kind: "PriorityClass"}:                             true,
+	{Group: "admissionregistration.k8s.io", Kind: "ValidatingWebhookConfiguration"}: true,
+	{Group: "admissionregistration.k8s.io", Kind: "MutatingWebhookConfiguration"}:   true,
+	{Group: "node.k8s.io", Kind: "RuntimeClass"}:                                    true,
+	{Group: "networking.k8s.io", Kind: "IngressClass"}:                              true,
+	{Group: "certificates.k8s.io", Kind: "CertificateSigningRequest"}:               true,
+	{Group: "flowcontrol.apiserver.k8s.io", Kind: "FlowSchema"}:                     true,
+	{Group: "flowcontrol.apiserver.k8s.io", Kind: "PriorityLevelConfiguration"}:     true,
+	{Group: "policy", Kind: "PodSecurityPolicy"}:                                    true,
+	{Group: "extensions", Kind: "PodSecurityPolicy"}:                                true,
+	{Group: "apiserverinternal.k8s.io", Kind: "StorageVersion"}:                     true,
+}
+
+// manifestsScope returns whether the objects of p are namespaced, there is no discovery of api servers
+// for manifests, the kinds out of the client-go scheme must be configured with namespaced.
+func manifestsScope(p common.Proxy, gvk schema.GroupVersionKind) (namespaced bool, ok bool) {
+	if p.Namespaced != nil {
+		return *p.Namespaced, true
+	}
+	// the custom kinds are registered as ObjType once watched
+	obj, err := scheme.Scheme.New(gvk)
+	if err != nil {
+		return false, false
+	}
+	if _, custom := obj.(*ObjType); custom {
+		return false, false
+	}
+	return !clusterScopedKinds[gvk.GroupKind()], true
+}
+
+type manifestKey struct {
+	gvr       store.GroupVersionResource
+	namespace string
+	name      string
+}
+
+type manifest struct {
+	file string
+	// raw is the json of the object to find the modified objects
+	raw []byte
+	obj interface{}
+}
+
+// fileWatcher loads the objects from the yaml or json manifests in a directory to the store as objects of cluster,
+// the changes of the manifests are sent to the store as added, modified and deleted events.
+type fileWatcher struct {
+	dir       string
+	cluster   string
+	resources []store.GroupVersionResource
+	store     store.Store
+	stop      chan struct{}
+	stopOnce  sync.Once
+	fswatcher *fsnotify.Watcher
+	// kinds are the resources of the configured kinds, the Namespaced of them are always set
+	kinds map[schema.GroupVersionKind]common.Proxy
+	// objects are the objects loaded last time
+	objects map[manifestKey]manifest
+}
+
+func NewFileWatcher(dir, cluster string, resources []store.GroupVersionResource, store store.Store) Watcher {
+	return &fileWatcher{
+		dir:       dir,
+		cluster:   cluster,
+		resources: resources,
+		store:     store,
+		stop:      make(chan struct{}),
+		kinds:     map[schema.GroupVersionKind]common.Proxy{},
+		objects:   map[manifestKey]manifest{},
+	}
+}
+
+// Start loads the manifests and watches the changes of the directory.
+func (w *fileWatcher) Start() error {
+	for _, r := range w.resources {
+		p, ok := common.GetProxy(r.Group, r.Version, r.Resource)
+		if !ok || p.Kind() == "" {
+			log.Warnf("manifests: kind of %v is unknown, ignored", r)
+			continue
+		}
+		gvk := schema.GroupVersionKind{Group: r.Group, Version: r.Version, Kind: p.Kind()}
+		namespaced, ok := manifestsScope(p, gvk)
+		if !ok {
+			return fmt.Errorf("manifests: scope of %v is unknown, namespaced must be set in the config", r)
+		}
+		p.Namespaced = &namespaced
+		w.kinds[gvk] = p
+	}
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	w.fswatcher = fw
+	if err := w.sync(); err != nil {
+		_ = fw.Close()
+		return err
+	}
+	go w.watch()
+	return nil
+}
+
+func (w *fileWatcher) Stop() error {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+		if w.fswatcher != nil {
+			_ = w.fswatcher.Close()
+		}
+	})
+	return nil
+}
+
+func (w *fileWatcher) watch() {
+	// the timer is reset by each event and fired after the changes are finished
+	timer := time.NewTimer(manifestsDebounce)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case e, open := <-w.fswatcher.Events:
+			if !open {
+				return
+			}
+			log.Debugf("manifests: got file event %v", e)
+			timer.Reset(manifestsDebounce)
+		case err, open := <-w.fswatcher.Errors:
+			if !open {
+				return
+			}
+			log.Errorf("manifests: watch %s error: %v", w.dir, err)
+		case <-timer.C:
+			if err := w.sync(); err != nil {
+				log.Errorf("manifests: reload %s error: %v", w.dir, err)
+			}
+		}
+	}
+}
+
+// isManifest checks if the file name is a yaml or json manifest.
+func isManifest(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// sync loads all the manifests in the directory and sends the differences from the last loaded objects to the store.
+func (w *fileWatcher) sync() error {
+	objects := map[manifestKey]manifest{}
+	err := filepath.Walk(w.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// hidden files and directories, such as .git and ..data of the mounted ConfigMaps, are skipped,
+		// the files of ConfigMaps are linked to the directory.
+		if path != w.dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			// adding a watched directory again is ignored
+			return w.fswatcher.Add(path)
+		}
+		if !isManifest(path) {
+			return nil
+		}
+		if err := w.loadFile(path, objects); err != nil {
+			// the other manifests are still served
+			log.Errorf("manifests: load %s error: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := make([]manifestKey, 0, len(objects))
+	for k := range objects {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if a, b := keys[i].gvr, keys[j].gvr; a != b {
+			return a.Group+"/"+a.Version+"/"+a.Resource < b.Group+"/"+b.Version+"/"+b.Resource
+		}
+		if keys[i].namespace != keys[j].namespace {
+			return keys[i].namespace < keys[j].namespace
+		}
+		return keys[i].name < keys[j].name
+	})
+	for _, k := range keys {
+		o := objects[k]
+		old, ok := w.objects[k]
+		switch {
+		case !ok:
+			_ = w.store.OnResourceAdded(k.gvr, w.cluster, o.obj)
+		case !bytes.Equal(old.raw, o.raw):
+			_ = w.store.OnResourceModified(k.gvr, w.cluster, o.obj)
+		}
+	}
+	for k, o := range w.objects {
+		if _, ok := objects[k]; !ok {
+			_ = w.store.OnResourceDeleted(k.gvr, w.cluster, o.obj)
+		}
+	}
+	w.objects = objects
+	return nil
+}
+
+// loadFile loads the objects in the manifests of file to objects, the items of lists are loaded as objects.
+func (w *fileWatcher) loadFile(file string, objects map[manifestKey]manifest) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		u := &unstructured.Unstructured{}
+		if err := dec.Decode(&u.Object); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(u.Object) == 0 {
+			// empty documents
+			continue
+		}
+		if !u.IsList() {
+			w.addObject(file, u, objects)
+			continue
+		}
+		list, err := u.ToList()
+		if err != nil {
+			return err
+		}
+		for i := range list.Items {
+			item := &list.Items[i]
+			if item.GetKind() == "" {
+				// the items of typed lists may not have the type meta
+				item.SetAPIVersion(u.GetAPIVersion())
+				item.SetKind(strings.TrimSuffix(u.GetKind(), "List"))
+			}
+			w.addObject(file, item, objects)
+		}
+	}
+}
+
+func (w *fileWatcher) addObject(file string, u *unstructured.Unstructured, objects map[manifestKey]manifest) {
+	gvk := u.GroupVersionKind()
+	p, ok := w.kinds[gvk]
+	if !ok {
+		log.Debugf("manifests: %v in %s is not cached, ignored", gvk, file)
+		return
+	}
+	if u.GetNamespace() == "" && *p.Namespaced {
+		u.SetNamespace("default")
+	}
+	key := manifestKey{
+		gvr:       store.GroupVersionResource{Group: p.Group, Version: p.Version, Resource: p.Resource},
+		namespace: u.GetNamespace(),
+		name:      u.GetName(),
+	}
+	// the resourceVersion of manifests is not the revision of a cluster, a manifest restored or edited
+	// with a lower one must not be taken as a stale event of the object
+	u.SetResourceVersion("")
+	if o, ok := objects[key]; ok {
+		log.Warnf("manifests: %s %s/%s in %s is overridden by %s", p.Resource, key.namespace, key.name, o.file, file)
+	}
+	raw, err := json.Marshal(u.Object)
+	if err != nil {
+		log.Errorf("manifests: marshal %s %s/%s in %s error: %v", p.Resource, key.namespace, key.name, file, err)
+		return
+	}
+	// the objects are decoded to the same types as the objects watched from api servers
+	var obj runtime.Object = &ObjType{}
+	if scheme.Scheme.Recognizes(gvk) {
+		if obj, err = scheme.Scheme.New(gvk); err != nil {
+			obj = &ObjType{}
+		}
+	}
+	if err := json.Unmarshal(raw, obj); err != nil {
+		log.Errorf("manifests: decode %s %s/%s in %s error: %v", p.Resource, key.namespace, key.name, file, err)
+		return
+	}
+	objects[key] = manifest{file: file, raw: raw, obj: obj}
+}
@@ -0,0 +1,130 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/store"
+	"github.com/DaoCloud/ckube/store/memory"
+)
+
+const podList = `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: pod-1
+    namespace: test
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: pod-2
+`
+
+const fooManifests = `apiVersion: example.io/v1
+kind: Foo
+metadata:
+  name: foo-1
+spec:
+  replicas: 1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: not-cached
+`
+
+func TestFileWatcher(t *testing.T) {
+	clusterScoped := false
+	podsGVR := store.GroupVersionResource{Version: "v1", Resource: "pods"}
+	fooGVR := store.GroupVersionResource{Group: "example.io", Version: "v1", Resource: "foos"}
+	index := map[string]string{"namespace": "{.metadata.namespace}", "name": "{.metadata.name}"}
+	common.InitConfig(&common.Config{Proxies: []common.Proxy{
+		// pods are namespaced according to the scheme
+		{Version: "v1", Resource: "pods", ListKind: "PodList", Index: index},
+		{Group: "example.io", Version: "v1", Resource: "foos", ListKind: "FooList", Namespaced: &clusterScoped, Index: index},
+	}})
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "pods.yaml"), []byte(podList), 0644))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "foos"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "foos", "foo.yml"), []byte(fooManifests), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("# manifests"), 0644))
+
+	s := memory.NewMemoryStore(map[store.GroupVersionResource]map[string]string{podsGVR: index, fooGVR: index})
+	w := NewFileWatcher(dir, "local", []store.GroupVersionResource{podsGVR, fooGVR}, s)
+	assert.NoError(t, w.Start())
+	defer w.Stop()
+
+	_, ok := s.Get(podsGVR, "local", "test", "pod-1").(*corev1.Pod)
+	assert.True(t, ok)
+	// the namespace of namespaced objects is default if not set
+	assert.NotNil(t, s.Get(podsGVR, "local", "default", "pod-2"))
+	foo, ok := s.Get(fooGVR, "local", "", "foo-1").(*ObjType)
+	if assert.True(t, ok) {
+		assert.Equal(t, map[string]interface{}{"replicas": 1.0}, foo.Data["spec"])
+	}
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "foos", "foo.yml"), []byte(`{"apiVersion":"example.io/v1","kind":"Foo","metadata":{"name":"foo-1"},"spec":{"replicas":2}}`), 0644))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "pods.yaml")))
+	assert.Eventually(t, func() bool {
+		foo, ok := s.Get(fooGVR, "local", "", "foo-1").(*ObjType)
+		return ok && foo.Data["spec"].(map[string]interface{})["replicas"] == 2.0 &&
+			s.Get(podsGVR, "local", "test", "pod-1") == nil
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestFileWatcher_ResourceVersion(t *testing.T) {
+	podsGVR := store.GroupVersionResource{Version: "v1", Resource: "pods"}
+	index := map[string]string{"namespace": "{.metadata.namespace}", "name": "{.metadata.name}"}
+	common.InitConfig(&common.Config{Proxies: []common.Proxy{
+		{Version: "v1", Resource: "pods", ListKind: "PodList", Index: index},
+	}})
+	pod := func(rv, node string) []byte {
+		return []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"pod-1","namespace":"test","resourceVersion":"` +
+			rv + `"},"spec":{"nodeName":"` + node + `"}}`)
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "pod.json")
+	assert.NoError(t, os.WriteFile(file, pod("10", "node-1"), 0644))
+
+	st := memory.NewMemoryStore(map[store.GroupVersionResource]map[string]string{podsGVR: index})
+	w := NewFileWatcher(dir, "local", []store.GroupVersionResource{podsGVR}, st)
+	assert.NoError(t, w.Start())
+	defer w.Stop()
+	assert.NotNil(t, st.Get(podsGVR, "local", "test", "pod-1"))
+
+	// a deleted manifest can be restored
+	assert.NoError(t, os.Remove(file))
+	assert.Eventually(t, func() bool {
+		return st.Get(podsGVR, "local", "test", "pod-1") == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.NoError(t, os.WriteFile(file, pod("10", "node-1"), 0644))
+	assert.Eventually(t, func() bool {
+		return st.Get(podsGVR, "local", "test", "pod-1") != nil
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// an edit with a lower resourceVersion is not dropped
+	assert.NoError(t, os.WriteFile(file, pod("5", "node-2"), 0644))
+	assert.Eventually(t, func() bool {
+		p, ok := st.Get(podsGVR, "local", "test", "pod-1").(*corev1.Pod)
+		return ok && p.Spec.NodeName == "node-2"
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestFileWatcher_UnknownScope(t *testing.T) {
+	barGVR := store.GroupVersionResource{Group: "example.io", Version: "v1", Resource: "bars"}
+	common.InitConfig(&common.Config{Proxies: []common.Proxy{
+		{Group: "example.io", Version: "v1", Resource: "bars", ListKind: "BarList"},
+	}})
+	s := memory.NewMemoryStore(map[store.GroupVersionResource]map[string]string{barGVR: {}})
+	w := NewFileWatcher(t.TempDir(), "local", []store.GroupVersionResource{barGVR}, s)
+	// the scope of kinds out of the scheme must be configured
+	assert.Error(t, w.Start())
+}
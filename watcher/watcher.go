@@ -11,6 +11,7 @@ import (
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
@@ -20,21 +21,32 @@ import (
 	"github.com/DaoCloud/ckube/store"
 )
 
+type watchKey struct {
+	gvr     store.GroupVersionResource
+	cluster string
+}
+
 type watcher struct {
 	clusterConfigs map[string]rest.Config
 	resources      []store.GroupVersionResource
 	store          store.Store
 	stop           chan struct{}
 	lock           sync.Mutex
+	// watching stop channel of each watching resource
+	watching map[watchKey]chan struct{}
+	// expanded the clusters serving each resource expanded from patterns
+	expanded map[store.GroupVersionResource]sets.String
 	Watcher
 }
 
-func NewWatcher(clusterConfigs map[string]rest.Config, resources []store.GroupVersionResource, store store.Store) Watcher {
+func NewWatcher(clusterConfigs map[string]rest.Config, resources []store.GroupVersionResource, s store.Store) Watcher {
 	return &watcher{
 		clusterConfigs: clusterConfigs,
 		resources:      resources,
-		store:          store,
+		store:          s,
 		stop:           make(chan struct{}),
+		watching:       map[watchKey]chan struct{}{},
+		expanded:       map[store.GroupVersionResource]sets.String{},
 	}
 }
 
@@ -98,24 +110,65 @@ func (o ObjType) GetObjectKind() schema.ObjectKind {
 }
 
 func (o ObjType) DeepCopyObject() runtime.Object {
-	// o.lock.Lock()
-	// defer o.lock.Unlock()
-	m := map[string]interface{}{}
+	c := &ObjType{
+		TypeMeta: o.TypeMeta,
+		Data:     map[string]interface{}{},
+	}
+	o.ObjectMeta.DeepCopyInto(&c.ObjectMeta)
 	for k, v := range o.Data {
-		m[k] = v
+		// the values are decoded from json
+		c.Data[k] = runtime.DeepCopyJSONValue(v)
 	}
-	return &ObjType{
-		TypeMeta:   o.TypeMeta,
-		ObjectMeta: o.ObjectMeta,
-		Data:       m,
+	return c
+}
+
+// startWatch starts watching r in cluster if it is not being watched.
+func (w *watcher) startWatch(r store.GroupVersionResource, cluster string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	key := watchKey{gvr: r, cluster: cluster}
+	if _, ok := w.watching[key]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	w.watching[key] = stop
+	go w.watchResources(r, cluster, stop)
+}
+
+// stopWatch stops watching r in cluster.
+func (w *watcher) stopWatch(r store.GroupVersionResource, cluster string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	key := watchKey{gvr: r, cluster: cluster}
+	if stop, ok := w.watching[key]; ok {
+		close(stop)
+		delete(w.watching, key)
 	}
 }
 
-func (w *watcher) watchResources(r store.GroupVersionResource, cluster string) {
+// dropped stops watching r in cluster if the objects of r are not cached anymore, such as dropped by the
+// cache limits, the requests of r are passed to api servers and the events would be ignored.
+func (w *watcher) dropped(r store.GroupVersionResource, cluster string, stop <-chan struct{}) bool {
+	if w.store.IsStoreGVR(r) {
+		return false
+	}
+	log.Infof("cluster(%s): %v is not cached, stop watching", cluster, r)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	// the watch may be restarted since r is dropped
+	key := watchKey{gvr: r, cluster: cluster}
+	if ch, ok := w.watching[key]; ok && ch == stop {
+		close(ch)
+		delete(w.watching, key)
+	}
+	return true
+}
+
+func (w *watcher) watchResources(r store.GroupVersionResource, cluster string, stop <-chan struct{}) {
 	gvk := schema.GroupVersionKind{
 		Group:   r.Group,
 		Version: r.Version,
-		Kind:    strings.TrimRight(common.GetGVRKind(r.Group, r.Version, r.Resource), "List"),
+		Kind:    strings.TrimSuffix(common.GetGVRKind(r.Group, r.Version, r.Resource), "List"),
 	}
 	gv := schema.GroupVersion{
 		Group:   r.Group,
@@ -139,14 +192,19 @@ func (w *watcher) watchResources(r store.GroupVersionResource, cluster string) {
 		select {
 		case <-w.stop:
 			return
+		case <-stop:
+			return
 		default:
 		}
+		if w.dropped(r, cluster, stop) {
+			return
+		}
 		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
 		url := ""
 		if r.Group == "" {
-			url = fmt.Sprintf("/api/%s/%s?watch=true", r.Version, r.Resource)
+			url = fmt.Sprintf("/api/%s/%s?watch=true&allowWatchBookmarks=true", r.Version, r.Resource)
 		} else {
-			url = fmt.Sprintf("/apis/%s/%s/%s?watch=true", r.Group, r.Version, r.Resource)
+			url = fmt.Sprintf("/apis/%s/%s/%s?watch=true&allowWatchBookmarks=true", r.Group, r.Version, r.Resource)
 		}
 		first := true
 		ww, err := rt.Get().RequestURI(url).Timeout(time.Hour).Watch(ctx)
@@ -175,6 +233,15 @@ func (w *watcher) watchResources(r store.GroupVersionResource, cluster string) {
 						case watch.Error:
 							log.Warnf("cluster(%s): watch stream(%v) error: %v", cluster, r, rr.Object)
 						}
+						if oo, ok := rr.Object.(v1.Object); ok && rr.Type != watch.Error {
+							// bookmarks only carry the resourceVersion
+							_ = w.store.OnResourceVersion(r, cluster, oo.GetResourceVersion())
+						}
+						if w.dropped(r, cluster, stop) {
+							ww.Stop()
+							cancel()
+							return
+						}
 					} else {
 						log.Warnf("cluster(%s): watch stream(%v) closed", cluster, r)
 						ww.Stop()
@@ -185,6 +252,10 @@ func (w *watcher) watchResources(r store.GroupVersionResource, cluster string) {
 					ww.Stop()
 					cancel()
 					return
+				case <-stop:
+					ww.Stop()
+					cancel()
+					return
 				}
 			}
 		}
@@ -195,7 +266,18 @@ func (w *watcher) watchResources(r store.GroupVersionResource, cluster string) {
 func (w *watcher) Start() error {
 	for _, r := range w.resources {
 		for c := range w.clusterConfigs {
-			go w.watchResources(r, c)
+			w.startWatch(r, c)
+		}
+	}
+	patterns := []common.Proxy{}
+	for _, p := range common.GetConfig().Proxies {
+		if p.IsPattern() {
+			patterns = append(patterns, p)
+		}
+	}
+	if len(patterns) > 0 {
+		for c := range w.clusterConfigs {
+			go w.expandPatterns(c, patterns)
 		}
 	}
 	return nil
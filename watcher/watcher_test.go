@@ -0,0 +1,53 @@
+package watcher
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/DaoCloud/ckube/common"
+	"github.com/DaoCloud/ckube/store"
+	"github.com/DaoCloud/ckube/store/memory"
+)
+
+func TestObjType_DeepCopyObject(t *testing.T) {
+	o := &ObjType{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"apiVersion":"v1","kind":"Test","metadata":{"name":"a","labels":{"k":"v"}},"spec":{"list":[{"a":1}]}}`), o))
+	c := o.DeepCopyObject().(*ObjType)
+	assert.Equal(t, o, c)
+	c.Labels["k"] = "changed"
+	c.Data["spec"].(map[string]interface{})["list"].([]interface{})[0].(map[string]interface{})["a"] = 2.0
+	assert.Equal(t, "v", o.Labels["k"])
+	assert.Equal(t, 1.0, o.Data["spec"].(map[string]interface{})["list"].([]interface{})[0].(map[string]interface{})["a"])
+}
+
+func TestWatcher_Dropped(t *testing.T) {
+	podsGVR := store.GroupVersionResource{Version: "v1", Resource: "pods"}
+	deployGVR := store.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	m := memory.NewMemoryStore(map[store.GroupVersionResource]map[string]string{podsGVR: {}, deployGVR: {}},
+		memory.WithLimits(common.CacheLimit{MaxObjects: 1, Policy: common.LimitPolicyPassthrough}, nil))
+	w := NewWatcher(nil, nil, m).(*watcher)
+	podsStop, deployStop := make(chan struct{}), make(chan struct{})
+	w.watching[watchKey{gvr: podsGVR, cluster: "c1"}] = podsStop
+	w.watching[watchKey{gvr: deployGVR, cluster: "c1"}] = deployStop
+
+	pod := &ObjType{}
+	pod.Namespace, pod.Name = "test", "pod-1"
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "c1", pod))
+	assert.False(t, w.dropped(podsGVR, "c1", podsStop))
+	pod.Name = "pod-2"
+	// pods are passed through after the limit is exceeded
+	assert.NoError(t, m.OnResourceAdded(podsGVR, "c1", pod))
+	assert.True(t, w.dropped(podsGVR, "c1", podsStop))
+	_, ok := <-podsStop
+	assert.False(t, ok)
+	assert.NotContains(t, w.watching, watchKey{gvr: podsGVR, cluster: "c1"})
+
+	assert.False(t, w.dropped(deployGVR, "c1", deployStop))
+
+	// the restarted watch is not stopped by the old one
+	w.watching[watchKey{gvr: podsGVR, cluster: "c1"}] = make(chan struct{})
+	assert.True(t, w.dropped(podsGVR, "c1", podsStop))
+	assert.Contains(t, w.watching, watchKey{gvr: podsGVR, cluster: "c1"})
+}